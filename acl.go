@@ -0,0 +1,315 @@
+package fastdns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ACLAction is the action of an ACL rule.
+type ACLAction byte
+
+// ACL actions.
+const (
+	ACLAllow  ACLAction = iota // serve the request
+	ACLRefuse                  // reply REFUSED
+	ACLDrop                    // drop the request silently
+)
+
+func (a ACLAction) String() string {
+	switch a {
+	case ACLAllow:
+		return "allow"
+	case ACLRefuse:
+		return "refuse"
+	case ACLDrop:
+		return "drop"
+	}
+	return ""
+}
+
+// ACLRule matches the requests by client prefixes, zone and question types.
+type ACLRule struct {
+	// Action is applied to the matched requests.
+	Action ACLAction
+
+	// Prefixes matches the client addresses, empty matches all clients.
+	Prefixes []netip.Prefix
+
+	// Zone matches the domain and its subdomains, empty or "." matches all domains.
+	Zone string
+
+	// Types matches the question types, empty matches all types.
+	Types []Type
+
+	// Recursion only matches the requests with RD flag.
+	Recursion bool
+}
+
+// Match reports whether the rule matches the request from addr.
+func (r *ACLRule) Match(addr netip.Addr, req *Message) bool {
+	if r.Recursion && req.Header.Flags.RD() == 0 {
+		return false
+	}
+
+	if len(r.Types) != 0 {
+		ok := false
+		for _, typ := range r.Types {
+			if typ == req.Question.Type {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if zone := strings.TrimSuffix(r.Zone, "."); zone != "" {
+		domain := req.Domain
+		if len(domain) < len(zone) || !strings.EqualFold(b2s(domain[len(domain)-len(zone):]), zone) {
+			return false
+		}
+		if len(domain) > len(zone) && domain[len(domain)-len(zone)-1] != '.' {
+			return false
+		}
+	}
+
+	if len(r.Prefixes) != 0 {
+		addr = addr.Unmap()
+		for _, prefix := range r.Prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// ACL is a list of rules checked in order, the first matched rule wins and
+// the requests matched by none of the rules are allowed.
+//
+// If Filename is set, the rules are reloaded when the file changes, so every
+// ForkServer child picks up the new rules without restarting.
+type ACL struct {
+	// Filename is the file of rules, see ParseACLRules for the format.
+	Filename string
+
+	// ReloadInterval is the interval to check the changes of Filename, use 10s if empty.
+	ReloadInterval time.Duration
+
+	// ErrorLog specifies an optional logger for the reload errors.
+	ErrorLog *log.Logger
+
+	rules     atomic.Value // []ACLRule
+	modtime   int64
+	checked   int64
+	reloading uint32
+}
+
+// LoadACL loads the rules from filename and returns an ACL reloads on file changes.
+func LoadACL(filename string) (*ACL, error) {
+	acl := &ACL{Filename: filename}
+	if err := acl.Reload(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Rules returns the current rules.
+func (acl *ACL) Rules() []ACLRule {
+	rules, _ := acl.rules.Load().([]ACLRule)
+	return rules
+}
+
+// SetRules replaces the rules atomically.
+func (acl *ACL) SetRules(rules []ACLRule) {
+	acl.rules.Store(rules)
+}
+
+// Reload reads and replaces the rules from Filename, the current rules are kept on error.
+func (acl *ACL) Reload() error {
+	file, err := os.Open(acl.Filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	rules, err := ParseACLRules(file)
+	if err != nil {
+		return err
+	}
+
+	acl.SetRules(rules)
+	atomic.StoreInt64(&acl.modtime, fi.ModTime().UnixNano())
+	atomic.StoreInt64(&acl.checked, time.Now().UnixNano())
+
+	return nil
+}
+
+// Match returns the action of the first rule matches the request from addr.
+func (acl *ACL) Match(addr netip.Addr, req *Message) ACLAction {
+	if acl.Filename != "" {
+		acl.check()
+	}
+
+	rules, _ := acl.rules.Load().([]ACLRule)
+	for i := range rules {
+		if rules[i].Match(addr, req) {
+			return rules[i].Action
+		}
+	}
+
+	return ACLAllow
+}
+
+// check reloads the rules in background if Filename is modified.
+func (acl *ACL) check() {
+	interval := acl.ReloadInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	now := time.Now().UnixNano()
+	if now-atomic.LoadInt64(&acl.checked) < int64(interval) {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&acl.reloading, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreUint32(&acl.reloading, 0)
+		atomic.StoreInt64(&acl.checked, now)
+
+		fi, err := os.Stat(acl.Filename)
+		if err != nil || fi.ModTime().UnixNano() == atomic.LoadInt64(&acl.modtime) {
+			return
+		}
+
+		if err := acl.Reload(); err != nil && acl.ErrorLog != nil {
+			acl.ErrorLog.Printf("reload acl filename=%s error: %+v", acl.Filename, err)
+		}
+	}()
+}
+
+// ParseACLRules parses the rules line by line, each line has the fields
+//
+//	action prefixes [zone] [types]
+//
+// The action is one of allow, refuse and drop. The prefixes is a comma separated
+// list of prefixes or addresses, and "*" matches all clients. The zone defaults
+// to "." and the types is a comma separated list of question types, the special
+// type "recursion" only matches the requests with RD flag. For example
+//
+//	# only allow zone transfers and recursion from internal ranges
+//	allow  10.0.0.0/8,fd00::/8  example.org  AXFR,IXFR
+//	refuse *                    example.org  AXFR,IXFR
+//	allow  10.0.0.0/8,fd00::/8  .            recursion
+//	refuse *                    .            recursion
+//	drop   203.0.113.0/24
+func ParseACLRules(r io.Reader) (rules []ACLRule, err error) {
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Bytes()
+		if i := bytes.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("dns acl line %d: expected action, prefixes, zone and types", lineno)
+		}
+
+		var rule ACLRule
+
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			rule.Action = ACLAllow
+		case "refuse", "deny":
+			rule.Action = ACLRefuse
+		case "drop":
+			rule.Action = ACLDrop
+		default:
+			return nil, fmt.Errorf("dns acl line %d: invalid action %q", lineno, fields[0])
+		}
+
+		if fields[1] != "*" {
+			for _, s := range strings.Split(fields[1], ",") {
+				prefix, err := netip.ParsePrefix(s)
+				if err != nil {
+					addr, err := netip.ParseAddr(s)
+					if err != nil {
+						return nil, fmt.Errorf("dns acl line %d: invalid prefix %q", lineno, s)
+					}
+					prefix = netip.PrefixFrom(addr, addr.BitLen())
+				}
+				rule.Prefixes = append(rule.Prefixes, netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked())
+			}
+		}
+
+		if len(fields) > 2 {
+			rule.Zone = fields[2]
+		}
+
+		if len(fields) > 3 && fields[3] != "*" {
+			for _, s := range strings.Split(fields[3], ",") {
+				if strings.EqualFold(s, "recursion") {
+					rule.Recursion = true
+					continue
+				}
+				typ := ParseType(strings.ToUpper(s))
+				if typ == 0 {
+					return nil, fmt.Errorf("dns acl line %d: invalid type %q", lineno, s)
+				}
+				rule.Types = append(rule.Types, typ)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// Middleware returns a Middleware which refuses or drops the requests by the rules of acl.
+func (acl *ACL) Middleware() Middleware {
+	return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+		switch acl.Match(rw.RemoteAddr().Addr(), req) {
+		case ACLAllow:
+			next.ServeDNSContext(ctx, rw, req)
+		case ACLRefuse:
+			Error(rw, req, RcodeRefused)
+		}
+	})
+}
+
+// ACLMiddleware replies REFUSED to the clients which are not in the allowed prefixes,
+// it is a shortcut of the ACL middleware with an allow rule and a refuse rule.
+func ACLMiddleware(allowed []netip.Prefix) Middleware {
+	acl := &ACL{}
+	if len(allowed) != 0 {
+		acl.SetRules([]ACLRule{{Action: ACLAllow, Prefixes: allowed}, {Action: ACLRefuse}})
+	} else {
+		acl.SetRules([]ACLRule{{Action: ACLRefuse}})
+	}
+	return acl.Middleware()
+}
@@ -0,0 +1,173 @@
+package fastdns
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseACLRules(t *testing.T) {
+	rules, err := ParseACLRules(strings.NewReader(`
+# only allow zone transfers and recursion from internal ranges
+allow  10.0.0.0/8,fd00::1  example.org  AXFR,ixfr
+refuse *                   example.org  AXFR,IXFR
+allow  10.0.0.0/8          .            recursion
+refuse *                   .            recursion
+drop   203.0.113.0/24
+`))
+	if err != nil {
+		t.Fatalf("ParseACLRules error: %+v", err)
+	}
+
+	if len(rules) != 5 {
+		t.Fatalf("ParseACLRules shall return 5 rules, got %+v", rules)
+	}
+	if r := rules[0]; r.Action != ACLAllow || len(r.Prefixes) != 2 || r.Prefixes[1] != netip.MustParsePrefix("fd00::1/128") || r.Zone != "example.org" || len(r.Types) != 2 || r.Types[1] != TypeIXFR {
+		t.Errorf("ParseACLRules rule 0 mismatched: %+v", r)
+	}
+	if r := rules[3]; r.Action != ACLRefuse || r.Prefixes != nil || !r.Recursion || r.Types != nil {
+		t.Errorf("ParseACLRules rule 3 mismatched: %+v", r)
+	}
+	if r := rules[4]; r.Action != ACLDrop || r.Zone != "" {
+		t.Errorf("ParseACLRules rule 4 mismatched: %+v", r)
+	}
+
+	for _, text := range []string{
+		"permit 10.0.0.0/8",
+		"allow 10.0.0.0/33",
+		"allow * . BOGUS",
+		"allow",
+	} {
+		if _, err := ParseACLRules(strings.NewReader(text)); err == nil {
+			t.Errorf("ParseACLRules(%#v) shall return error", text)
+		}
+	}
+}
+
+func TestACLMatch(t *testing.T) {
+	rules, _ := ParseACLRules(strings.NewReader(`
+allow  10.0.0.0/8  example.org  AXFR
+refuse *           example.org  AXFR
+allow  10.0.0.0/8  .            recursion
+refuse *           .            recursion
+drop   203.0.113.0/24
+`))
+
+	acl := &ACL{}
+	acl.SetRules(rules)
+
+	var cases = []struct {
+		Addr   string
+		Domain string
+		Type   Type
+		RD     bool
+		Action ACLAction
+	}{
+		{"10.1.2.3", "example.org", TypeAXFR, false, ACLAllow},
+		{"::ffff:10.1.2.3", "Sub.Example.ORG", TypeAXFR, false, ACLAllow},
+		{"192.0.2.1", "example.org", TypeAXFR, false, ACLRefuse},
+		{"192.0.2.1", "notexample.org", TypeAXFR, false, ACLAllow},
+		{"192.0.2.1", "example.org", TypeA, false, ACLAllow},
+		{"192.0.2.1", "example.org", TypeA, true, ACLRefuse},
+		{"10.1.2.3", "example.org", TypeA, true, ACLAllow},
+		{"203.0.113.9", "example.org", TypeA, false, ACLDrop},
+	}
+
+	for _, c := range cases {
+		req := AcquireMessage()
+		req.SetRequestQuestion(c.Domain, c.Type, ClassINET)
+		if !c.RD {
+			req.Header.Flags &^= 0b0000000100000000
+		}
+		if got := acl.Match(netip.MustParseAddr(c.Addr), req); got != c.Action {
+			t.Errorf("ACL Match(%s, %s, %s, rd=%v) got=%s want=%s", c.Addr, c.Domain, c.Type, c.RD, got, c.Action)
+		}
+		ReleaseMessage(req)
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "acl.conf")
+	if err := os.WriteFile(filename, []byte("refuse 192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatalf("write acl file error: %+v", err)
+	}
+
+	acl, err := LoadACL(filename)
+	if err != nil {
+		t.Fatalf("LoadACL error: %+v", err)
+	}
+	acl.ReloadInterval = time.Millisecond
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	if got := acl.Match(addr, mockMessage()); got != ACLRefuse {
+		t.Errorf("ACL Match shall refuse, got %s", got)
+	}
+
+	if err := os.WriteFile(filename, []byte("drop 192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatalf("write acl file error: %+v", err)
+	}
+	mtime := time.Now().Add(time.Second)
+	_ = os.Chtimes(filename, mtime, mtime)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for acl.Match(addr, mockMessage()) != ACLDrop {
+		if time.Now().After(deadline) {
+			t.Fatalf("ACL shall reload the rules from %s", filename)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// stop the background reloading, which may read the file being written
+	acl.ReloadInterval = time.Hour
+	for atomic.LoadUint32(&acl.reloading) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := os.WriteFile(filename, []byte("bogus\n"), 0644); err != nil {
+		t.Fatalf("write acl file error: %+v", err)
+	}
+	if err := acl.Reload(); err == nil {
+		t.Errorf("ACL Reload shall return error for invalid rules")
+	}
+	if got := acl.Match(addr, mockMessage()); got != ACLDrop {
+		t.Errorf("ACL shall keep the rules on reload error, got %s", got)
+	}
+}
+
+func TestACLMiddlewareRules(t *testing.T) {
+	acl := &ACL{}
+	acl.SetRules([]ACLRule{
+		{Action: ACLDrop, Prefixes: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}},
+		{Action: ACLRefuse, Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}},
+	})
+
+	handler := Chain(&mockServerHandler{}, acl.Middleware())
+
+	var cases = []struct {
+		Addr  string
+		Empty bool
+		Rcode Rcode
+	}{
+		{"10.1.2.3:53", false, RcodeNoError},
+		{"192.0.2.1:53", false, RcodeRefused},
+		{"203.0.113.1:53", true, 0},
+	}
+
+	for _, c := range cases {
+		rw := &MemResponseWriter{Raddr: netip.MustParseAddrPort(c.Addr)}
+		handler.ServeDNS(rw, mockMessage())
+		if c.Empty {
+			if len(rw.Data) != 0 {
+				t.Errorf("ACL Middleware(%s) shall drop, got=%x", c.Addr, rw.Data)
+			}
+			continue
+		}
+		if len(rw.Data) < 4 || Rcode(rw.Data[3]&0x0f) != c.Rcode {
+			t.Errorf("ACL Middleware(%s) error got=%x want rcode=%s", c.Addr, rw.Data, c.Rcode)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package fastdns
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"errors"
 	"net"
 	"net/netip"
@@ -12,6 +15,8 @@ import (
 var (
 	// ErrMaxConns is returned when dns client reaches the max connections limitation.
 	ErrMaxConns = errors.New("dns client reaches the max connections limitation")
+	// ErrInvalidCookie is returned when dns response does not have the expected client cookie.
+	ErrInvalidCookie = errors.New("dns response does not have the expected client cookie")
 )
 
 // Client is an UDP client that supports DNS protocol.
@@ -32,21 +37,98 @@ type Client struct {
 	// ReadTimeout is the maximum duration for reading the dns server response.
 	ReadTimeout time.Duration
 
-	mu    sync.Mutex
-	conns []*net.UDPConn
+	// Cookie enables DNS Cookies (RFC 7873), the client sends a client cookie with
+	// the remembered server cookie of upstream, and verifies the client cookie in responses.
+	Cookie bool
+
+	// ClientSubnet optionally adds the EDNS Client Subnet option (RFC 7871) of the prefix to the
+	// requests, the requests which already have the option, e.g. forwarded from the downstream
+	// clients, are sent as is.
+	ClientSubnet netip.Prefix
+
+	// Multiplex optionally carries the concurrent queries on the number of UDP sockets, instead of
+	// a socket per in-flight query. The responses are demultiplexed by message ID and question, the
+	// sockets are bound to random source ports and rotated periodically, and the IDs are randomized.
+	// The responses without the question section, e.g. the error responses of Error, are dropped
+	// as mismatched.
+	//
+	// Zero means disabled.
+	Multiplex int
+
+	// Coalesce optionally coalesces the identical in-flight queries, which have the same
+	// qname, qtype, qclass, RD bit, CD bit, DO bit and client subnet, into one upstream exchange.
+	Coalesce bool
+
+	// udpSize advertises the EDNS0 UDP payload size in the lookup queries if not zero.
+	udpSize uint16
+
+	mu      sync.Mutex
+	conns   []*net.UDPConn
+	mux     []*muxConn
+	cookies map[netip.AddrPort][]byte
+	calls   map[string]*coalesceCall
 }
 
 // Exchange executes a single DNS transaction, returning
 // a Response for the provided Request.
 func (c *Client) Exchange(req, resp *Message) (err error) {
-	err = c.exchange(req, resp)
-	if err != nil && os.IsTimeout(err) {
-		err = c.exchange(req, resp)
+	return c.ExchangeContext(context.Background(), req, resp)
+}
+
+// ExchangeContext executes a single DNS transaction with the context, the reading of response is
+// limited by the deadline of ctx and aborted once ctx is done.
+func (c *Client) ExchangeContext(ctx context.Context, req, resp *Message) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if c.Coalesce {
+		return c.coalesce(ctx, req, resp)
+	}
+	return c.exchangeRetry(ctx, req, resp)
+}
+
+func (c *Client) exchangeRetry(ctx context.Context, req, resp *Message) (err error) {
+	err = c.exchange(ctx, req, resp)
+	if err != nil && os.IsTimeout(err) && ctx.Err() == nil {
+		err = c.exchange(ctx, req, resp)
+	}
+	if err == nil && c.Cookie && resp.Rcode() == RcodeBADCOOKIE {
+		// retry with the fresh server cookie
+		err = c.exchange(ctx, req, resp)
+	}
+	return err
+}
+
+func (c *Client) exchange(ctx context.Context, req, resp *Message) (err error) {
+	raw := req.Raw
+	if c.Cookie || c.ClientSubnet.IsValid() {
+		msg := AcquireMessage()
+		defer ReleaseMessage(msg)
+		msg.Raw = append(msg.Raw[:0], req.Raw...)
+		opt, _ := req.OPT()
+		if _, ok := opt.Option(EDNSOptionClientSubnet); !ok && c.ClientSubnet.IsValid() {
+			var data [4 + 16]byte
+			msg.AddEDNSOption(EDNSOptionClientSubnet, AppendClientSubnet(data[:0], ClientSubnet{Prefix: c.ClientSubnet}))
+		}
+		if c.Cookie {
+			msg.AddEDNSOption(EDNSOptionCookie, c.cookie(c.AddrPort))
+		}
+		raw = msg.Raw
+	}
+
+	if c.Multiplex > 0 {
+		err = c.exchangeMux(ctx, raw, resp)
+	} else {
+		err = c.exchangeConn(ctx, raw, resp)
 	}
+	if err == nil && c.Cookie {
+		err = c.setCookie(c.AddrPort, resp)
+	}
+
 	return err
 }
 
-func (c *Client) exchange(req, resp *Message) error {
+func (c *Client) exchangeConn(ctx context.Context, raw []byte, resp *Message) error {
 	var fresh bool
 	conn, err := c.get()
 	if conn == nil && err == nil {
@@ -57,35 +139,93 @@ func (c *Client) exchange(req, resp *Message) error {
 		return err
 	}
 
-	_, err = conn.Write(req.Raw)
+	_, err = conn.Write(raw)
 	if err != nil && !fresh {
 		// if error is a pooled conn, let's close it & retry again
 		conn.Close()
 		if conn, err = c.dial(); err != nil {
 			return err
 		}
-		if _, err = conn.Write(req.Raw); err != nil {
+		if _, err = conn.Write(raw); err != nil {
 			return err
 		}
 	}
 
-	if c.ReadTimeout > 0 {
-		err = conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
-		if err != nil {
-			return err
-		}
+	// the zero deadline clears the one of previous query on the pooled socket
+	if err = conn.SetReadDeadline(c.deadline(ctx)); err != nil {
+		conn.Close()
+		return err
+	}
+	if ctx.Done() != nil {
+		// abort the reading once ctx is done, the watcher exits before the socket is reused
+		stop, exited := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				_ = conn.SetReadDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-exited
+		}()
 	}
 
-	resp.Raw = resp.Raw[:cap(resp.Raw)]
-	n, err := conn.Read(resp.Raw)
-	if err == nil {
+	for {
+		resp.Raw = resp.Raw[:cap(resp.Raw)]
+		var n int
+		if n, err = conn.Read(resp.Raw); err != nil {
+			break
+		}
 		resp.Raw = resp.Raw[:n]
-		err = ParseMessage(resp, resp.Raw, false)
+		// skip the late responses of previous queries and the spoofed ones until the deadline
+		if matchResponse(raw, resp.Raw) {
+			err = ParseMessage(resp, resp.Raw, false)
+			break
+		}
+	}
+
+	if err != nil {
+		// the late response of this query may arrive, so the socket shall not be reused
+		conn.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
 	}
 
 	c.put(conn)
 
-	return err
+	return nil
+}
+
+// deadline returns the deadline of reading response, which is the earlier one of ReadTimeout and ctx.
+func (c *Client) deadline(ctx context.Context) (deadline time.Time) {
+	if c.ReadTimeout > 0 {
+		deadline = time.Now().Add(c.ReadTimeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return
+}
+
+// matchResponse reports whether resp is the response of req by message ID and question, the error
+// responses may not have the question section.
+func matchResponse(req, resp []byte) bool {
+	if len(req) < 12 || len(resp) < 12 || req[0] != resp[0] || req[1] != resp[1] {
+		return false
+	}
+	if req[4] == 0 && req[5] == 0 {
+		return true
+	}
+	if resp[4] == 0 && resp[5] == 0 {
+		return resp[3]&0x0f != 0
+	}
+	n := skipQuestions(req, 1)
+	return n > 0 && len(resp) >= n && bytes.EqualFold(resp[12:n], req[12:n])
 }
 
 func (c *Client) dial() (conn *net.UDPConn, err error) {
@@ -124,3 +264,59 @@ func (c *Client) put(conn *net.UDPConn) {
 
 	c.conns = append(c.conns, conn)
 }
+
+// closeIdleConns closes the idle sockets of client.
+func (c *Client) closeIdleConns() {
+	c.mu.Lock()
+	conns := c.conns
+	c.conns = nil
+	c.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// cookie returns the client cookie followed by the remembered server cookie of upstream.
+func (c *Client) cookie(upstream netip.AddrPort) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cookie := c.cookies[upstream]
+	if cookie == nil {
+		if c.cookies == nil {
+			c.cookies = make(map[netip.AddrPort][]byte)
+		}
+		cookie = make([]byte, 8, 40)
+		_, _ = rand.Read(cookie)
+		c.cookies[upstream] = cookie
+	}
+
+	return cookie
+}
+
+// setCookie verifies the client cookie in resp and remembers the server cookie of upstream.
+func (c *Client) setCookie(upstream netip.AddrPort, resp *Message) error {
+	opt, ok := resp.OPT()
+	if !ok {
+		return nil
+	}
+	cookie, ok := opt.Option(EDNSOptionCookie)
+	if !ok {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client := c.cookies[upstream]
+	if len(cookie) < 8 || len(client) < 8 || !bytes.Equal(cookie[:8], client[:8]) {
+		return ErrInvalidCookie
+	}
+	if len(cookie) >= 16 && len(cookie) <= 40 {
+		// copy on write, the remembered cookies may be in use
+		c.cookies[upstream] = append(append(make([]byte, 0, 40), client[:8]...), cookie[8:]...)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package fastdns
+
+import "context"
+
+// coalesceCall is an in-flight upstream exchange shared by the identical queries.
+type coalesceCall struct {
+	done chan struct{}
+	raw  []byte
+	err  error
+}
+
+// coalesce executes the exchange of req once for the identical in-flight queries, and
+// fans the response out to each requester with its own message ID.
+func (c *Client) coalesce(ctx context.Context, req, resp *Message) error {
+	var buf [300]byte
+	key := coalesceKey(buf[:0], req)
+	if key == nil {
+		return c.exchangeRetry(ctx, req, resp)
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[string(key)]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if call.err == context.Canceled || call.err == context.DeadlineExceeded {
+			// the exchange is aborted by the context of leader
+			return c.exchangeRetry(ctx, req, resp)
+		}
+		if call.raw == nil {
+			return call.err
+		}
+		resp.Raw = append(resp.Raw[:0], call.raw...)
+		// restore the ID and the case of question of request, the error responses may not have the question
+		resp.Raw[0], resp.Raw[1] = req.Raw[0], req.Raw[1]
+		if n := skipQuestions(req.Raw, 1); n > 0 && resp.Raw[4] == 0 && resp.Raw[5] == 1 && skipQuestions(resp.Raw, 1) == n {
+			copy(resp.Raw[12:n], req.Raw[12:n])
+		}
+		return ParseMessage(resp, resp.Raw, false)
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]*coalesceCall)
+	}
+	call := &coalesceCall{done: make(chan struct{})}
+	c.calls[string(key)] = call
+	c.mu.Unlock()
+
+	call.err = c.exchangeRetry(ctx, req, resp)
+	if call.err == nil || call.err == ErrInvalidHeader && len(resp.Raw) >= 12 {
+		// the error responses without the question section are shared as well
+		call.raw = append([]byte(nil), resp.Raw...)
+	}
+
+	c.mu.Lock()
+	delete(c.calls, string(key))
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.err
+}
+
+// coalesceKey appends the key of identical queries to dst, that is the lowercase
+// question, RD bit, CD bit, DO bit and client subnet of req. It returns nil if req is malformed.
+func coalesceKey(dst []byte, req *Message) []byte {
+	n := skipQuestions(req.Raw, 1)
+	if n < 0 || req.Header.QDCount != 1 {
+		return nil
+	}
+	for _, b := range req.Raw[12:n] {
+		if 'A' <= b && b <= 'Z' {
+			b |= 0x20
+		}
+		dst = append(dst, b)
+	}
+
+	// the upstreams reply differently with the RD bit, and the validating ones with the CD bit
+	dst = append(dst, byte(req.Header.Flags.RD()), byte(req.Header.Flags.CD()))
+
+	opt, ok := req.OPT()
+	switch {
+	case !ok:
+		dst = append(dst, 0)
+	case opt.DO():
+		dst = append(dst, 2)
+	default:
+		dst = append(dst, 1)
+	}
+	// the responses may be scoped to the client subnet
+	if ecs, ok := opt.Option(EDNSOptionClientSubnet); ok {
+		dst = append(dst, ecs...)
+	}
+
+	return dst
+}
@@ -0,0 +1,167 @@
+package fastdns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientCoalesce(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	var queries int32
+	go func() {
+		buf := make([]byte, 1232)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&queries, 1)
+			data := append([]byte(nil), buf[:n]...)
+			data[2] |= 0b10000000
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				_, _ = conn.WriteTo(data, addr)
+			}()
+		}
+	}()
+
+	client := &Client{
+		AddrPort:    conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout: 2 * time.Second,
+		Coalesce:    true,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, resp := AcquireMessage(), AcquireMessage()
+			defer ReleaseMessage(req)
+			defer ReleaseMessage(resp)
+
+			domain, typ := "example.org", TypeA
+			if i%2 == 1 {
+				domain, typ = "EXAMPLE.org", TypeAAAA
+			}
+			req.SetRequestQuestion(domain, typ, ClassINET)
+			req.Raw[0], req.Raw[1], req.Header.ID = byte(i>>8), byte(i), uint16(i)
+
+			if err := client.Exchange(req, resp); err != nil {
+				t.Errorf("client exchange error: %+v", err)
+				return
+			}
+			if resp.Header.ID != uint16(i) || resp.Question.Type != typ {
+				t.Errorf("client shall fan out the response with own message ID %d, got %x", i, resp.Raw)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("client shall coalesce the identical queries into 2 upstream exchanges, got %d", n)
+	}
+}
+
+func TestClientCoalesceError(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 1232)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// the error response without question section, but with an EDE option
+			msg := AcquireMessage()
+			_ = ParseMessage(msg, buf[:n], true)
+			msg.SetResponseHeader(RcodeRefused, 0)
+			msg.AddEDNSOption(EDNSOptionExtendedError, AppendExtendedError(nil, ExtendedErrorOther, "refused"))
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				_, _ = conn.WriteTo(msg.Raw, addr)
+				ReleaseMessage(msg)
+			}()
+		}
+	}()
+
+	client := &Client{
+		AddrPort:    conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout: 2 * time.Second,
+		Coalesce:    true,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, resp := AcquireMessage(), AcquireMessage()
+			defer ReleaseMessage(req)
+			defer ReleaseMessage(resp)
+
+			req.SetRequestQuestion("example.org", TypeA, ClassINET)
+			req.Raw[0], req.Raw[1], req.Header.ID = byte(i>>8), byte(i), uint16(i)
+
+			err := client.Exchange(req, resp)
+			if err != ErrInvalidHeader || len(resp.Raw) < 12 || resp.Raw[1] != byte(i) || resp.Raw[3]&0x0f != byte(RcodeRefused) {
+				t.Errorf("client shall fan out the error response as is, got %x %+v", resp.Raw, err)
+				return
+			}
+			if edes := resp.ExtendedErrors(); len(edes) != 1 || edes[0].Text != "refused" {
+				t.Errorf("client shall keep the EDE option of error response, got %+v", edes)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCoalesceKey(t *testing.T) {
+	key := func(domain string, do bool) string {
+		req := AcquireMessage()
+		defer ReleaseMessage(req)
+		req.SetRequestQuestion(domain, TypeA, ClassINET)
+		req.SetEDNS(1232, do)
+		return string(coalesceKey(nil, req))
+	}
+
+	if key("example.org", false) != key("Example.ORG", false) {
+		t.Errorf("coalesceKey shall be case insensitive")
+	}
+	if key("example.org", false) == key("example.org", true) {
+		t.Errorf("coalesceKey shall differ in DO bit")
+	}
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	req.SetEDNS(1232, false)
+	// CD = 1
+	req.Header.Flags |= 0b0000000000010000
+	req.Raw[3] = byte(req.Header.Flags)
+	if string(coalesceKey(nil, req)) == key("example.org", false) {
+		t.Errorf("coalesceKey shall differ in CD bit")
+	}
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	req.SetEDNS(1232, false)
+	// RD = 0, CD = 0
+	req.Header.Flags &^= 0b0000000100010000
+	req.Raw[2], req.Raw[3] = byte(req.Header.Flags>>8), byte(req.Header.Flags)
+	if string(coalesceKey(nil, req)) == key("example.org", false) {
+		t.Errorf("coalesceKey shall differ in RD bit")
+	}
+}
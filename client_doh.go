@@ -0,0 +1,149 @@
+package fastdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidContentType is returned when doh server does not reply application/dns-message.
+	ErrInvalidContentType = errors.New("dns doh server does not reply application/dns-message")
+)
+
+// DoHClient is a DNS-over-HTTPS client, see RFC 8484.
+type DoHClient struct {
+	// Endpoint is the URL of DoH server, e.g. https://1.1.1.1/dns-query
+	Endpoint string
+
+	// UseGET sends the requests by GET with the base64url "dns" parameter, which is
+	// cache friendly, otherwise the requests are sent by POST.
+	UseGET bool
+
+	// UserAgent optionally sets the User-Agent header of requests.
+	UserAgent string
+
+	// Timeout is the maximum duration of a DNS transaction, zero means no timeout.
+	Timeout time.Duration
+
+	// HTTPClient optionally specifies the http client to send requests, a client with
+	// HTTP/2 enabled transport is used if nil, so the connections are reused.
+	HTTPClient *http.Client
+
+	once   sync.Once
+	client *http.Client
+}
+
+// Exchange executes a single DNS transaction, returning
+// a Response for the provided Request.
+func (c *DoHClient) Exchange(req, resp *Message) error {
+	return c.ExchangeContext(context.Background(), req, resp)
+}
+
+// ExchangeContext executes a single DNS transaction with ctx, returning
+// a Response for the provided Request.
+func (c *DoHClient) ExchangeContext(ctx context.Context, req, resp *Message) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var hreq *http.Request
+	var err error
+	if c.UseGET {
+		// use zero ID for http caches, see RFC 8484 section 4.1
+		msg := AcquireMessage()
+		defer ReleaseMessage(msg)
+		msg.Raw = append(msg.Raw[:0], req.Raw...)
+		msg.Raw[0], msg.Raw[1] = 0, 0
+
+		sep := "?"
+		if strings.Contains(c.Endpoint, "?") {
+			sep = "&"
+		}
+		hreq, err = http.NewRequestWithContext(ctx, http.MethodGet, c.Endpoint+sep+"dns="+base64.RawURLEncoding.EncodeToString(msg.Raw), nil)
+	} else {
+		hreq, err = http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint, bytes.NewReader(req.Raw))
+		if err == nil {
+			hreq.Header.Set("content-type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	hreq.Header.Set("accept", "application/dns-message")
+	if c.UserAgent != "" {
+		hreq.Header.Set("user-agent", c.UserAgent)
+	}
+
+	hresp, err := c.httpClient().Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+
+	if hresp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, hresp.Body)
+		return fmt.Errorf("dns doh server replies unexpected status: %s", hresp.Status)
+	}
+	if mediatype, _, _ := mime.ParseMediaType(hresp.Header.Get("content-type")); mediatype != "application/dns-message" {
+		_, _ = io.Copy(io.Discard, hresp.Body)
+		return ErrInvalidContentType
+	}
+
+	resp.Raw, err = readMessage(resp.Raw[:0], hresp.Body)
+	if err != nil {
+		return err
+	}
+
+	err = ParseMessage(resp, resp.Raw, false)
+	if err == nil && c.UseGET {
+		// restore the ID of request
+		resp.Header.ID = req.Header.ID
+		resp.Raw[0], resp.Raw[1] = byte(req.Header.ID>>8), byte(req.Header.ID)
+	}
+
+	return err
+}
+
+func (c *DoHClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	c.once.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ForceAttemptHTTP2 = true
+		c.client = &http.Client{Transport: transport}
+	})
+	return c.client
+}
+
+// readMessage reads a dns message up to 65535 bytes from r and appends it to dst.
+func readMessage(dst []byte, r io.Reader) ([]byte, error) {
+	for {
+		if len(dst) == cap(dst) {
+			if len(dst) >= 65535 {
+				return dst, ErrInvalidAnswer
+			}
+			dst = append(dst, 0)[:len(dst)]
+		}
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+}
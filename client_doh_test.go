@@ -0,0 +1,133 @@
+package fastdns
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockDoHHandler is a net/http port of the fastdoh handler.
+type mockDoHHandler struct {
+	DNSHandler Handler
+}
+
+func (h *mockDoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	switch r.Method {
+	case http.MethodGet:
+		body, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		body, _ = io.ReadAll(r.Body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw, req := &MemResponseWriter{}, AcquireMessage()
+	defer ReleaseMessage(req)
+	if v, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		rw.Raddr = v
+	}
+
+	err := ParseMessage(req, body, true)
+	if err != nil {
+		Error(rw, req, RcodeFormErr)
+	} else {
+		h.DNSHandler.ServeDNS(rw, req)
+	}
+
+	w.Header().Set("content-type", "application/dns-message")
+	_, _ = w.Write(rw.Data)
+}
+
+func TestDoHClientExchange(t *testing.T) {
+	var conns, proto int32
+	handler := &mockDoHHandler{DNSHandler: &mockServerHandler{}}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&proto, int32(r.ProtoMajor))
+		handler.ServeHTTP(w, r)
+	}))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	for _, get := range []bool{false, true} {
+		client := &DoHClient{
+			Endpoint:   server.URL + "/dns-query",
+			UseGET:     get,
+			Timeout:    time.Second,
+			HTTPClient: server.Client(),
+		}
+
+		for i := 0; i < 3; i++ {
+			req, resp := AcquireMessage(), AcquireMessage()
+			req.SetRequestQuestion("example.org", TypeA, ClassINET)
+			if err := client.Exchange(req, resp); err != nil {
+				t.Fatalf("DoHClient(get=%v) exchange error: %+v", get, err)
+			}
+			if resp.Header.ID != req.Header.ID || resp.Header.ANCount != 1 || string(resp.Domain) != "example.org" {
+				t.Errorf("DoHClient(get=%v) mismatched response: %x", get, resp.Raw)
+			}
+			ReleaseMessage(req)
+			ReleaseMessage(resp)
+		}
+	}
+
+	if p := atomic.LoadInt32(&proto); p != 2 {
+		t.Errorf("DoHClient shall use HTTP/2, got HTTP/%d", p)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("DoHClient shall reuse the HTTP/2 connection, got %d connections", n)
+	}
+}
+
+func TestDoHClientError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/charset" {
+			// echo the query as the response
+			body, _ := io.ReadAll(r.Body)
+			body[2] |= 0b10000000
+			w.Header().Set("content-type", "Application/DNS-Message; charset=binary")
+			_, _ = w.Write(body)
+			return
+		}
+		if r.URL.Path == "/text" {
+			w.Header().Set("content-type", "text/plain")
+			_, _ = io.WriteString(w, "hello")
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	client := &DoHClient{Endpoint: server.URL + "/dns-query"}
+	if err := client.Exchange(req, resp); err == nil {
+		t.Errorf("DoHClient shall return error for status 404")
+	}
+
+	client = &DoHClient{Endpoint: server.URL + "/charset"}
+	if err := client.Exchange(req, resp); err != nil {
+		t.Errorf("DoHClient shall accept the parameters of content type, got %+v", err)
+	}
+
+	client = &DoHClient{Endpoint: server.URL + "/text"}
+	if err := client.Exchange(req, resp); err != ErrInvalidContentType {
+		t.Errorf("DoHClient shall return ErrInvalidContentType, got %+v", err)
+	}
+}
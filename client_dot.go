@@ -0,0 +1,412 @@
+package fastdns
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSPKIPinMismatch is returned when dns dot server certificate does not match the pinned SPKI.
+	ErrSPKIPinMismatch = errors.New("dns dot server certificate does not match the pinned spki")
+	// ErrConnClosed is returned when dns connection is closed before the response is received.
+	ErrConnClosed = errors.New("dns connection is closed before the response is received")
+)
+
+// dotMaxPipeline is the number of in-flight queries on a connection before dialing a new one.
+const dotMaxPipeline = 64
+
+// DoTClient is a DNS-over-TLS client, see RFC 7858. The queries are pipelined on
+// persistent TLS connections and matched with the responses by message ID.
+type DoTClient struct {
+	// AddrPort is the address of DoT server, the port is usually 853.
+	AddrPort netip.AddrPort
+
+	// ServerName is used as SNI and to verify the server certificate, use TLSConfig.ServerName if empty.
+	// If both are empty, the certificate is verified against the IP address, or only by SPKIPins if not empty.
+	ServerName string
+
+	// SPKIPins optionally pins the server certificate by the base64 encoded SHA-256
+	// digests of the Subject Public Key Info, see RFC 7858 section 4.2.
+	SPKIPins []string
+
+	// TLSConfig optionally specifies the TLS configuration, e.g. RootCAs.
+	TLSConfig *tls.Config
+
+	// MaxIdleConns controls the maximum number of idle (keep-alive)
+	// connections. Zero means no limit.
+	MaxIdleConns int
+
+	// MaxConns optionally limits the total number of connections, the queries are
+	// pipelined on the existing connections on limit.
+	//
+	// Zero means no limit.
+	MaxConns int
+
+	// ReadTimeout is the maximum duration for reading the dns server response.
+	ReadTimeout time.Duration
+
+	// IdleTimeout is the maximum duration of an idle connection, use 30s if empty.
+	IdleTimeout time.Duration
+
+	once      sync.Once
+	tlsConfig *tls.Config
+
+	dialMu sync.Mutex
+	mu     sync.Mutex
+	conns  []*dotConn
+}
+
+// Exchange executes a single DNS transaction, returning
+// a Response for the provided Request.
+func (c *DoTClient) Exchange(req, resp *Message) error {
+	return c.ExchangeContext(context.Background(), req, resp)
+}
+
+// ExchangeContext executes a single DNS transaction with ctx, returning
+// a Response for the provided Request.
+func (c *DoTClient) ExchangeContext(ctx context.Context, req, resp *Message) error {
+	if c.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.ReadTimeout)
+		defer cancel()
+	}
+
+	fresh, err := c.exchange(ctx, req, resp)
+	if err != nil && !fresh && ctx.Err() == nil {
+		// the pooled connection may be closed by server, let's retry again
+		_, err = c.exchange(ctx, req, resp)
+	}
+	return err
+}
+
+func (c *DoTClient) exchange(ctx context.Context, req, resp *Message) (fresh bool, err error) {
+	if len(req.Raw) < 12 {
+		return false, ErrInvalidHeader
+	}
+
+	dc, fresh, err := c.get(ctx)
+	if err != nil {
+		return fresh, err
+	}
+
+	id, ch, err := dc.send(req.Raw, c.ReadTimeout)
+	if err != nil {
+		dc.close(err)
+		return fresh, err
+	}
+
+	select {
+	case data, ok := <-ch:
+		if !ok {
+			return fresh, dc.err
+		}
+		resp.Raw = append(resp.Raw[:0], data...)
+		// restore the ID of request
+		resp.Raw[0], resp.Raw[1] = req.Raw[0], req.Raw[1]
+		err = ParseMessage(resp, resp.Raw, false)
+	case <-ctx.Done():
+		dc.cancel(id)
+		err = ctx.Err()
+	}
+
+	c.put(dc)
+
+	return fresh, err
+}
+
+func (c *DoTClient) config() *tls.Config {
+	c.once.Do(func() {
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if c.ServerName != "" {
+			config.ServerName = c.ServerName
+		}
+		named := config.ServerName != ""
+		if !named {
+			config.ServerName = c.AddrPort.Addr().String()
+		}
+
+		if len(c.SPKIPins) != 0 {
+			pins := c.SPKIPins
+			verify := !config.InsecureSkipVerify && named
+			roots, name := config.RootCAs, config.ServerName
+			// verify the certificate by pins, and by roots if the server name is set.
+			config.InsecureSkipVerify = true
+			config.VerifyConnection = func(cs tls.ConnectionState) error {
+				if len(cs.PeerCertificates) == 0 {
+					return ErrSPKIPinMismatch
+				}
+				// the unverified certificates other than leaf may be sent by anyone, so only the
+				// leaf is pinned if the chain is not verified.
+				chains := [][]*x509.Certificate{cs.PeerCertificates[:1]}
+				if verify {
+					opts := x509.VerifyOptions{Roots: roots, DNSName: name, Intermediates: x509.NewCertPool()}
+					for _, cert := range cs.PeerCertificates[1:] {
+						opts.Intermediates.AddCert(cert)
+					}
+					var err error
+					if chains, err = cs.PeerCertificates[0].Verify(opts); err != nil {
+						return err
+					}
+				}
+				for _, chain := range chains {
+					for _, cert := range chain {
+						digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+						pin := base64.StdEncoding.EncodeToString(digest[:])
+						for _, s := range pins {
+							if s == pin {
+								return nil
+							}
+						}
+					}
+				}
+				return ErrSPKIPinMismatch
+			}
+		}
+
+		c.tlsConfig = config
+	})
+	return c.tlsConfig
+}
+
+func (c *DoTClient) dial(ctx context.Context) (*dotConn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", c.AddrPort.String())
+	if err != nil {
+		return nil, err
+	}
+
+	tc := tls.Client(conn, c.config())
+	if err = tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	dc := &dotConn{
+		client:  c,
+		conn:    tc,
+		pending: make(map[uint16]chan []byte),
+	}
+	dc.idle()
+
+	go dc.readLoop()
+
+	return dc, nil
+}
+
+// get returns the least loaded connection, or dials a new one if all connections are busy.
+func (c *DoTClient) get(ctx context.Context) (dc *dotConn, fresh bool, err error) {
+	if dc = c.pick(); dc != nil {
+		return dc, false, nil
+	}
+
+	// serialize dialing, so the concurrent queries are pipelined on the new connection
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+
+	if dc = c.pick(); dc != nil {
+		return dc, false, nil
+	}
+
+	if dc, err = c.dial(ctx); err != nil {
+		return nil, true, err
+	}
+
+	c.mu.Lock()
+	c.conns = append(c.conns, dc)
+	c.mu.Unlock()
+
+	return dc, true, nil
+}
+
+// pick returns the least loaded connection, or nil if all connections are busy.
+func (c *DoTClient) pick() (dc *dotConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var inflight int
+	for _, conn := range c.conns {
+		if n := conn.inflight(); dc == nil || n < inflight {
+			dc, inflight = conn, n
+		}
+	}
+	if dc != nil && (inflight < dotMaxPipeline || (c.MaxConns != 0 && len(c.conns) >= c.MaxConns)) {
+		return dc
+	}
+
+	return nil
+}
+
+// put closes the connection if it is idle and exceeds the MaxIdleConns.
+func (c *DoTClient) put(dc *dotConn) {
+	if c.MaxIdleConns == 0 || dc.inflight() != 0 {
+		return
+	}
+
+	c.mu.Lock()
+	idles := 0
+	for _, conn := range c.conns {
+		if conn.inflight() == 0 {
+			idles++
+		}
+	}
+	c.mu.Unlock()
+
+	if idles > c.MaxIdleConns {
+		dc.close(nil)
+	}
+}
+
+func (c *DoTClient) remove(dc *dotConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, conn := range c.conns {
+		if conn == dc {
+			c.conns = append(c.conns[:i], c.conns[i+1:]...)
+			break
+		}
+	}
+}
+
+// dotConn is a persistent DoT connection with the pending queries.
+type dotConn struct {
+	client *DoTClient
+	conn   *tls.Conn
+	wmu    sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	closed  bool
+	err     error
+}
+
+func (dc *dotConn) inflight() int {
+	dc.mu.Lock()
+	n := len(dc.pending)
+	dc.mu.Unlock()
+	return n
+}
+
+// idle sets the read deadline of idle timeout, it must be called with no pending queries.
+func (dc *dotConn) idle() {
+	timeout := dc.client.IdleTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	_ = dc.conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// send writes the framed query with an unused ID, and returns the ID and the channel of response.
+func (dc *dotConn) send(raw []byte, timeout time.Duration) (id uint16, ch chan []byte, err error) {
+	ch = make(chan []byte, 1)
+
+	dc.mu.Lock()
+	if dc.closed {
+		dc.mu.Unlock()
+		return 0, nil, ErrConnClosed
+	}
+	id = uint16(raw[0])<<8 | uint16(raw[1])
+	for dc.pending[id] != nil {
+		id = uint16(fastrandn(65536))
+	}
+	if len(dc.pending) == 0 {
+		_ = dc.conn.SetReadDeadline(time.Time{})
+	}
+	dc.pending[id] = ch
+	dc.mu.Unlock()
+
+	msg := AcquireMessage()
+	defer ReleaseMessage(msg)
+	msg.Raw = append(msg.Raw[:0], byte(len(raw)>>8), byte(len(raw)))
+	msg.Raw = append(msg.Raw, raw...)
+	msg.Raw[2], msg.Raw[3] = byte(id>>8), byte(id)
+
+	dc.wmu.Lock()
+	if timeout > 0 {
+		_ = dc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err = dc.conn.Write(msg.Raw)
+	dc.wmu.Unlock()
+
+	return id, ch, err
+}
+
+// cancel removes the pending query of id.
+func (dc *dotConn) cancel(id uint16) {
+	dc.mu.Lock()
+	if dc.pending[id] != nil {
+		delete(dc.pending, id)
+		if len(dc.pending) == 0 {
+			dc.idle()
+		}
+	}
+	dc.mu.Unlock()
+}
+
+// close closes the connection and wakes up the pending queries.
+func (dc *dotConn) close(err error) {
+	dc.mu.Lock()
+	if dc.closed {
+		dc.mu.Unlock()
+		return
+	}
+	if err == nil {
+		err = ErrConnClosed
+	}
+	dc.closed, dc.err = true, err
+	for id, ch := range dc.pending {
+		close(ch)
+		delete(dc.pending, id)
+	}
+	dc.mu.Unlock()
+
+	dc.conn.Close()
+	dc.client.remove(dc)
+}
+
+// readLoop reads the framed responses and dispatches them to the pending queries by ID.
+func (dc *dotConn) readLoop() {
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(dc.conn, length[:]); err != nil {
+			dc.close(err)
+			return
+		}
+
+		data := make([]byte, int(length[0])<<8|int(length[1]))
+		if _, err := io.ReadFull(dc.conn, data); err != nil {
+			dc.close(err)
+			return
+		}
+		if len(data) < 12 {
+			continue
+		}
+
+		id := uint16(data[0])<<8 | uint16(data[1])
+
+		dc.mu.Lock()
+		ch := dc.pending[id]
+		if ch != nil {
+			delete(dc.pending, id)
+			if len(dc.pending) == 0 {
+				dc.idle()
+			}
+		}
+		dc.mu.Unlock()
+
+		if ch != nil {
+			ch <- data
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package fastdns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"log"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mockCertificate(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %+v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error: %+v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+type countListener struct {
+	net.Listener
+	accepts int32
+}
+
+func (ln *countListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&ln.accepts, 1)
+	}
+	return conn, err
+}
+
+func mockDoTServer(t *testing.T, name string, sni *atomic.Value) (*countListener, *x509.Certificate) {
+	certificate, cert := mockCertificate(t, name)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp error: %+v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if sni != nil {
+				sni.Store(hello.ServerName)
+			}
+			return nil, nil
+		},
+	}
+
+	cl := &countListener{Listener: tls.NewListener(ln, config)}
+
+	s := &Server{
+		Handler:  &mockServerHandler{},
+		ErrorLog: log.Default(),
+	}
+	go func() {
+		_ = s.ServeListener(cl)
+	}()
+
+	return cl, cert
+}
+
+func TestDoTClientExchange(t *testing.T) {
+	ln, cert := mockDoTServer(t, "dns.example", nil)
+	defer ln.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	client := &DoTClient{
+		AddrPort:    ln.Addr().(*net.TCPAddr).AddrPort(),
+		TLSConfig:   &tls.Config{RootCAs: roots},
+		ReadTimeout: 2 * time.Second,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, resp := AcquireMessage(), AcquireMessage()
+			defer ReleaseMessage(req)
+			defer ReleaseMessage(resp)
+
+			req.SetRequestQuestion("example.org", TypeA, ClassINET)
+			// same ID for all queries, which are rewritten on the connection
+			req.Raw[0], req.Raw[1], req.Header.ID = 0, 1, 1
+
+			if err := client.Exchange(req, resp); err != nil {
+				t.Errorf("DoTClient exchange error: %+v", err)
+				return
+			}
+			if resp.Header.ID != 1 || resp.Header.ANCount != 1 || string(resp.Domain) != "example.org" {
+				t.Errorf("DoTClient mismatched response: %x", resp.Raw)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&ln.accepts); n != 1 {
+		t.Errorf("DoTClient shall pipeline queries on one connection, got %d connections", n)
+	}
+}
+
+func TestDoTClientSNI(t *testing.T) {
+	var sni atomic.Value
+	ln, cert := mockDoTServer(t, "dns.example", &sni)
+	defer ln.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	client := &DoTClient{
+		AddrPort:    ln.Addr().(*net.TCPAddr).AddrPort(),
+		ServerName:  "dns.example",
+		TLSConfig:   &tls.Config{RootCAs: roots},
+		ReadTimeout: 2 * time.Second,
+	}
+	if err := client.Exchange(req, resp); err != nil {
+		t.Fatalf("DoTClient exchange error: %+v", err)
+	}
+	if name, _ := sni.Load().(string); name != "dns.example" {
+		t.Errorf("DoTClient shall send SNI, got %#v", name)
+	}
+
+	client = &DoTClient{
+		AddrPort:    ln.Addr().(*net.TCPAddr).AddrPort(),
+		ServerName:  "other.example",
+		TLSConfig:   &tls.Config{RootCAs: roots},
+		ReadTimeout: 2 * time.Second,
+	}
+	if err := client.Exchange(req, resp); err == nil {
+		t.Errorf("DoTClient shall reject the certificate of other name")
+	}
+}
+
+func TestDoTClientSPKIPins(t *testing.T) {
+	ln, cert := mockDoTServer(t, "dns.example", nil)
+	defer ln.Close()
+
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	client := &DoTClient{
+		AddrPort:    ln.Addr().(*net.TCPAddr).AddrPort(),
+		SPKIPins:    []string{pin},
+		ReadTimeout: 2 * time.Second,
+	}
+	if err := client.Exchange(req, resp); err != nil {
+		t.Errorf("DoTClient shall accept the pinned certificate, got %+v", err)
+	}
+
+	client = &DoTClient{
+		AddrPort:    ln.Addr().(*net.TCPAddr).AddrPort(),
+		SPKIPins:    []string{base64.StdEncoding.EncodeToString(make([]byte, 32))},
+		ReadTimeout: 2 * time.Second,
+	}
+	if err := client.Exchange(req, resp); err == nil {
+		t.Errorf("DoTClient shall reject the certificate mismatched pins")
+	}
+
+	// the server name of TLSConfig is verified as well as the pins
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	for name, ok := range map[string]bool{"dns.example": true, "other.example": false} {
+		client = &DoTClient{
+			AddrPort:    ln.Addr().(*net.TCPAddr).AddrPort(),
+			SPKIPins:    []string{pin},
+			TLSConfig:   &tls.Config{ServerName: name, RootCAs: roots},
+			ReadTimeout: 2 * time.Second,
+		}
+		if err := client.Exchange(req, resp); (err == nil) != ok {
+			t.Errorf("DoTClient with TLSConfig.ServerName=%s return %+v", name, err)
+		}
+	}
+}
+
+func TestDoTClientSPKIPinsUnverifiedChain(t *testing.T) {
+	// the unrelated leaf is sent with the pinned intermediate, which is public
+	certificate, _ := mockCertificate(t, "attacker.example")
+	_, pinned := mockCertificate(t, "pinned.example")
+	certificate.Certificate = append(certificate.Certificate, pinned.Raw)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatalf("listen tls error: %+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		_ = (&Server{Handler: &mockServerHandler{}, ErrorLog: log.Default()}).ServeListener(ln)
+	}()
+
+	digest := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+	client := &DoTClient{
+		AddrPort:    ln.Addr().(*net.TCPAddr).AddrPort(),
+		SPKIPins:    []string{base64.StdEncoding.EncodeToString(digest[:])},
+		ReadTimeout: 2 * time.Second,
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	if err := client.Exchange(req, resp); err == nil {
+		t.Errorf("DoTClient shall only pin the leaf of unverified chain")
+	}
+}
+
+func TestDoTClientIdleTimeout(t *testing.T) {
+	ln, _ := mockDoTServer(t, "dns.example", nil)
+	defer ln.Close()
+
+	client := &DoTClient{
+		AddrPort:    netip.MustParseAddrPort(ln.Addr().String()),
+		TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+		ReadTimeout: 2 * time.Second,
+		IdleTimeout: 50 * time.Millisecond,
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	if err := client.Exchange(req, resp); err != nil {
+		t.Fatalf("DoTClient exchange error: %+v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	client.mu.Lock()
+	conns := len(client.conns)
+	client.mu.Unlock()
+	if conns != 0 {
+		t.Errorf("DoTClient shall close the idle connections, got %d", conns)
+	}
+
+	if err := client.Exchange(req, resp); err != nil {
+		t.Fatalf("DoTClient exchange error: %+v", err)
+	}
+	if n := atomic.LoadInt32(&ln.accepts); n != 2 {
+		t.Errorf("DoTClient shall dial a new connection after idle timeout, got %d connections", n)
+	}
+}
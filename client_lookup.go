@@ -0,0 +1,298 @@
+package fastdns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lookupMaxCNAMEs is the maximum length of CNAME chain to follow.
+const lookupMaxCNAMEs = 8
+
+// LookupHost looks up the given host, returning a slice of its addresses, A records before AAAA records.
+func (c *Client) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
+	ips, err := c.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, nil
+}
+
+// LookupNetIP looks up host, returning a slice of its IP addresses of network "ip", "ip4" or "ip6".
+// The A and AAAA records of network "ip" are queried concurrently and merged.
+func (c *Client) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+
+	var types []Type
+	switch network {
+	case "ip":
+		types = []Type{TypeA, TypeAAAA}
+	case "ip4":
+		types = []Type{TypeA}
+	case "ip6":
+		types = []Type{TypeAAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	results := make([][]netip.Addr, len(types))
+	errs := make([]error, len(types))
+	var wg sync.WaitGroup
+	for i, typ := range types {
+		wg.Add(1)
+		go func(i int, typ Type) {
+			defer wg.Done()
+			_, errs[i] = c.lookup(ctx, host, typ, func(resp *Message, data []byte) {
+				if ip, ok := netip.AddrFromSlice(data); ok {
+					results[i] = append(results[i], ip)
+				}
+			})
+		}(i, typ)
+	}
+	wg.Wait()
+
+	var ips []netip.Addr
+	for _, result := range results {
+		ips = append(ips, result...)
+	}
+	if len(ips) == 0 {
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, c.dnsError(host, errNoSuchHost)
+	}
+
+	return ips, nil
+}
+
+// LookupCNAME returns the canonical name for the given host, by following the CNAME chain of its A records.
+// Unlike net.Resolver, the names are returned without the trailing dot, as the server helpers accept.
+func (c *Client) LookupCNAME(ctx context.Context, host string) (cname string, err error) {
+	return c.lookup(ctx, host, TypeA, func(resp *Message, data []byte) {})
+}
+
+// LookupMX returns the MX records for the given domain name sorted by preference.
+func (c *Client) LookupMX(ctx context.Context, name string) (mxs []net.MX, err error) {
+	_, err = c.lookup(ctx, name, TypeMX, func(resp *Message, data []byte) {
+		if len(data) > 2 {
+			mxs = append(mxs, net.MX{
+				Host: string(resp.DecodeName(nil, data[2:])),
+				Pref: uint16(data[0])<<8 | uint16(data[1]),
+			})
+		}
+	})
+	if err == nil && len(mxs) == 0 {
+		err = c.dnsError(name, errNoSuchHost)
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return
+}
+
+// LookupSRV looks up the SRV records of _service._proto.name sorted by priority and weight,
+// or of name directly if both service and proto are empty. It returns the canonical name.
+func (c *Client) LookupSRV(ctx context.Context, service, proto, name string) (cname string, srvs []net.SRV, err error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	cname, err = c.lookup(ctx, target, TypeSRV, func(resp *Message, data []byte) {
+		if len(data) > 6 {
+			srvs = append(srvs, net.SRV{
+				Target:   string(resp.DecodeName(nil, data[6:])),
+				Port:     uint16(data[4])<<8 | uint16(data[5]),
+				Priority: uint16(data[0])<<8 | uint16(data[1]),
+				Weight:   uint16(data[2])<<8 | uint16(data[3]),
+			})
+		}
+	})
+	if err == nil && len(srvs) == 0 {
+		err = c.dnsError(target, errNoSuchHost)
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	return
+}
+
+// LookupTXT returns the TXT records for the given domain name, the character strings of a record are concatenated.
+func (c *Client) LookupTXT(ctx context.Context, name string) (txts []string, err error) {
+	_, err = c.lookup(ctx, name, TypeTXT, func(resp *Message, data []byte) {
+		var txt []byte
+		for len(data) > 0 && int(data[0]) < len(data) {
+			l := int(data[0])
+			txt = append(txt, data[1:1+l]...)
+			data = data[1+l:]
+		}
+		txts = append(txts, string(txt))
+	})
+	if err == nil && len(txts) == 0 {
+		err = c.dnsError(name, errNoSuchHost)
+	}
+	return
+}
+
+// LookupNS returns the NS records for the given domain name.
+func (c *Client) LookupNS(ctx context.Context, name string) (nss []net.NS, err error) {
+	_, err = c.lookup(ctx, name, TypeNS, func(resp *Message, data []byte) {
+		nss = append(nss, net.NS{Host: string(resp.DecodeName(nil, data))})
+	})
+	if err == nil && len(nss) == 0 {
+		err = c.dnsError(name, errNoSuchHost)
+	}
+	return
+}
+
+// LookupAddr performs a reverse lookup for the given address, returning a list of names mapping to that address.
+func (c *Client) LookupAddr(ctx context.Context, addr string) (names []string, err error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	_, err = c.lookup(ctx, reverseName(ip), TypePTR, func(resp *Message, data []byte) {
+		names = append(names, string(resp.DecodeName(nil, data)))
+	})
+	if err == nil && len(names) == 0 {
+		err = c.dnsError(addr, errNoSuchHost)
+	}
+	return
+}
+
+const errNoSuchHost = "no such host"
+
+// lookup queries the records of name, follows the CNAME chain and calls f with the records of the canonical
+// name. It returns the canonical name, the responses of NODATA are not errors.
+func (c *Client) lookup(ctx context.Context, name string, typ Type, f func(resp *Message, data []byte)) (cname string, err error) {
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+
+	name = strings.TrimSuffix(name, ".")
+	cname = name
+
+	for i := 0; i <= lookupMaxCNAMEs; i++ {
+		if err = ctx.Err(); err != nil {
+			return "", c.dnsError(name, err.Error())
+		}
+
+		req.Header.Flags = 0
+		req.SetRequestQuestion(cname, typ, ClassINET)
+		if c.udpSize != 0 {
+			req.SetEDNS(c.udpSize, false)
+		}
+		var rcode Rcode
+		if err = c.ExchangeContext(ctx, req, resp); err == nil {
+			rcode = resp.Rcode()
+		} else if err == ErrInvalidHeader && len(resp.Raw) >= 12 && resp.Raw[3]&0x0f != 0 {
+			// the error responses may not have the question section
+			rcode = Rcode(resp.Raw[3] & 0x0f)
+		} else {
+			e := c.dnsError(name, err.Error())
+			e.IsTimeout = os.IsTimeout(err) || err == context.DeadlineExceeded
+			return "", e
+		}
+
+		switch rcode {
+		case RcodeNoError:
+		case RcodeNXDomain:
+			return "", c.dnsError(name, errNoSuchHost)
+		default:
+			e := c.dnsError(name, "server misbehaving: "+rcode.String())
+			e.IsTemporary = rcode == RcodeServFail
+			return "", e
+		}
+
+		// follow the CNAME chain in the answers, which may be out of order
+		target := cname
+		for j := 0; j < lookupMaxCNAMEs; j++ {
+			next := target
+			walkAnswers(resp, func(owner string, t Type, data []byte) bool {
+				if t == TypeCNAME && strings.EqualFold(owner, target) {
+					next = string(resp.DecodeName(nil, data))
+					return false
+				}
+				return true
+			})
+			if next == target {
+				break
+			}
+			target = next
+		}
+
+		found := false
+		walkAnswers(resp, func(owner string, t Type, data []byte) bool {
+			if t == typ && strings.EqualFold(owner, target) {
+				f(resp, data)
+				found = true
+			}
+			return true
+		})
+
+		if found || target == cname || typ == TypeCNAME {
+			return target, nil
+		}
+		// the answers end with a CNAME, let's query the canonical name again
+		cname = target
+	}
+
+	return "", c.dnsError(name, "too many CNAMEs")
+}
+
+func (c *Client) dnsError(name, err string) *net.DNSError {
+	return &net.DNSError{Err: err, Name: name, Server: c.AddrPort.String(), IsNotFound: err == errNoSuchHost}
+}
+
+// walkAnswers calls f with the owner name, type and data of each answer record of msg, it stops on malformed records.
+func walkAnswers(msg *Message, f func(owner string, typ Type, data []byte) bool) {
+	payload := msg.Raw
+	offset := skipQuestions(payload, int(msg.Header.QDCount))
+	var buf [256]byte
+	for i := 0; i < int(msg.Header.ANCount) && offset >= 0; i++ {
+		end := skipRecord(payload, offset)
+		if end < 0 {
+			return
+		}
+		n := skipName(payload, offset)
+		owner := msg.DecodeName(buf[:0], payload[offset:n])
+		typ := Type(payload[n])<<8 | Type(payload[n+1])
+		if !f(b2s(owner), typ, payload[n+10:end]) {
+			return
+		}
+		offset = end
+	}
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func reverseName(ip netip.Addr) string {
+	const hexDigits = "0123456789abcdef"
+	ip = ip.Unmap()
+	var b []byte
+	if ip.Is4() {
+		v4 := ip.As4()
+		for i := 3; i >= 0; i-- {
+			b = append(b, strconv.Itoa(int(v4[i]))...)
+			b = append(b, '.')
+		}
+		return string(append(b, "in-addr.arpa"...))
+	}
+	v6 := ip.As16()
+	for i := 15; i >= 0; i-- {
+		b = append(b, hexDigits[v6[i]&0xf], '.', hexDigits[v6[i]>>4], '.')
+	}
+	return string(append(b, "ip6.arpa"...))
+}
@@ -0,0 +1,208 @@
+package fastdns
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mockLookupClient(t *testing.T) (*Client, func()) {
+	handler := HandlerFunc(func(rw ResponseWriter, req *Message) {
+		switch string(req.Domain) {
+		case "example.org":
+			switch req.Question.Type {
+			case TypeA:
+				HOST(rw, req, 300, []netip.Addr{netip.MustParseAddr("1.1.1.1")})
+			case TypeAAAA:
+				HOST(rw, req, 300, []netip.Addr{netip.MustParseAddr("2001:db8::1")})
+			case TypeMX:
+				MX(rw, req, 300, []net.MX{{Host: "mx2.example.org", Pref: 20}, {Host: "mx1.example.org", Pref: 10}})
+			case TypeTXT:
+				TXT(rw, req, 300, "v=spf1 -all")
+			case TypeNS:
+				NS(rw, req, 300, []net.NS{{Host: "ns1.example.org"}, {Host: "ns2.example.org"}})
+			default:
+				Error(rw, req, RcodeNoError)
+			}
+		case "www.example.org":
+			if req.Question.Type == TypeA {
+				CNAME(rw, req, 300, []string{"cdn.example.net", "edge.example.net"}, []netip.Addr{netip.MustParseAddr("2.2.2.2")})
+			} else {
+				Error(rw, req, RcodeNoError)
+			}
+		case "alias.example.org":
+			// the CNAME chain is followed by a new query
+			CNAME(rw, req, 300, []string{"example.org"}, nil)
+		case "_sip._udp.example.org":
+			SRV(rw, req, 300, []net.SRV{{Target: "sip2.example.org", Port: 5060, Priority: 20}, {Target: "sip1.example.org", Port: 5060, Priority: 10}})
+		case "dkim.example.org":
+			// the long TXT is split into the character-strings of maximum length
+			TXT(rw, req, 300, strings.Repeat("k", 300))
+		case "4.3.2.1.in-addr.arpa":
+			PTR(rw, req, 300, "host.example.org")
+		default:
+			Error(rw, req, RcodeNXDomain)
+		}
+	})
+
+	s := &Server{
+		Handler:  handler,
+		ErrorLog: log.Default(),
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+
+	go func() {
+		_ = s.Serve(conn)
+	}()
+
+	client := &Client{
+		AddrPort:    conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout: time.Second,
+	}
+
+	return client, func() { conn.Close() }
+}
+
+func TestClientLookupHost(t *testing.T) {
+	client, cleanup := mockLookupClient(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	addrs, err := client.LookupHost(ctx, "example.org")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"1.1.1.1", "2001:db8::1"}) {
+		t.Errorf("LookupHost(example.org) return %v %+v", addrs, err)
+	}
+
+	ips, err := client.LookupNetIP(ctx, "ip4", "www.example.org")
+	if err != nil || !reflect.DeepEqual(ips, []netip.Addr{netip.MustParseAddr("2.2.2.2")}) {
+		t.Errorf("LookupNetIP(www.example.org) return %v %+v", ips, err)
+	}
+
+	ips, err = client.LookupNetIP(ctx, "ip", "alias.example.org")
+	if err != nil || len(ips) != 2 {
+		t.Errorf("LookupNetIP(alias.example.org) return %v %+v", ips, err)
+	}
+
+	cname, err := client.LookupCNAME(ctx, "www.example.org.")
+	if err != nil || cname != "edge.example.net" {
+		t.Errorf("LookupCNAME(www.example.org) return %v %+v", cname, err)
+	}
+
+	_, err = client.LookupHost(ctx, "nxdomain.example.org")
+	var e *net.DNSError
+	if !errors.As(err, &e) || !e.IsNotFound {
+		t.Errorf("LookupHost(nxdomain.example.org) shall return not found error, got %+v", err)
+	}
+}
+
+func TestClientLookupRecords(t *testing.T) {
+	client, cleanup := mockLookupClient(t)
+	defer cleanup()
+
+	client.Multiplex = 1
+
+	ctx := context.Background()
+
+	mxs, err := client.LookupMX(ctx, "example.org")
+	if err != nil || !reflect.DeepEqual(mxs, []net.MX{{Host: "mx1.example.org", Pref: 10}, {Host: "mx2.example.org", Pref: 20}}) {
+		t.Errorf("LookupMX(example.org) return %v %+v", mxs, err)
+	}
+
+	cname, srvs, err := client.LookupSRV(ctx, "sip", "udp", "example.org")
+	if err != nil || cname != "_sip._udp.example.org" || len(srvs) != 2 || srvs[0].Target != "sip1.example.org" {
+		t.Errorf("LookupSRV(example.org) return %v %v %+v", cname, srvs, err)
+	}
+
+	txts, err := client.LookupTXT(ctx, "example.org")
+	if err != nil || !reflect.DeepEqual(txts, []string{"v=spf1 -all"}) {
+		t.Errorf("LookupTXT(example.org) return %v %+v", txts, err)
+	}
+
+	txts, err = client.LookupTXT(ctx, "dkim.example.org")
+	if err != nil || !reflect.DeepEqual(txts, []string{strings.Repeat("k", 300)}) {
+		t.Errorf("LookupTXT(dkim.example.org) return %v %+v", txts, err)
+	}
+
+	nss, err := client.LookupNS(ctx, "example.org")
+	if err != nil || !reflect.DeepEqual(nss, []net.NS{{Host: "ns1.example.org"}, {Host: "ns2.example.org"}}) {
+		t.Errorf("LookupNS(example.org) return %v %+v", nss, err)
+	}
+
+	names, err := client.LookupAddr(ctx, "1.2.3.4")
+	if err != nil || !reflect.DeepEqual(names, []string{"host.example.org"}) {
+		t.Errorf("LookupAddr(1.2.3.4) return %v %+v", names, err)
+	}
+
+	_, err = client.LookupMX(ctx, "www.example.org")
+	var e *net.DNSError
+	if !errors.As(err, &e) || !e.IsNotFound {
+		t.Errorf("LookupMX(www.example.org) shall return not found error, got %+v", err)
+	}
+
+	// the multiplexed sockets drop the NXDOMAIN responses without the question section
+	client.Multiplex = 0
+	_, err = client.LookupTXT(ctx, "nxdomain.example.org")
+	if !errors.As(err, &e) || !e.IsNotFound {
+		t.Errorf("LookupTXT(nxdomain.example.org) shall return not found error, got %+v", err)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	cases := []struct {
+		IP   string
+		Name string
+	}{
+		{"1.2.3.4", "4.3.2.1.in-addr.arpa"},
+		{"::ffff:1.2.3.4", "4.3.2.1.in-addr.arpa"},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+
+	for _, c := range cases {
+		if name := reverseName(netip.MustParseAddr(c.IP)); name != c.Name {
+			t.Errorf("reverseName(%v) return %v, expect %v", c.IP, name, c.Name)
+		}
+	}
+}
+
+func TestClientLookupContext(t *testing.T) {
+	// the server which never replies
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	for _, multiplex := range []int{0, 1} {
+		client := &Client{
+			AddrPort:  conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+			Multiplex: multiplex,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, err := client.LookupHost(ctx, "example.org")
+		cancel()
+		var e *net.DNSError
+		if !errors.As(err, &e) || !e.IsTimeout || time.Since(start) > time.Second {
+			t.Errorf("LookupHost(multiplex=%d) shall return timeout by the deadline of context, got %+v in %s", multiplex, err, time.Since(start))
+		}
+
+		ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start = time.Now()
+		if _, err = client.LookupTXT(ctx, "example.org"); err == nil || time.Since(start) > time.Second {
+			t.Errorf("LookupTXT(multiplex=%d) shall be aborted by the cancel of context, got %+v in %s", multiplex, err, time.Since(start))
+		}
+	}
+}
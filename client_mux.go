@@ -0,0 +1,312 @@
+package fastdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// muxMaxQueries is the number of queries on a multiplexed socket before it is rotated to a new source port.
+	muxMaxQueries = 4096
+	// muxIdleTimeout is the maximum duration of an idle multiplexed socket.
+	muxIdleTimeout = 30 * time.Second
+)
+
+// muxQuery is an in-flight query on a multiplexed socket.
+type muxQuery struct {
+	question []byte
+	resp     *Message
+	err      error
+	done     chan struct{}
+}
+
+var muxQueryPool = sync.Pool{
+	New: func() interface{} {
+		return &muxQuery{done: make(chan struct{}, 1)}
+	},
+}
+
+// muxConn is an UDP socket which carries many in-flight queries, the responses are
+// demultiplexed by the reader goroutine on message ID and question.
+type muxConn struct {
+	client *Client
+	conn   *net.UDPConn
+
+	mu       sync.Mutex
+	pending  map[uint16]*muxQuery
+	queries  int
+	retiring bool
+	closed   bool
+}
+
+func (c *Client) exchangeMux(ctx context.Context, raw []byte, resp *Message) error {
+	if len(raw) < 12 {
+		return ErrInvalidHeader
+	}
+	question := raw[12:]
+	if n := skipQuestions(raw, 1); n > 0 {
+		question = raw[12:n]
+	}
+
+	q := muxQueryPool.Get().(*muxQuery)
+	q.question, q.resp = question, resp
+	defer func() {
+		q.question, q.resp, q.err = nil, nil, nil
+		muxQueryPool.Put(q)
+	}()
+
+	mc, err := c.getMux()
+	if err != nil {
+		return err
+	}
+
+	id, err := mc.send(raw, q)
+	if err == ErrConnClosed {
+		// the socket is rotated or closed meanwhile, let's retry again
+		if mc, err = c.getMux(); err != nil {
+			return err
+		}
+		id, err = mc.send(raw, q)
+	}
+	if err != nil {
+		if err != ErrMaxConns && err != ErrConnClosed {
+			mc.close(err)
+		}
+		return err
+	}
+
+	var timeout <-chan time.Time
+	if deadline := c.deadline(ctx); !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-q.done:
+	case <-timeout:
+		if mc.cancel(id, q) {
+			return os.ErrDeadlineExceeded
+		}
+		// the response is delivered meanwhile
+		<-q.done
+	case <-ctx.Done():
+		if mc.cancel(id, q) {
+			return ctx.Err()
+		}
+		<-q.done
+	}
+
+	if q.err != nil {
+		return q.err
+	}
+
+	// restore the ID of request
+	resp.Raw[0], resp.Raw[1] = raw[0], raw[1]
+
+	return ParseMessage(resp, resp.Raw, false)
+}
+
+// getMux returns a random one of the multiplexed sockets, or dials a new one if there are not enough sockets.
+func (c *Client) getMux() (*muxConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.mux) >= c.Multiplex {
+		return c.mux[fastrandn(uint32(len(c.mux)))], nil
+	}
+
+	mc, err := c.dialMux()
+	if err != nil {
+		return nil, err
+	}
+	c.mux = append(c.mux, mc)
+
+	return mc, nil
+}
+
+// dialMux dials a multiplexed socket on a random source port.
+func (c *Client) dialMux() (*muxConn, error) {
+	raddr := net.UDPAddrFromAddrPort(c.AddrPort)
+
+	conn, err := net.DialUDP("udp", &net.UDPAddr{Port: 1024 + int(randUint16())%(65536-1024)}, raddr)
+	for i := 0; err != nil && i < 3; i++ {
+		conn, err = net.DialUDP("udp", &net.UDPAddr{Port: 1024 + int(randUint16())%(65536-1024)}, raddr)
+	}
+	if err != nil {
+		// let the kernel choose an ephemeral port
+		conn, err = net.DialUDP("udp", nil, raddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mc := &muxConn{
+		client:  c,
+		conn:    conn,
+		pending: make(map[uint16]*muxQuery),
+	}
+
+	go mc.readLoop()
+
+	return mc, nil
+}
+
+func (c *Client) removeMux(mc *muxConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, conn := range c.mux {
+		if conn == mc {
+			c.mux = append(c.mux[:i], c.mux[i+1:]...)
+			break
+		}
+	}
+}
+
+func (mc *muxConn) inflight() int {
+	mc.mu.Lock()
+	n := len(mc.pending)
+	mc.mu.Unlock()
+	return n
+}
+
+// send writes the query with a random unused ID, and returns the ID.
+func (mc *muxConn) send(raw []byte, q *muxQuery) (id uint16, err error) {
+	mc.mu.Lock()
+	if mc.closed {
+		mc.mu.Unlock()
+		return 0, ErrConnClosed
+	}
+	if len(mc.pending) >= 0xffff {
+		mc.mu.Unlock()
+		return 0, ErrMaxConns
+	}
+	id = randUint16()
+	for mc.pending[id] != nil {
+		id = randUint16()
+	}
+	mc.pending[id] = q
+	mc.queries++
+	retire := mc.queries >= muxMaxQueries && !mc.retiring
+	if retire {
+		mc.retiring = true
+	}
+	mc.mu.Unlock()
+
+	if retire {
+		// rotate to a new source port, the socket is closed after the pending queries
+		mc.client.removeMux(mc)
+	}
+
+	msg := AcquireMessage()
+	defer ReleaseMessage(msg)
+	msg.Raw = append(msg.Raw[:0], raw...)
+	msg.Raw[0], msg.Raw[1] = byte(id>>8), byte(id)
+
+	if _, err = mc.conn.Write(msg.Raw); err != nil && !mc.cancel(id, q) {
+		// the query is woken up by close meanwhile
+		<-q.done
+	}
+
+	return id, err
+}
+
+// cancel removes the pending query of id, and reports whether the query is removed before its response.
+func (mc *muxConn) cancel(id uint16, q *muxQuery) bool {
+	mc.mu.Lock()
+	if mc.pending[id] != q {
+		mc.mu.Unlock()
+		return false
+	}
+	delete(mc.pending, id)
+	drained := mc.retiring && len(mc.pending) == 0
+	mc.mu.Unlock()
+
+	if drained {
+		mc.close(nil)
+	}
+
+	return true
+}
+
+// close closes the socket and wakes up the pending queries.
+func (mc *muxConn) close(err error) {
+	mc.mu.Lock()
+	if mc.closed {
+		mc.mu.Unlock()
+		return
+	}
+	if err == nil {
+		err = ErrConnClosed
+	}
+	mc.closed = true
+	for id, q := range mc.pending {
+		q.err = err
+		q.done <- struct{}{}
+		delete(mc.pending, id)
+	}
+	mc.mu.Unlock()
+
+	mc.conn.Close()
+	mc.client.removeMux(mc)
+}
+
+// readLoop reads the responses and dispatches them to the pending queries by ID and question.
+func (mc *muxConn) readLoop() {
+	buf := make([]byte, 65535)
+	for {
+		_ = mc.conn.SetReadDeadline(time.Now().Add(muxIdleTimeout))
+		n, err := mc.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				mc.mu.Lock()
+				idle := len(mc.pending) == 0
+				mc.mu.Unlock()
+				if !idle {
+					continue
+				}
+			}
+			mc.close(err)
+			return
+		}
+		if n < 12 {
+			continue
+		}
+
+		data := buf[:n]
+		id := uint16(data[0])<<8 | uint16(data[1])
+
+		mc.mu.Lock()
+		q := mc.pending[id]
+		// drop the mismatched or spoofed responses
+		if q == nil || len(data) < 12+len(q.question) || !bytes.EqualFold(data[12:12+len(q.question)], q.question) {
+			mc.mu.Unlock()
+			continue
+		}
+		delete(mc.pending, id)
+		q.resp.Raw = append(q.resp.Raw[:0], data...)
+		q.done <- struct{}{}
+		if mc.retiring && len(mc.pending) == 0 {
+			mc.mu.Unlock()
+			mc.close(nil)
+			return
+		}
+		mc.mu.Unlock()
+	}
+}
+
+// randUint16 returns a cryptographically random uint16 for message IDs and source ports.
+func randUint16() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint16(fastrandn(65536))
+	}
+	return uint16(b[0])<<8 | uint16(b[1])
+}
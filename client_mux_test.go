@@ -0,0 +1,182 @@
+package fastdns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockEchoServer replies the queries as is with QR flag, it sends a spoofed response of other question
+// before the real one if spoof is true, and records the source addresses of queries.
+func mockEchoServer(t *testing.T, spoof bool, sources *sync.Map) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+
+	go func() {
+		buf := make([]byte, 1232)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 12 {
+				continue
+			}
+			if sources != nil {
+				sources.Store(addr.String(), true)
+			}
+			data := append([]byte(nil), buf[:n]...)
+			data[2] |= 0b10000000
+			if spoof {
+				fake := append([]byte(nil), data...)
+				fake[13]++
+				_, _ = conn.WriteTo(fake, addr)
+			}
+			_, _ = conn.WriteTo(data, addr)
+		}
+	}()
+
+	return conn
+}
+
+func TestClientMultiplex(t *testing.T) {
+	var sources sync.Map
+	conn := mockEchoServer(t, false, &sources)
+	defer conn.Close()
+
+	client := &Client{
+		AddrPort:    conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout: 2 * time.Second,
+		Multiplex:   2,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, resp := AcquireMessage(), AcquireMessage()
+			defer ReleaseMessage(req)
+			defer ReleaseMessage(resp)
+
+			domain := fmt.Sprintf("www%d.example.org", i)
+			req.SetRequestQuestion(domain, TypeA, ClassINET)
+			if err := client.Exchange(req, resp); err != nil {
+				t.Errorf("client exchange error: %+v", err)
+				return
+			}
+			if resp.Header.ID != req.Header.ID || string(resp.Domain) != domain {
+				t.Errorf("client mismatched response of %s: %x", domain, resp.Raw)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	n := 0
+	sources.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	if n > 2 {
+		t.Errorf("client shall multiplex queries on 2 sockets, got %d source addresses", n)
+	}
+}
+
+func TestClientMultiplexSpoof(t *testing.T) {
+	conn := mockEchoServer(t, true, nil)
+	defer conn.Close()
+
+	client := &Client{
+		AddrPort:    conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout: 2 * time.Second,
+		Multiplex:   1,
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if err := client.Exchange(req, resp); err != nil {
+		t.Fatalf("client exchange error: %+v", err)
+	}
+	if string(resp.Domain) != "example.org" {
+		t.Errorf("client shall drop the response of mismatched question, got %x", resp.Raw)
+	}
+}
+
+func TestClientMultiplexTimeout(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	client := &Client{
+		AddrPort:    conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout: 50 * time.Millisecond,
+		Multiplex:   1,
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if err := client.Exchange(req, resp); !os.IsTimeout(err) {
+		t.Errorf("client exchange shall timeout, got %+v", err)
+	}
+
+	client.mu.Lock()
+	mc := client.mux[0]
+	client.mu.Unlock()
+	if pending := mc.inflight(); pending != 0 {
+		t.Errorf("client shall remove the timeout queries, got %d pending", pending)
+	}
+}
+
+func TestClientMultiplexClose(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	client := &Client{
+		AddrPort:    conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout: 2 * time.Second,
+		Multiplex:   1,
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	raw := resp.Raw[:cap(resp.Raw)]
+
+	go func() {
+		for {
+			client.mu.Lock()
+			mux := client.mux
+			client.mu.Unlock()
+			if len(mux) != 0 && mux[0].inflight() != 0 {
+				mux[0].close(nil)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	if err := client.Exchange(req, resp); err != ErrConnClosed {
+		t.Errorf("client exchange shall return ErrConnClosed, got %+v", err)
+	}
+	if resp.Raw == nil || &resp.Raw[:cap(resp.Raw)][0] != &raw[0] {
+		t.Errorf("client shall keep the buffer of response on close")
+	}
+}
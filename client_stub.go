@@ -0,0 +1,227 @@
+package fastdns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// StubClient is a stub resolver client which looks up the hosts file before the nameservers of resolv.conf,
+// and applies the search list, timeout, attempts and rotate options of resolv.conf as glibc does.
+type StubClient struct {
+	// Config is the resolver configuration, use the one loaded from /etc/resolv.conf if nil.
+	Config *ResolvConf
+
+	// Hosts is the static table looked up before the nameservers, use the one loaded from /etc/hosts if nil.
+	Hosts *Hosts
+
+	once    sync.Once
+	clients []*Client
+	next    uint32
+}
+
+func (c *StubClient) init() {
+	c.once.Do(func() {
+		if c.Config == nil {
+			if conf, err := LoadResolvConf("/etc/resolv.conf"); err == nil {
+				c.Config = conf
+			} else {
+				c.Config = ParseResolvConf(nil)
+			}
+		}
+		if c.Hosts == nil {
+			if hosts, err := LoadHosts("/etc/hosts"); err == nil {
+				c.Hosts = hosts
+			} else {
+				c.Hosts = ParseHosts(nil)
+			}
+		}
+		nameservers := c.Config.Nameservers
+		if len(nameservers) == 0 {
+			nameservers = ParseResolvConf(nil).Nameservers
+		}
+		for _, addr := range nameservers {
+			client := &Client{
+				AddrPort:    addr,
+				ReadTimeout: c.Config.Timeout,
+			}
+			if c.Config.EDNS0 {
+				client.udpSize = 1232
+			}
+			c.clients = append(c.clients, client)
+		}
+	})
+}
+
+// Exchange executes a single DNS transaction with the nameservers in turn, until a nameserver replies
+// a response other than SERVFAIL, NOTIMP and REFUSED. The search list is not applied to req.
+func (c *StubClient) Exchange(req, resp *Message) (err error) {
+	err = c.each(context.Background(), func(client *Client) error {
+		if err := client.Exchange(req, resp); err != nil {
+			return err
+		}
+		switch resp.Rcode() {
+		case RcodeServFail, RcodeNotImp, RcodeRefused:
+			return client.dnsError(string(req.Domain), "server misbehaving: "+resp.Rcode().String())
+		}
+		return nil
+	})
+	if e, ok := err.(*net.DNSError); ok && !e.IsTimeout && len(resp.Raw) >= 12 {
+		// the failure responses of all nameservers are replied as is
+		err = nil
+	}
+	return
+}
+
+// LookupHost looks up the given host in the hosts file and then the nameservers, returning a slice of its addresses.
+func (c *StubClient) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
+	ips, err := c.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, nil
+}
+
+// LookupNetIP looks up host of network "ip", "ip4" or "ip6" in the hosts file, and then the nameservers with
+// the search list.
+func (c *StubClient) LookupNetIP(ctx context.Context, network, host string) (ips []netip.Addr, err error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+	c.init()
+	if ips = c.Hosts.LookupNetIP(network, host); len(ips) != 0 {
+		return ips, nil
+	}
+	err = c.search(ctx, host, func(client *Client, name string) (err error) {
+		ips, err = client.LookupNetIP(ctx, network, name)
+		return
+	})
+	return
+}
+
+// LookupCNAME returns the canonical name for the given host with the search list.
+func (c *StubClient) LookupCNAME(ctx context.Context, host string) (cname string, err error) {
+	err = c.search(ctx, host, func(client *Client, name string) (err error) {
+		cname, err = client.LookupCNAME(ctx, name)
+		return
+	})
+	return
+}
+
+// LookupMX returns the MX records for the given domain name with the search list.
+func (c *StubClient) LookupMX(ctx context.Context, name string) (mxs []net.MX, err error) {
+	err = c.search(ctx, name, func(client *Client, name string) (err error) {
+		mxs, err = client.LookupMX(ctx, name)
+		return
+	})
+	return
+}
+
+// LookupSRV looks up the SRV records of _service._proto.name with the search list.
+func (c *StubClient) LookupSRV(ctx context.Context, service, proto, name string) (cname string, srvs []net.SRV, err error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	err = c.search(ctx, target, func(client *Client, name string) (err error) {
+		cname, srvs, err = client.LookupSRV(ctx, "", "", name)
+		return
+	})
+	return
+}
+
+// LookupTXT returns the TXT records for the given domain name with the search list.
+func (c *StubClient) LookupTXT(ctx context.Context, name string) (txts []string, err error) {
+	err = c.search(ctx, name, func(client *Client, name string) (err error) {
+		txts, err = client.LookupTXT(ctx, name)
+		return
+	})
+	return
+}
+
+// LookupNS returns the NS records for the given domain name with the search list.
+func (c *StubClient) LookupNS(ctx context.Context, name string) (nss []net.NS, err error) {
+	err = c.search(ctx, name, func(client *Client, name string) (err error) {
+		nss, err = client.LookupNS(ctx, name)
+		return
+	})
+	return
+}
+
+// LookupAddr performs a reverse lookup for the given address in the hosts file, and then the nameservers.
+func (c *StubClient) LookupAddr(ctx context.Context, addr string) (names []string, err error) {
+	c.init()
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		if names = c.Hosts.LookupAddr(ip); len(names) != 0 {
+			return names, nil
+		}
+	}
+	err = c.each(ctx, func(client *Client) (err error) {
+		names, err = client.LookupAddr(ctx, addr)
+		return
+	})
+	return
+}
+
+// search calls f with the names of NameList in order until f succeeds, the names which are not found are
+// skipped. It returns the first error other than not found, or the not found error of name.
+func (c *StubClient) search(ctx context.Context, name string, f func(client *Client, name string) error) error {
+	c.init()
+
+	var first error
+	for _, candidate := range c.Config.NameList(name) {
+		err := c.each(ctx, func(client *Client) error {
+			return f(client, candidate)
+		})
+		if err == nil {
+			return nil
+		}
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			continue
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+
+	if first != nil {
+		return first
+	}
+	return &net.DNSError{Err: errNoSuchHost, Name: name, IsNotFound: true}
+}
+
+// each calls f with the clients of nameservers for Attempts rounds until f succeeds or reports not found,
+// the nameservers are tried in the listed order, or in round robin order if the rotate option is set.
+func (c *StubClient) each(ctx context.Context, f func(client *Client) error) (err error) {
+	c.init()
+
+	var start int
+	if c.Config.Rotate {
+		start = int(atomic.AddUint32(&c.next, 1) % uint32(len(c.clients)))
+	}
+
+	attempts := c.Config.Attempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	for i := 0; i < attempts*len(c.clients); i++ {
+		if err = f(c.clients[(start+i)%len(c.clients)]); err == nil || ctx.Err() != nil {
+			return err
+		}
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			return err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,93 @@
+package fastdns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mockStubClient(t *testing.T) (*StubClient, func()) {
+	client, cleanup := mockLookupClient(t)
+
+	// the nameserver which never replies
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+
+	stub := &StubClient{
+		Config: &ResolvConf{
+			Nameservers: []netip.AddrPort{conn.LocalAddr().(*net.UDPAddr).AddrPort(), client.AddrPort},
+			Search:      []string{"none.example", "example.org"},
+			Ndots:       1,
+			Timeout:     100 * time.Millisecond,
+			Attempts:    2,
+			EDNS0:       true,
+		},
+		Hosts: ParseHosts([]byte("192.0.2.1 router router.example.org\n")),
+	}
+
+	return stub, func() { conn.Close(); cleanup() }
+}
+
+func TestStubClientLookup(t *testing.T) {
+	client, cleanup := mockStubClient(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// the search list is applied to the names with less than ndots dots
+	addrs, err := client.LookupHost(ctx, "www")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"2.2.2.2"}) {
+		t.Errorf("LookupHost(www) return %v %+v", addrs, err)
+	}
+	mxs, err := client.LookupMX(ctx, "example.org")
+	if err != nil || len(mxs) != 2 || mxs[0].Host != "mx1.example.org" {
+		t.Errorf("LookupMX(example.org) return %+v %+v", mxs, err)
+	}
+	_, srvs, err := client.LookupSRV(ctx, "sip", "udp", "example.org")
+	if err != nil || len(srvs) != 2 || srvs[0].Target != "sip1.example.org" {
+		t.Errorf("LookupSRV(example.org) return %+v %+v", srvs, err)
+	}
+
+	// the hosts file is looked up before the nameservers
+	ips, err := client.LookupNetIP(ctx, "ip4", "ROUTER")
+	if err != nil || !reflect.DeepEqual(ips, []netip.Addr{netip.MustParseAddr("192.0.2.1")}) {
+		t.Errorf("LookupNetIP(ROUTER) return %v %+v", ips, err)
+	}
+	names, err := client.LookupAddr(ctx, "192.0.2.1")
+	if err != nil || !reflect.DeepEqual(names, []string{"router", "router.example.org"}) {
+		t.Errorf("LookupAddr(192.0.2.1) return %v %+v", names, err)
+	}
+	names, err = client.LookupAddr(ctx, "1.2.3.4")
+	if err != nil || !reflect.DeepEqual(names, []string{"host.example.org"}) {
+		t.Errorf("LookupAddr(1.2.3.4) return %v %+v", names, err)
+	}
+
+	// not found after the search list
+	_, err = client.LookupHost(ctx, "none")
+	if e, ok := err.(*net.DNSError); !ok || !e.IsNotFound || e.Name != "none" {
+		t.Errorf("LookupHost(none) shall return not found, got %+v", err)
+	}
+}
+
+func TestStubClientExchange(t *testing.T) {
+	client, cleanup := mockStubClient(t)
+	defer cleanup()
+	client.Config.Rotate = true
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+
+	// the nameservers are tried in turn, whichever starts first
+	for i := 0; i < 2; i++ {
+		req.SetRequestQuestion("example.org", TypeA, ClassINET)
+		if err := client.Exchange(req, resp); err != nil || resp.Header.ANCount != 1 {
+			t.Errorf("Exchange(example.org) return %x %+v", resp.Raw, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package fastdns
 
 import (
+	"net"
 	"net/netip"
 	"testing"
 	"time"
@@ -42,3 +43,65 @@ func TestClientExchange(t *testing.T) {
 		})
 	}
 }
+
+func TestClientMismatchedResponses(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 1232)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := AcquireMessage()
+			if ParseMessage(req, buf[:n], true) != nil || string(req.Domain) == "timeout.example.org" {
+				continue
+			}
+			req.SetResponseHeader(RcodeNoError, 1)
+			req.Raw = AppendHOSTRecord(req.Raw, req, 300, []netip.Addr{netip.MustParseAddr("1.1.1.1")})
+			// the response of other ID, the response of other question, and the expected response
+			spoofed := append([]byte(nil), req.Raw...)
+			spoofed[1]++
+			_, _ = conn.WriteTo(spoofed, addr)
+			other := append([]byte(nil), req.Raw...)
+			other[13] = 'x'
+			_, _ = conn.WriteTo(other, addr)
+			_, _ = conn.WriteTo(req.Raw, addr)
+			ReleaseMessage(req)
+		}
+	}()
+
+	client := &Client{
+		AddrPort:    conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout: 200 * time.Millisecond,
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+
+	for i := 0; i < 3; i++ {
+		req.SetRequestQuestion("example.org", TypeA, ClassINET)
+		if err := client.Exchange(req, resp); err != nil || resp.Header.ID != req.Header.ID || string(resp.Domain) != "example.org" {
+			t.Errorf("Exchange shall skip the mismatched responses, got %x %+v", resp.Raw, err)
+		}
+	}
+
+	// the socket of timeout is closed instead of reused
+	client.mu.Lock()
+	conns := len(client.conns)
+	client.mu.Unlock()
+	req.SetRequestQuestion("timeout.example.org", TypeA, ClassINET)
+	if err := client.Exchange(req, resp); err == nil {
+		t.Errorf("Exchange shall return timeout error")
+	}
+	if client.mu.Lock(); len(client.conns) != conns-1 {
+		t.Errorf("Exchange shall close the socket of timeout, conns %d -> %d", conns, len(client.conns))
+	}
+	client.mu.Unlock()
+}
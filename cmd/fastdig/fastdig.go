@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/netip"
 	"os"
-	"regexp"
 	"runtime"
 	"strings"
 	"time"
@@ -14,7 +13,7 @@ import (
 )
 
 func main() {
-	domain, qtype, server, options := parse(os.Args[1:])
+	domain, qtype, qclass, server, options := parse(os.Args[1:])
 
 	client := &fastdns.Client{
 		AddrPort:    netip.AddrPortFrom(netip.MustParseAddr(server), 53),
@@ -26,7 +25,13 @@ func main() {
 	defer fastdns.ReleaseMessage(req)
 	defer fastdns.ReleaseMessage(resp)
 
-	req.SetRequestQuestion(domain, fastdns.ParseType(qtype), fastdns.ClassINET)
+	req.SetRequestQuestion(domain, fastdns.ParseType(qtype), qclass)
+	if !opt("noedns", options) {
+		req.SetEDNS(1232, false)
+		if opt("nsid", options) {
+			req.AddEDNSOption(fastdns.EDNSOptionNSID, nil)
+		}
+	}
 
 	start := time.Now()
 	err := client.Exchange(req, resp)
@@ -43,11 +48,12 @@ func main() {
 	if opt("short", options) {
 		short(resp)
 	} else {
-		cmd(req, resp, server, start, end)
+		cmd(req, resp, server, options, start, end)
 	}
 }
 
-func parse(args []string) (domain, qtype, server string, options []string) {
+func parse(args []string) (domain, qtype string, qclass fastdns.Class, server string, options []string) {
+	qclass = fastdns.ClassINET
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 		if arg == "" {
@@ -59,7 +65,11 @@ func parse(args []string) (domain, qtype, server string, options []string) {
 		case '+':
 			options = append(options, arg[1:])
 		default:
-			if domain == "" {
+			if c := strings.ToUpper(arg); c == "IN" || c == "CH" || c == "CHAOS" {
+				if c != "IN" {
+					qclass = fastdns.ClassCHAOS
+				}
+			} else if domain == "" {
 				domain = arg
 			} else {
 				qtype = arg
@@ -68,10 +78,8 @@ func parse(args []string) (domain, qtype, server string, options []string) {
 	}
 	if server == "" {
 		server = "8.8.8.8"
-		if data, err := os.ReadFile("/etc/resolv.conf"); err == nil {
-			if m := regexp.MustCompile(`(^|\n)\s*nameserver\s+(\S+)`).FindAllStringSubmatch(string(data), -1); len(m) != 0 {
-				server = m[0][2]
-			}
+		if conf, err := fastdns.LoadResolvConf("/etc/resolv.conf"); err == nil {
+			server = conf.Nameservers[0].Addr().String()
 		}
 	}
 	if qtype == "" {
@@ -137,7 +145,7 @@ func short(resp *fastdns.Message) {
 	})
 }
 
-func cmd(req, resp *fastdns.Message, server string, start, end time.Time) {
+func cmd(req, resp *fastdns.Message, server string, options []string, start, end time.Time) {
 	var flags string
 	for _, f := range []struct {
 		b byte
@@ -158,16 +166,50 @@ func cmd(req, resp *fastdns.Message, server string, start, end time.Time) {
 
 	fmt.Printf("\n")
 	fmt.Printf("; <<>> DiG 0.0.1-fastdns-%s <<>> %s\n", runtime.Version(), req.Domain)
-	fmt.Printf(";; global options: +cmd +noedns\n")
+	if opt("noedns", options) {
+		fmt.Printf(";; global options: +cmd +noedns\n")
+	} else {
+		fmt.Printf(";; global options: +cmd\n")
+	}
 	fmt.Printf(";; Got answer:\n")
 	fmt.Printf(";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n",
-		strings.ToUpper(resp.Header.Flags.Opcode().String()), strings.ToUpper(resp.Header.Flags.Rcode().String()), resp.Header.ID)
+		strings.ToUpper(resp.Header.Flags.Opcode().String()), strings.ToUpper(resp.Rcode().String()), resp.Header.ID)
 	fmt.Printf(";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
 		flags, resp.Header.QDCount, resp.Header.ANCount, resp.Header.NSCount, resp.Header.ARCount)
 
 	fmt.Printf("\n")
-	// fmt.Printf(";; OPT PSEUDOSECTION:\n")
-	// fmt.Printf("; EDNS: version: 0, flags:; udp: 512\n")
+	if opt, ok := resp.OPT(); ok {
+		var flags string
+		if opt.DO() {
+			flags = " do"
+		}
+		fmt.Printf(";; OPT PSEUDOSECTION:\n")
+		fmt.Printf("; EDNS: version: %d, flags:%s; udp: %d\n", opt.Version, flags, opt.UDPSize)
+		opt.Walk(func(code fastdns.EDNSOption, data []byte) bool {
+			switch code {
+			case fastdns.EDNSOptionExtendedError:
+				if ede, err := fastdns.ParseExtendedError(data); err == nil {
+					if ede.Text != "" {
+						fmt.Printf("; EDE: %d (%s): (%s)\n", ede.Code, ede.Code, ede.Text)
+					} else {
+						fmt.Printf("; EDE: %d (%s)\n", ede.Code, ede.Code)
+					}
+				}
+			case fastdns.EDNSOptionClientSubnet:
+				if ecs, err := fastdns.ParseClientSubnet(data); err == nil {
+					fmt.Printf("; CLIENT-SUBNET: %s/%d\n", ecs.Prefix, ecs.Scope)
+				}
+			case fastdns.EDNSOptionCookie:
+				fmt.Printf("; COOKIE: %x\n", data)
+			case fastdns.EDNSOptionNSID:
+				fmt.Printf("; NSID: %x (\"%s\")\n", data, data)
+			default:
+				fmt.Printf("; OPT=%d: %x\n", code, data)
+			}
+			return true
+		})
+		fmt.Printf("\n")
+	}
 	fmt.Printf(";; QUESTION SECTION:\n")
 	fmt.Printf(";%s.		%s	%s\n", req.Domain, req.Question.Class, req.Question.Type)
 
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"net"
 	"sync"
 	"time"
@@ -31,6 +33,7 @@ var memCtxPool = sync.Pool{
 type DoHHandler struct {
 	DNSQuery   string
 	DNSHandler fastdns.Handler
+	DNSTimeout time.Duration // the deadline of request context passed to DNSHandler, use 5s if empty
 	DNSStats   fastdns.Stats
 	DoHStats   fastdns.Stats
 }
@@ -88,11 +91,20 @@ func (h *DoHHandler) HandlerDoH(ctx *fasthttp.RequestCtx) {
 		rw.Laddr = v.AddrPort()
 	}
 
-	err := fastdns.ParseMessage(req, ctx.PostBody(), true)
+	body := ctx.PostBody()
+	if ctx.IsGet() {
+		// the base64url "dns" parameter of GET requests, see RFC 8484 section 4.1
+		dns := ctx.QueryArgs().Peek("dns")
+		body = make([]byte, base64.RawURLEncoding.DecodedLen(len(dns)))
+		n, _ := base64.RawURLEncoding.Decode(body, dns)
+		body = body[:n]
+	}
+
+	err := fastdns.ParseMessage(req, body, true)
 	if err != nil {
 		fastdns.Error(rw, req, fastdns.RcodeFormErr)
 	} else {
-		h.DNSHandler.ServeDNS(rw, req)
+		h.serveDNS(ctx, rw, req)
 		if h.DoHStats != nil {
 			h.DoHStats.UpdateStats(rw.Raddr, req, time.Since(start))
 		}
@@ -101,3 +113,21 @@ func (h *DoHHandler) HandlerDoH(ctx *fasthttp.RequestCtx) {
 	ctx.SetContentType("application/dns-message")
 	_, _ = ctx.Write(rw.Data)
 }
+
+// serveDNS calls DNSHandler with a DoH request context if it implements fastdns.ContextHandler.
+func (h *DoHHandler) serveDNS(ctx context.Context, rw fastdns.ResponseWriter, req *fastdns.Message) {
+	ch, ok := h.DNSHandler.(fastdns.ContextHandler)
+	if !ok {
+		h.DNSHandler.ServeDNS(rw, req)
+		return
+	}
+
+	timeout := h.DNSTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	dnsCtx, cancel := fastdns.NewRequestContext(ctx, fastdns.TransportDoH, timeout)
+	defer cancel()
+	ch.ServeDNSContext(dnsCtx, rw, req)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/netip"
 	"os"
@@ -17,17 +18,22 @@ type DNSHandler struct {
 
 // ServeDNS implements fastdns.Handler
 func (h *DNSHandler) ServeDNS(rw fastdns.ResponseWriter, req *fastdns.Message) {
+	h.ServeDNSContext(context.Background(), rw, req)
+}
+
+// ServeDNSContext implements fastdns.ContextHandler
+func (h *DNSHandler) ServeDNSContext(ctx context.Context, rw fastdns.ResponseWriter, req *fastdns.Message) {
 	if h.Debug {
-		log.Printf("%s] %s: CLASS %s TYPE %s\n", rw.RemoteAddr(), req.Domain, req.Question.Class, req.Question.Type)
+		log.Printf("%s] %s: CLASS %s TYPE %s TRANSPORT %s\n", rw.RemoteAddr(), req.Domain, req.Question.Class, req.Question.Type, fastdns.TransportFromContext(ctx))
 	}
 
 	resp := fastdns.AcquireMessage()
 	defer fastdns.ReleaseMessage(resp)
 
-	err := h.DNSClient.Exchange(req, resp)
+	err := h.DNSClient.ExchangeContext(ctx, req, resp)
 	if err == fastdns.ErrMaxConns {
 		time.Sleep(10 * time.Millisecond)
-		err = h.DNSClient.Exchange(req, resp)
+		err = h.DNSClient.ExchangeContext(ctx, req, resp)
 	}
 	if err != nil {
 		fastdns.Error(rw, req, fastdns.RcodeServFail)
@@ -58,8 +64,9 @@ func main() {
 		DNSQuery: "/dns-query",
 		DNSHandler: &DNSHandler{
 			DNSClient: &fastdns.Client{
-				AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{8, 8, 8, 8}), 53),
-				MaxConns: 8192,
+				AddrPort:  netip.AddrPortFrom(netip.AddrFrom4([4]byte{8, 8, 8, 8}), 53),
+				Multiplex: 16,
+				Coalesce:  true,
 			},
 			Debug: os.Getenv("DEBUG") != "",
 		},
@@ -0,0 +1,147 @@
+package fastdns
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// ContextHandler is implemented by any value that implements ServeDNSContext.
+//
+// If the Handler of server implements ContextHandler, the server calls ServeDNSContext
+// with a per-request context instead of ServeDNS.
+type ContextHandler interface {
+	ServeDNSContext(ctx context.Context, rw ResponseWriter, req *Message)
+}
+
+// ContextHandlerFunc is an adapter to allow the use of ordinary functions as DNS handlers.
+type ContextHandlerFunc func(ctx context.Context, rw ResponseWriter, req *Message)
+
+// ServeDNSContext calls f(ctx, rw, req).
+func (f ContextHandlerFunc) ServeDNSContext(ctx context.Context, rw ResponseWriter, req *Message) {
+	f(ctx, rw, req)
+}
+
+// ServeDNS calls f(context.Background(), rw, req).
+func (f ContextHandlerFunc) ServeDNS(rw ResponseWriter, req *Message) {
+	f(context.Background(), rw, req)
+}
+
+// ToContextHandler adapts the existing Handler to ContextHandler, the context is ignored.
+func ToContextHandler(h Handler) ContextHandler {
+	if ch, ok := h.(ContextHandler); ok {
+		return ch
+	}
+	return ContextHandlerFunc(func(_ context.Context, rw ResponseWriter, req *Message) {
+		h.ServeDNS(rw, req)
+	})
+}
+
+// Transport is the transport protocol of DNS request.
+type Transport string
+
+// Transports of DNS request.
+const (
+	TransportUDP Transport = "udp"
+	TransportTCP Transport = "tcp"
+	TransportDoH Transport = "doh"
+	TransportDoT Transport = "dot"
+)
+
+type requestContextKey struct{}
+
+// requestContext carries the transport and a request-scoped value store.
+type requestContext struct {
+	context.Context
+	transport Transport
+	mu        sync.Mutex
+	values    map[interface{}]interface{}
+}
+
+func (c *requestContext) Value(key interface{}) interface{} {
+	if key == (requestContextKey{}) {
+		return c
+	}
+	c.mu.Lock()
+	v, ok := c.values[key]
+	c.mu.Unlock()
+	if ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+// NewRequestContext returns a per-request context with the transport and the deadline of timeout.
+// A zero timeout means no deadline.
+func NewRequestContext(parent context.Context, transport Transport, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		parent, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		parent, cancel = context.WithCancel(parent)
+	}
+	return &requestContext{Context: parent, transport: transport}, cancel
+}
+
+// TransportFromContext returns the transport of request context, or empty if ctx is not a request context.
+func TransportFromContext(ctx context.Context) Transport {
+	if c, ok := ctx.Value(requestContextKey{}).(*requestContext); ok {
+		return c.transport
+	}
+	return ""
+}
+
+// SetContextValue stores the value of key into the request-scoped value store of ctx,
+// which can be retrieved by ctx.Value(key). It returns false if ctx is not a request context.
+func SetContextValue(ctx context.Context, key, value interface{}) bool {
+	c, ok := ctx.Value(requestContextKey{}).(*requestContext)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	if c.values == nil {
+		c.values = make(map[interface{}]interface{})
+	}
+	c.values[key] = value
+	c.mu.Unlock()
+	return true
+}
+
+// contextHandler calls ContextHandler with a per-request context.
+type contextHandler struct {
+	Handler     ContextHandler
+	Timeout     time.Duration
+	BaseContext func() context.Context
+}
+
+// ServeDNS implements Handler.
+func (h *contextHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	parent := context.Background()
+	if h.BaseContext != nil {
+		parent = h.BaseContext()
+	}
+
+	ctx, cancel := NewRequestContext(parent, writerTransport(rw), h.Timeout)
+	defer cancel()
+	h.Handler.ServeDNSContext(ctx, rw, req)
+}
+
+// transportOf returns the transport of request context, or guesses it from rw.
+func transportOf(ctx context.Context, rw ResponseWriter) Transport {
+	if transport := TransportFromContext(ctx); transport != "" {
+		return transport
+	}
+	return writerTransport(rw)
+}
+
+// writerTransport returns the transport of rw created by server, the TLS connections are DoT.
+func writerTransport(rw ResponseWriter) Transport {
+	if w, ok := rw.(*tcpResponseWriter); ok {
+		if _, ok := w.Conn.(*tls.Conn); ok {
+			return TransportDoT
+		}
+		return TransportTCP
+	}
+	return TransportUDP
+}
@@ -0,0 +1,136 @@
+package fastdns
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRequestContext(t *testing.T) {
+	type key struct{}
+
+	ctx, cancel := NewRequestContext(context.Background(), TransportTCP, time.Second)
+	defer cancel()
+
+	if _, ok := ctx.Deadline(); !ok {
+		t.Errorf("NewRequestContext shall set deadline")
+	}
+	if got := TransportFromContext(ctx); got != TransportTCP {
+		t.Errorf("TransportFromContext error got=%#v want=%#v", got, TransportTCP)
+	}
+	if !SetContextValue(ctx, key{}, "value") {
+		t.Errorf("SetContextValue shall return true for request context")
+	}
+	if got := ctx.Value(key{}); got != "value" {
+		t.Errorf("ctx.Value error got=%#v want=%#v", got, "value")
+	}
+
+	child := context.WithValue(ctx, struct{ child bool }{}, 1)
+	if got := TransportFromContext(child); got != TransportTCP {
+		t.Errorf("TransportFromContext of child error got=%#v want=%#v", got, TransportTCP)
+	}
+
+	if SetContextValue(context.Background(), key{}, "value") {
+		t.Errorf("SetContextValue shall return false for background context")
+	}
+	if got := TransportFromContext(context.Background()); got != "" {
+		t.Errorf("TransportFromContext of background error got=%#v", got)
+	}
+}
+
+func TestToContextHandler(t *testing.T) {
+	rw, req := &MemResponseWriter{}, mockMessage()
+
+	ToContextHandler(&mockServerHandler{}).ServeDNSContext(context.Background(), rw, req)
+	if len(rw.Data) == 0 {
+		t.Errorf("ToContextHandler shall call ServeDNS of handler")
+	}
+}
+
+func TestServerContextHandler(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// On Windows, the resolver always uses C library functions, such as GetAddrInfo and DnsQuery.
+		return
+	}
+
+	s := &Server{
+		Handler: ContextHandlerFunc(func(ctx context.Context, rw ResponseWriter, req *Message) {
+			if _, ok := ctx.Deadline(); !ok || TransportFromContext(ctx) != TransportUDP {
+				Error(rw, req, RcodeServFail)
+				return
+			}
+			HOST1(rw, req, 300, netip.AddrFrom4([4]byte{1, 1, 1, 1}))
+		}),
+		ErrorLog: log.Default(),
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+
+	go func() {
+		_ = s.Serve(conn)
+	}()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+
+	ips, err := resolver.LookupNetIP(context.Background(), "ip4", "example.org")
+	if err != nil {
+		t.Errorf("LookupNetIP return error: %+v", err)
+	}
+	if len(ips) == 0 || ips[0].String() != "1.1.1.1" {
+		t.Errorf("LookupNetIP return mismatched reply: %+v", ips)
+	}
+}
+
+func TestWriterTransport(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	cases := []struct {
+		Writer    ResponseWriter
+		Transport Transport
+	}{
+		{&MemResponseWriter{}, TransportUDP},
+		{&tcpResponseWriter{Conn: c1}, TransportTCP},
+		{&tcpResponseWriter{Conn: tls.Client(c1, &tls.Config{})}, TransportDoT},
+	}
+
+	for _, c := range cases {
+		if got := transportOf(context.Background(), c.Writer); got != c.Transport {
+			t.Errorf("transportOf(%T) error got=%#v want=%#v", c.Writer, got, c.Transport)
+		}
+	}
+}
+
+func TestContextHandlerPanic(t *testing.T) {
+	var ctx context.Context
+	h := &contextHandler{
+		Handler: ContextHandlerFunc(func(c context.Context, rw ResponseWriter, req *Message) {
+			ctx = c
+			panic("oops")
+		}),
+		Timeout: time.Hour,
+	}
+
+	func() {
+		defer func() { _ = recover() }()
+		h.ServeDNS(&MemResponseWriter{}, mockMessage())
+	}()
+
+	if ctx == nil || ctx.Err() != context.Canceled {
+		t.Errorf("contextHandler shall cancel the context of panicked handler")
+	}
+}
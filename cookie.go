@@ -0,0 +1,269 @@
+package fastdns
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CookiePolicy is the policy of server for the UDP requests without a valid server cookie.
+type CookiePolicy int
+
+const (
+	// CookieOptional serves the requests regardless of the cookies.
+	CookieOptional CookiePolicy = iota
+	// CookieRequired replies BADCOOKIE with a fresh server cookie to the requests which carry
+	// a client cookie only or an invalid server cookie, and REFUSED to the requests without cookies.
+	CookieRequired
+	// CookieTruncate replies TC=1 to the requests without a valid server cookie, to let the
+	// clients retry over TCP.
+	CookieTruncate
+)
+
+// Cookies generates and validates DNS Cookies (RFC 7873) on server, the server cookies
+// are interoperable SipHash-2-4 cookies described in RFC 9018.
+type Cookies struct {
+	// Policy is applied to the UDP requests without a valid server cookie.
+	Policy CookiePolicy
+
+	once    sync.Once
+	secrets atomic.Value // *cookieSecrets
+}
+
+type cookieSecrets struct {
+	current  [16]byte
+	previous [16]byte
+}
+
+// SetSecret rotates the secret of server cookies, the cookies generated by
+// the previous secret are still valid until next rotation.
+func (c *Cookies) SetSecret(secret [16]byte) {
+	c.once.Do(func() {})
+	s := &cookieSecrets{current: secret, previous: secret}
+	if old, ok := c.secrets.Load().(*cookieSecrets); ok {
+		s.previous = old.current
+	}
+	c.secrets.Store(s)
+}
+
+func (c *Cookies) load() *cookieSecrets {
+	c.once.Do(func() {
+		var secret [16]byte
+		_, _ = rand.Read(secret[:])
+		c.secrets.Store(&cookieSecrets{current: secret, previous: secret})
+	})
+	return c.secrets.Load().(*cookieSecrets)
+}
+
+// AppendServerCookie appends the server cookie of the client cookie and addr to dst.
+func (c *Cookies) AppendServerCookie(dst []byte, client []byte, addr netip.Addr, now time.Time) []byte {
+	return appendServerCookie(dst, &c.load().current, client, addr, uint32(now.Unix()))
+}
+
+// Validate reports whether cookie, the client cookie followed by the server cookie, is valid for addr.
+func (c *Cookies) Validate(cookie []byte, addr netip.Addr, now time.Time) bool {
+	// Version(1), Reserved(3), Timestamp(4), Hash(8)
+	if len(cookie) != 8+16 || cookie[8] != 1 {
+		return false
+	}
+
+	// valid for one hour and five minutes clock skew, see RFC 9018 section 4.3
+	timestamp := binary.BigEndian.Uint32(cookie[12:16])
+	if delta := int32(uint32(now.Unix()) - timestamp); delta > 3600 || delta < -300 {
+		return false
+	}
+
+	var buf [24]byte
+	s := c.load()
+	for _, secret := range [...]*[16]byte{&s.current, &s.previous} {
+		b := appendServerCookie(buf[:0], secret, cookie[:8], addr, timestamp)
+		if subtle.ConstantTimeCompare(b, cookie[8:]) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func appendServerCookie(dst []byte, secret *[16]byte, client []byte, addr netip.Addr, timestamp uint32) []byte {
+	// ClientCookie(8), Version(1), Reserved(3), Timestamp(4), Client-IP(4/16)
+	var buf [8 + 1 + 3 + 4 + 16]byte
+	copy(buf[:8], client)
+	buf[8] = 1
+	binary.BigEndian.PutUint32(buf[12:16], timestamp)
+	n := 16
+	if addr = addr.Unmap(); addr.Is4() {
+		ip := addr.As4()
+		n += copy(buf[n:], ip[:])
+	} else {
+		ip := addr.As16()
+		n += copy(buf[n:], ip[:])
+	}
+
+	hash := siphash(binary.LittleEndian.Uint64(secret[:8]), binary.LittleEndian.Uint64(secret[8:]), buf[:n])
+
+	dst = append(dst, buf[8:16]...)
+	dst = append(dst, byte(hash>>56), byte(hash>>48), byte(hash>>40), byte(hash>>32), byte(hash>>24), byte(hash>>16), byte(hash>>8), byte(hash))
+
+	return dst
+}
+
+// CookieMiddleware adds server cookies to the responses and applies the cookie policy to the UDP requests.
+func CookieMiddleware(cookies *Cookies) Middleware {
+	return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+		var cookie []byte
+		var ok bool
+		if opt, found := req.OPT(); found {
+			cookie, ok = opt.Option(EDNSOptionCookie)
+		}
+
+		if !ok {
+			switch {
+			case cookies.Policy == CookieOptional || transportOf(ctx, rw) != TransportUDP:
+				next.ServeDNSContext(ctx, rw, req)
+			case cookies.Policy == CookieTruncate:
+				truncate(rw, req)
+			default:
+				Error(rw, req, RcodeRefused)
+			}
+			return
+		}
+
+		// client cookie only, or client cookie with a server cookie of 8 to 32 bytes
+		if len(cookie) != 8 && (len(cookie) < 16 || len(cookie) > 40) {
+			Error(rw, req, RcodeFormErr)
+			return
+		}
+
+		w := cookieResponseWriterPool.Get().(*cookieResponseWriter)
+		defer func() {
+			w.ResponseWriter = nil
+			cookieResponseWriterPool.Put(w)
+		}()
+
+		addr := rw.RemoteAddr().Addr()
+		now := time.Now()
+
+		valid := len(cookie) > 8 && cookies.Validate(cookie, addr, now)
+
+		w.ResponseWriter = rw
+		w.cookie = append(w.cookie[:0], cookie[:8]...)
+		w.cookie = cookies.AppendServerCookie(w.cookie, cookie[:8], addr, now)
+
+		if !valid && cookies.Policy != CookieOptional && transportOf(ctx, rw) == TransportUDP {
+			if cookies.Policy == CookieTruncate {
+				truncate(w, req)
+				return
+			}
+			// BADCOOKIE is an extended rcode, 23 = 1<<4 | 7
+			req.SetResponseHeader(RcodeNoError, 0)
+			req.Raw[3] |= byte(RcodeBADCOOKIE & 0x0f)
+			req.Header.Flags |= Flags(RcodeBADCOOKIE & 0x0f)
+			req.Raw[11] = 1
+			req.Header.ARCount = 1
+			req.Raw = AppendOPTRecord(req.Raw, OPT{
+				UDPSize:       1232,
+				ExtendedRcode: byte(RcodeBADCOOKIE >> 4),
+				Options:       AppendEDNSOption(nil, EDNSOptionCookie, w.cookie),
+			})
+			_, _ = rw.Write(req.Raw)
+			return
+		}
+
+		next.ServeDNSContext(ctx, w, req)
+	})
+}
+
+// truncate replies an empty response with TC=1 to req.
+func truncate(rw ResponseWriter, req *Message) {
+	req.SetResponseHeader(RcodeNoError, 0)
+	req.Header.Flags |= 0b0000001000000000
+	req.Raw[2] |= 0b00000010
+	_, _ = rw.Write(req.Raw)
+}
+
+// cookieResponseWriter adds the cookie option to the responses.
+type cookieResponseWriter struct {
+	ResponseWriter
+	cookie []byte
+	buf    []byte
+}
+
+var cookieResponseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return new(cookieResponseWriter)
+	},
+}
+
+// Unwrap returns the wrapped ResponseWriter.
+func (rw *cookieResponseWriter) Unwrap() ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *cookieResponseWriter) Write(p []byte) (int, error) {
+	if len(p) < 12 {
+		return rw.ResponseWriter.Write(p)
+	}
+	rw.buf = appendEDNSOption(rw.buf[:0], p, EDNSOptionCookie, rw.cookie)
+	if _, err := rw.ResponseWriter.Write(rw.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// siphash returns the SipHash-2-4 of p with key k0 and k1.
+func siphash(k0, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	b := uint64(len(p)) << 56
+	for len(p) >= 8 {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		p = p[8:]
+	}
+
+	for i := len(p) - 1; i >= 0; i-- {
+		b |= uint64(p[i]) << (8 * i)
+	}
+	v3 ^= b
+	round()
+	round()
+	v0 ^= b
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+
+	return v0 ^ v1 ^ v2 ^ v3
+}
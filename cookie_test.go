@@ -0,0 +1,178 @@
+package fastdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSiphash(t *testing.T) {
+	var key [16]byte
+	var msg [15]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	k0, k1 := binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:])
+
+	var cases = []struct {
+		Data []byte
+		Hash uint64
+	}{
+		{msg[:0], 0x726fdb47dd0e0e31},
+		{msg[:8], 0x93f5f5799a932462},
+		{msg[:15], 0xa129ca6149be45e5},
+	}
+
+	for _, c := range cases {
+		if hash := siphash(k0, k1, c.Data); hash != c.Hash {
+			t.Errorf("siphash(%x) error got=%x want=%x", c.Data, hash, c.Hash)
+		}
+	}
+}
+
+func TestCookiesValidate(t *testing.T) {
+	cookies := &Cookies{}
+	cookies.SetSecret([16]byte{1})
+
+	client := []byte("01234567")
+	addr := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+
+	cookie := cookies.AppendServerCookie(append([]byte(nil), client...), client, addr, now)
+	if len(cookie) != 24 {
+		t.Fatalf("AppendServerCookie shall return 16 bytes server cookie, got %x", cookie[8:])
+	}
+
+	if !cookies.Validate(cookie, addr, now) {
+		t.Errorf("Validate shall accept cookie %x", cookie)
+	}
+	if !cookies.Validate(cookie, netip.MustParseAddr("::ffff:192.0.2.1"), now) {
+		t.Errorf("Validate shall accept cookie of mapped address")
+	}
+	if cookies.Validate(cookie, netip.MustParseAddr("192.0.2.2"), now) {
+		t.Errorf("Validate shall reject cookie of other address")
+	}
+	if cookies.Validate(cookie, addr, now.Add(2*time.Hour)) {
+		t.Errorf("Validate shall reject expired cookie")
+	}
+
+	cookies.SetSecret([16]byte{2})
+	if !cookies.Validate(cookie, addr, now) {
+		t.Errorf("Validate shall accept cookie of previous secret")
+	}
+	cookies.SetSecret([16]byte{3})
+	if cookies.Validate(cookie, addr, now) {
+		t.Errorf("Validate shall reject cookie of retired secret")
+	}
+}
+
+func TestCookieMiddleware(t *testing.T) {
+	cookies := &Cookies{}
+	client := []byte("01234567")
+	raddr := netip.MustParseAddrPort("192.0.2.1:53")
+	valid := cookies.AppendServerCookie(append([]byte(nil), client...), client, raddr.Addr(), time.Now())
+
+	var cases = []struct {
+		Policy CookiePolicy
+		Cookie []byte
+		Rcode  Rcode
+		TC     bool
+		Answer bool
+	}{
+		{CookieOptional, nil, RcodeNoError, false, true},
+		{CookieOptional, client, RcodeNoError, false, true},
+		{CookieOptional, []byte("0123"), RcodeFormErr, false, false},
+		{CookieRequired, nil, RcodeRefused, false, false},
+		{CookieRequired, client, RcodeBADCOOKIE, false, false},
+		{CookieRequired, valid, RcodeNoError, false, true},
+		{CookieTruncate, client, RcodeNoError, true, false},
+		{CookieTruncate, valid, RcodeNoError, false, true},
+	}
+
+	for _, c := range cases {
+		cookies.Policy = c.Policy
+		handler := Chain(&mockServerHandler{}, CookieMiddleware(cookies))
+
+		var req *Message
+		if c.Cookie != nil {
+			req = mockEDNSMessage(AppendEDNSOption(nil, EDNSOptionCookie, c.Cookie))
+		} else {
+			req = mockEDNSMessage(nil)
+		}
+		_ = ParseMessage(req, req.Raw, false)
+
+		rw := &MemResponseWriter{Raddr: raddr}
+		handler.ServeDNS(rw, req)
+		ReleaseMessage(req)
+
+		resp := AcquireMessage()
+		if err := ParseMessage(resp, rw.Data, true); err != nil && c.Rcode == RcodeNoError {
+			t.Errorf("CookieMiddleware(%d, %x) response error: %+v", c.Policy, c.Cookie, err)
+		}
+		if rcode := resp.Rcode(); rcode != c.Rcode {
+			t.Errorf("CookieMiddleware(%d, %x) rcode got=%s want=%s", c.Policy, c.Cookie, rcode, c.Rcode)
+		}
+		if tc := resp.Header.Flags.TC() != 0; tc != c.TC {
+			t.Errorf("CookieMiddleware(%d, %x) tc got=%v want=%v", c.Policy, c.Cookie, tc, c.TC)
+		}
+		if answer := resp.Header.ANCount != 0; answer != c.Answer {
+			t.Errorf("CookieMiddleware(%d, %x) answer got=%v want=%v", c.Policy, c.Cookie, answer, c.Answer)
+		}
+		if len(c.Cookie) >= 8 && c.Rcode != RcodeFormErr {
+			opt, _ := resp.OPT()
+			cookie, _ := opt.Option(EDNSOptionCookie)
+			if len(cookie) != 24 || !bytes.Equal(cookie[:8], client) || !cookies.Validate(cookie, raddr.Addr(), time.Now()) {
+				t.Errorf("CookieMiddleware(%d, %x) shall reply a valid cookie, got %x", c.Policy, c.Cookie, cookie)
+			}
+		}
+		ReleaseMessage(resp)
+	}
+}
+
+func TestClientCookie(t *testing.T) {
+	s := &Server{
+		Handler:  Chain(&mockServerHandler{}, CookieMiddleware(&Cookies{Policy: CookieRequired})),
+		ErrorLog: log.Default(),
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		_ = s.Serve(conn)
+	}()
+
+	client := &Client{
+		AddrPort:    conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout: time.Second,
+		Cookie:      true,
+	}
+
+	for i := 0; i < 2; i++ {
+		req, resp := AcquireMessage(), AcquireMessage()
+		req.SetRequestQuestion("example.org", TypeA, ClassINET)
+		if err := client.Exchange(req, resp); err != nil {
+			t.Fatalf("client exchange error: %+v", err)
+		}
+		if resp.Rcode() != RcodeNoError || resp.Header.ANCount != 1 {
+			t.Errorf("client exchange shall pass cookie check, rcode=%s raw=%x", resp.Rcode(), resp.Raw)
+		}
+		ReleaseMessage(req)
+		ReleaseMessage(resp)
+	}
+
+	if cookie := client.cookie(client.AddrPort); len(cookie) != 24 {
+		t.Errorf("client shall remember the server cookie, got %x", cookie)
+	}
+}
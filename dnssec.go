@@ -0,0 +1,714 @@
+package fastdns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidDNSSECRecord is returned when dnssec record is malformed.
+	ErrInvalidDNSSECRecord = errors.New("dns dnssec record is malformed")
+	// ErrUnsupportedAlgorithm is returned when dnssec algorithm or digest type is not supported.
+	ErrUnsupportedAlgorithm = errors.New("dns dnssec algorithm is not supported")
+	// ErrBogusSignature is returned when dnssec records have no valid signatures.
+	ErrBogusSignature = errors.New("dns dnssec signature is bogus")
+	// ErrBogusDenial is returned when dnssec denial of existence is not proved.
+	ErrBogusDenial = errors.New("dns dnssec denial of existence is bogus")
+)
+
+// DNSSECAlgorithm is a DNSSEC algorithm number.
+type DNSSECAlgorithm uint8
+
+// Wire constants and supported algorithms.
+const (
+	AlgorithmRSASHA1          DNSSECAlgorithm = 5
+	AlgorithmRSASHA1NSEC3SHA1 DNSSECAlgorithm = 7
+	AlgorithmRSASHA256        DNSSECAlgorithm = 8
+	AlgorithmRSASHA512        DNSSECAlgorithm = 10
+	AlgorithmECDSAP256SHA256  DNSSECAlgorithm = 13
+	AlgorithmECDSAP384SHA384  DNSSECAlgorithm = 14
+	AlgorithmED25519          DNSSECAlgorithm = 15
+)
+
+func (a DNSSECAlgorithm) String() string {
+	switch a {
+	case AlgorithmRSASHA1:
+		return "RSASHA1"
+	case AlgorithmRSASHA1NSEC3SHA1:
+		return "RSASHA1-NSEC3-SHA1"
+	case AlgorithmRSASHA256:
+		return "RSASHA256"
+	case AlgorithmRSASHA512:
+		return "RSASHA512"
+	case AlgorithmECDSAP256SHA256:
+		return "ECDSAP256SHA256"
+	case AlgorithmECDSAP384SHA384:
+		return "ECDSAP384SHA384"
+	case AlgorithmED25519:
+		return "ED25519"
+	}
+	return ""
+}
+
+// hash returns the hash function of algorithm, ED25519 signs the message without prehash.
+func (a DNSSECAlgorithm) hash() (crypto.Hash, bool) {
+	switch a {
+	case AlgorithmRSASHA1, AlgorithmRSASHA1NSEC3SHA1:
+		return crypto.SHA1, true
+	case AlgorithmRSASHA256, AlgorithmECDSAP256SHA256:
+		return crypto.SHA256, true
+	case AlgorithmRSASHA512:
+		return crypto.SHA512, true
+	case AlgorithmECDSAP384SHA384:
+		return crypto.SHA384, true
+	case AlgorithmED25519:
+		return 0, true
+	}
+	return 0, false
+}
+
+// Digest types of DS records.
+const (
+	DigestSHA1   uint8 = 1
+	DigestSHA256 uint8 = 2
+	DigestSHA384 uint8 = 4
+)
+
+// Security is the DNSSEC validation state of answers, see RFC 4035 Section 4.3.
+type Security uint8
+
+// Security states, Indeterminate means that the answers are not validated.
+const (
+	SecurityIndeterminate Security = iota
+	SecurityInsecure
+	SecuritySecure
+	SecurityBogus
+)
+
+func (s Security) String() string {
+	switch s {
+	case SecurityIndeterminate:
+		return "Indeterminate"
+	case SecurityInsecure:
+		return "Insecure"
+	case SecuritySecure:
+		return "Secure"
+	case SecurityBogus:
+		return "Bogus"
+	}
+	return ""
+}
+
+// combine returns the security of answers which consist of the answers of s and t.
+func (s Security) combine(t Security) Security {
+	for _, x := range []Security{SecurityBogus, SecurityIndeterminate, SecurityInsecure} {
+		if s == x || t == x {
+			return x
+		}
+	}
+	return SecuritySecure
+}
+
+// DNSKEY represents the data of DNSKEY record, see RFC 4034 Section 2.
+type DNSKEY struct {
+	// Flags is the flags of key, 256 for ZSK and 257 for KSK.
+	Flags uint16
+
+	// Protocol must be 3.
+	Protocol uint8
+
+	// Algorithm is the algorithm of public key.
+	Algorithm DNSSECAlgorithm
+
+	// PublicKey is the public key in the format of algorithm.
+	PublicKey []byte
+}
+
+// NewDNSKEY returns the DNSKEY of the ECDSA P-256/P-384, Ed25519 or RSA (with RSASHA256) public key,
+// flags is 256 for ZSK and 257 for KSK.
+func NewDNSKEY(flags uint16, pub crypto.PublicKey) (key DNSKEY, err error) {
+	key.Flags, key.Protocol = flags, 3
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			key.Algorithm = AlgorithmECDSAP256SHA256
+		case elliptic.P384():
+			key.Algorithm = AlgorithmECDSAP384SHA384
+		default:
+			return key, ErrUnsupportedAlgorithm
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		key.PublicKey = make([]byte, 2*size)
+		pub.X.FillBytes(key.PublicKey[:size])
+		pub.Y.FillBytes(key.PublicKey[size:])
+	case ed25519.PublicKey:
+		key.Algorithm = AlgorithmED25519
+		key.PublicKey = append([]byte(nil), pub...)
+	case *rsa.PublicKey:
+		key.Algorithm = AlgorithmRSASHA256
+		e := big.NewInt(int64(pub.E)).Bytes()
+		if len(e) > 255 {
+			return key, ErrUnsupportedAlgorithm
+		}
+		key.PublicKey = append(append([]byte{byte(len(e))}, e...), pub.N.Bytes()...)
+	default:
+		return key, ErrUnsupportedAlgorithm
+	}
+	return key, nil
+}
+
+// ParseDNSKEY parses the data of DNSKEY record.
+func ParseDNSKEY(data []byte) (key DNSKEY, err error) {
+	if len(data) < 4 {
+		return key, ErrInvalidDNSSECRecord
+	}
+	key.Flags = uint16(data[0])<<8 | uint16(data[1])
+	key.Protocol = data[2]
+	key.Algorithm = DNSSECAlgorithm(data[3])
+	key.PublicKey = data[4:]
+	return key, nil
+}
+
+// AppendDNSKEY appends the data of DNSKEY record to dst and returns the resulting dst.
+func AppendDNSKEY(dst []byte, key DNSKEY) []byte {
+	dst = append(dst, byte(key.Flags>>8), byte(key.Flags), key.Protocol, byte(key.Algorithm))
+	return append(dst, key.PublicKey...)
+}
+
+// KeyTag returns the key tag of key, see RFC 4034 Appendix B.
+func (key DNSKEY) KeyTag() uint16 {
+	var ac uint32
+	for i, b := range AppendDNSKEY(nil, key) {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+// DS returns the DS record data of key with owner name and digest type.
+func (key DNSKEY) DS(owner string, digestType uint8) (ds DS, err error) {
+	ds.KeyTag, ds.Algorithm, ds.DigestType = key.KeyTag(), key.Algorithm, digestType
+	ds.Digest, err = dsDigest(owner, key, digestType)
+	return ds, err
+}
+
+func dsDigest(owner string, key DNSKEY, digestType uint8) ([]byte, error) {
+	data := AppendDNSKEY(encodeName(nil, strings.ToLower(owner)), key)
+	switch digestType {
+	case DigestSHA1:
+		d := sha1.Sum(data)
+		return d[:], nil
+	case DigestSHA256:
+		d := sha256.Sum256(data)
+		return d[:], nil
+	case DigestSHA384:
+		d := sha512.Sum384(data)
+		return d[:], nil
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// DS represents the data of DS record, see RFC 4034 Section 5.
+type DS struct {
+	// KeyTag is the key tag of the DNSKEY.
+	KeyTag uint16
+
+	// Algorithm is the algorithm of the DNSKEY.
+	Algorithm DNSSECAlgorithm
+
+	// DigestType is the digest algorithm.
+	DigestType uint8
+
+	// Digest is the digest of the DNSKEY.
+	Digest []byte
+}
+
+// ParseDS parses the data of DS record.
+func ParseDS(data []byte) (ds DS, err error) {
+	if len(data) < 5 {
+		return ds, ErrInvalidDNSSECRecord
+	}
+	ds.KeyTag = uint16(data[0])<<8 | uint16(data[1])
+	ds.Algorithm = DNSSECAlgorithm(data[2])
+	ds.DigestType = data[3]
+	ds.Digest = data[4:]
+	return ds, nil
+}
+
+// AppendDS appends the data of DS record to dst and returns the resulting dst.
+func AppendDS(dst []byte, ds DS) []byte {
+	dst = append(dst, byte(ds.KeyTag>>8), byte(ds.KeyTag), byte(ds.Algorithm), ds.DigestType)
+	return append(dst, ds.Digest...)
+}
+
+// RRSIG represents the data of RRSIG record, see RFC 4034 Section 3.
+type RRSIG struct {
+	// TypeCovered is the type of the signed RRset.
+	TypeCovered Type
+
+	// Algorithm is the algorithm of signature.
+	Algorithm DNSSECAlgorithm
+
+	// Labels is the number of labels of the original owner name, without the wildcard label.
+	Labels uint8
+
+	// OriginalTTL is the TTL of the signed RRset.
+	OriginalTTL uint32
+
+	// Expiration and Inception are the validity period in seconds since epoch, in serial number arithmetic.
+	Expiration uint32
+	Inception  uint32
+
+	// KeyTag is the key tag of the signing DNSKEY.
+	KeyTag uint16
+
+	// SignerName is the zone name of the signing DNSKEY, without the trailing dot.
+	SignerName string
+
+	// Signature is the signature in the format of algorithm.
+	Signature []byte
+}
+
+// ParseRRSIG parses the data of RRSIG record.
+func ParseRRSIG(data []byte) (sig RRSIG, err error) {
+	if len(data) < 19 {
+		return sig, ErrInvalidDNSSECRecord
+	}
+	sig.TypeCovered = Type(data[0])<<8 | Type(data[1])
+	sig.Algorithm = DNSSECAlgorithm(data[2])
+	sig.Labels = data[3]
+	sig.OriginalTTL = uint32(data[4])<<24 | uint32(data[5])<<16 | uint32(data[6])<<8 | uint32(data[7])
+	sig.Expiration = uint32(data[8])<<24 | uint32(data[9])<<16 | uint32(data[10])<<8 | uint32(data[11])
+	sig.Inception = uint32(data[12])<<24 | uint32(data[13])<<16 | uint32(data[14])<<8 | uint32(data[15])
+	sig.KeyTag = uint16(data[16])<<8 | uint16(data[17])
+	name, end := readName(data, 18)
+	if end < 0 {
+		return sig, ErrInvalidDNSSECRecord
+	}
+	sig.SignerName = name
+	sig.Signature = data[end:]
+	return sig, nil
+}
+
+// AppendRRSIG appends the data of RRSIG record to dst and returns the resulting dst.
+func AppendRRSIG(dst []byte, sig RRSIG) []byte {
+	dst = append(dst,
+		byte(sig.TypeCovered>>8), byte(sig.TypeCovered), byte(sig.Algorithm), sig.Labels,
+		byte(sig.OriginalTTL>>24), byte(sig.OriginalTTL>>16), byte(sig.OriginalTTL>>8), byte(sig.OriginalTTL),
+		byte(sig.Expiration>>24), byte(sig.Expiration>>16), byte(sig.Expiration>>8), byte(sig.Expiration),
+		byte(sig.Inception>>24), byte(sig.Inception>>16), byte(sig.Inception>>8), byte(sig.Inception),
+		byte(sig.KeyTag>>8), byte(sig.KeyTag),
+	)
+	dst = encodeName(dst, sig.SignerName)
+	return append(dst, sig.Signature...)
+}
+
+// NSEC represents the data of NSEC record, see RFC 4034 Section 4.
+type NSEC struct {
+	// NextDomain is the next owner name in the canonical ordering of zone.
+	NextDomain string
+
+	// Types is the types at the owner name.
+	Types []Type
+}
+
+// ParseNSEC parses the data of NSEC record.
+func ParseNSEC(data []byte) (nsec NSEC, err error) {
+	name, end := readName(data, 0)
+	if end < 0 {
+		return nsec, ErrInvalidDNSSECRecord
+	}
+	nsec.NextDomain = name
+	nsec.Types, err = parseTypeBitmap(data[end:])
+	return nsec, err
+}
+
+// AppendNSEC appends the data of NSEC record to dst and returns the resulting dst.
+func AppendNSEC(dst []byte, nsec NSEC) []byte {
+	dst = encodeName(dst, nsec.NextDomain)
+	return appendTypeBitmap(dst, nsec.Types)
+}
+
+// NSEC3 represents the data of NSEC3 record, see RFC 5155 Section 3.
+type NSEC3 struct {
+	// HashAlgorithm is the hash algorithm, 1 for SHA-1.
+	HashAlgorithm uint8
+
+	// Flags is the flags, the lowest bit is the Opt-Out flag.
+	Flags uint8
+
+	// Iterations is the number of additional hash iterations.
+	Iterations uint16
+
+	// Salt is the salt of hash.
+	Salt []byte
+
+	// NextHashed is the next hashed owner name in binary.
+	NextHashed []byte
+
+	// Types is the types at the original owner name.
+	Types []Type
+}
+
+// ParseNSEC3 parses the data of NSEC3 record.
+func ParseNSEC3(data []byte) (nsec3 NSEC3, err error) {
+	if len(data) < 5 {
+		return nsec3, ErrInvalidDNSSECRecord
+	}
+	// the lengths are converted to int, as 5+salt and 1+hash overflow byte
+	salt := int(data[4])
+	if len(data) < 6+salt || len(data) < 6+salt+int(data[5+salt]) {
+		return nsec3, ErrInvalidDNSSECRecord
+	}
+	nsec3.HashAlgorithm = data[0]
+	nsec3.Flags = data[1]
+	nsec3.Iterations = uint16(data[2])<<8 | uint16(data[3])
+	nsec3.Salt = data[5 : 5+salt]
+	data = data[5+salt:]
+	hash := int(data[0])
+	nsec3.NextHashed = data[1 : 1+hash]
+	nsec3.Types, err = parseTypeBitmap(data[1+hash:])
+	return nsec3, err
+}
+
+// AppendNSEC3 appends the data of NSEC3 record to dst and returns the resulting dst.
+func AppendNSEC3(dst []byte, nsec3 NSEC3) []byte {
+	dst = append(dst, nsec3.HashAlgorithm, nsec3.Flags, byte(nsec3.Iterations>>8), byte(nsec3.Iterations), byte(len(nsec3.Salt)))
+	dst = append(dst, nsec3.Salt...)
+	dst = append(dst, byte(len(nsec3.NextHashed)))
+	dst = append(dst, nsec3.NextHashed...)
+	return appendTypeBitmap(dst, nsec3.Types)
+}
+
+// hasType reports whether typ is in types.
+func hasType(types []Type, typ Type) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTypeBitmap parses the type bit maps of NSEC and NSEC3 records.
+func parseTypeBitmap(data []byte) (types []Type, err error) {
+	for len(data) != 0 {
+		if len(data) < 2 || data[1] == 0 || data[1] > 32 || len(data) < 2+int(data[1]) {
+			return nil, ErrInvalidDNSSECRecord
+		}
+		window := Type(data[0]) << 8
+		for i, b := range data[2 : 2+data[1]] {
+			for j := 0; j < 8; j++ {
+				if b&(0x80>>j) != 0 {
+					types = append(types, window|Type(i*8+j))
+				}
+			}
+		}
+		data = data[2+data[1]:]
+	}
+	return types, nil
+}
+
+// appendTypeBitmap appends the type bit maps of types to dst.
+func appendTypeBitmap(dst []byte, types []Type) []byte {
+	types = append([]Type(nil), types...)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	for i := 0; i < len(types); {
+		window := types[i] >> 8
+		var bitmap [32]byte
+		n := 0
+		for ; i < len(types) && types[i]>>8 == window; i++ {
+			b := int(types[i] & 0xff)
+			bitmap[b/8] |= 0x80 >> (b % 8)
+			n = b/8 + 1
+		}
+		dst = append(dst, byte(window), byte(n))
+		dst = append(dst, bitmap[:n]...)
+	}
+	return dst
+}
+
+// nsec3Hash returns the NSEC3 SHA-1 hash of name, see RFC 5155 Section 5.
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	h := sha1.New()
+	h.Write(encodeName(nil, strings.ToLower(name)))
+	h.Write(salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(digest[:0])
+	}
+	return digest
+}
+
+var base32HexEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// nsec3Label returns the hashed owner label of NSEC3 records in lowercase base32hex.
+func nsec3Label(hash []byte) string {
+	return strings.ToLower(base32HexEncoding.EncodeToString(hash))
+}
+
+// compareNames compares the lowercase names in the canonical ordering, see RFC 4034 Section 6.1.
+func compareNames(a, b string) int {
+	for a != "" && b != "" {
+		var la, lb string
+		if i := strings.LastIndexByte(a, '.'); i >= 0 {
+			a, la = a[:i], a[i+1:]
+		} else {
+			a, la = "", a
+		}
+		if i := strings.LastIndexByte(b, '.'); i >= 0 {
+			b, lb = b[:i], b[i+1:]
+		} else {
+			b, lb = "", b
+		}
+		if c := strings.Compare(la, lb); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	}
+	return 1
+}
+
+// covers reports whether name is strictly between owner and next, the last record of a chain covers
+// the names after owner or before next.
+func covers(owner, next, name string) bool {
+	if compareNames(owner, next) < 0 {
+		return compareNames(owner, name) < 0 && compareNames(name, next) < 0
+	}
+	return compareNames(owner, name) < 0 || compareNames(name, next) < 0
+}
+
+// coversHash is covers of the NSEC3 hashes.
+func coversHash(owner, next, hash []byte) bool {
+	if bytes.Compare(owner, next) < 0 {
+		return bytes.Compare(owner, hash) < 0 && bytes.Compare(hash, next) < 0
+	}
+	return bytes.Compare(owner, hash) < 0 || bytes.Compare(hash, next) < 0
+}
+
+// canonicalRRs returns the canonical form of the RRset for signing, see RFC 4034 Section 6.
+// The wildcard owner is restored from labels of signature.
+func canonicalRRs(dst []byte, rrs []recursorRR, sig RRSIG) []byte {
+	owner := strings.ToLower(rrs[0].Name)
+	if n := countLabels(owner); int(sig.Labels) < n && !(strings.HasPrefix(owner, "*.") && int(sig.Labels) == n-1) {
+		owner = strings.TrimSuffix("*."+ancestorName(owner, int(sig.Labels)), ".")
+	}
+
+	datas := make([][]byte, 0, len(rrs))
+	for _, rr := range rrs {
+		data := rr.Data
+		if prefix, _, suffix, ok := rdataNames(rr.Type); ok && prefix+suffix <= len(data) {
+			data = append([]byte(nil), data...)
+			lower := data[prefix : len(data)-suffix]
+			for i, c := range lower {
+				if 'A' <= c && c <= 'Z' {
+					lower[i] = c + 'a' - 'A'
+				}
+			}
+		}
+		datas = append(datas, data)
+	}
+	sort.Slice(datas, func(i, j int) bool { return bytes.Compare(datas[i], datas[j]) < 0 })
+
+	for i, data := range datas {
+		if i > 0 && bytes.Equal(data, datas[i-1]) {
+			continue
+		}
+		dst = appendRR(dst, recursorRR{
+			Name:  owner,
+			Type:  rrs[0].Type,
+			Class: rrs[0].Class,
+			TTL:   sig.OriginalTTL,
+			Data:  data,
+		})
+	}
+
+	return dst
+}
+
+// signedData returns the data which is signed by sig, that is the RRSIG data without signature and the RRset.
+func signedData(rrs []recursorRR, sig RRSIG) []byte {
+	sig.SignerName = strings.ToLower(sig.SignerName)
+	sig.Signature = nil
+	return canonicalRRs(AppendRRSIG(nil, sig), rrs, sig)
+}
+
+// verifyRRSIG verifies the signature of RRset by key at time now.
+func verifyRRSIG(rrs []recursorRR, sig RRSIG, key DNSKEY, now time.Time) error {
+	if sig.Algorithm != key.Algorithm || sig.KeyTag != key.KeyTag() || key.Flags&0x0100 == 0 || key.Protocol != 3 {
+		return ErrBogusSignature
+	}
+	// serial number arithmetic, see RFC 4034 Section 3.1.5
+	t := uint32(now.Unix())
+	if int32(t-sig.Inception) < 0 || int32(sig.Expiration-t) < 0 {
+		return ErrBogusSignature
+	}
+
+	hash, ok := sig.Algorithm.hash()
+	if !ok {
+		return ErrUnsupportedAlgorithm
+	}
+	data := signedData(rrs, sig)
+	var hashed []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(data)
+		hashed = h.Sum(nil)
+	}
+
+	switch sig.Algorithm {
+	case AlgorithmRSASHA1, AlgorithmRSASHA1NSEC3SHA1, AlgorithmRSASHA256, AlgorithmRSASHA512:
+		pub, err := rsaPublicKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, hashed, sig.Signature) != nil {
+			return ErrBogusSignature
+		}
+	case AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384:
+		curve := elliptic.P256()
+		if sig.Algorithm == AlgorithmECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(key.PublicKey) != 2*size || len(sig.Signature) != 2*size {
+			return ErrBogusSignature
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return ErrBogusSignature
+		}
+		r, s := new(big.Int).SetBytes(sig.Signature[:size]), new(big.Int).SetBytes(sig.Signature[size:])
+		if !ecdsa.Verify(pub, hashed, r, s) {
+			return ErrBogusSignature
+		}
+	case AlgorithmED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(key.PublicKey, data, sig.Signature) {
+			return ErrBogusSignature
+		}
+	}
+
+	return nil
+}
+
+// rsaPublicKey parses the RSA public key of DNSKEY, see RFC 3110 Section 2.
+func rsaPublicKey(data []byte) (*rsa.PublicKey, error) {
+	if len(data) < 3 {
+		return nil, ErrInvalidDNSSECRecord
+	}
+	n := int(data[0])
+	data = data[1:]
+	if n == 0 {
+		n = int(data[0])<<8 | int(data[1])
+		data = data[2:]
+	}
+	if n == 0 || n > 4 || len(data) <= n {
+		return nil, ErrInvalidDNSSECRecord
+	}
+	e := 0
+	for _, b := range data[:n] {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(data[n:]), E: e}, nil
+}
+
+// signRRset signs the RRset of zone signer by the private key of key, and returns the RRSIG record.
+func signRRset(rrs []recursorRR, signer string, key DNSKEY, priv crypto.Signer, inception, expiration time.Time) (recursorRR, error) {
+	owner := rrs[0].Name
+	labels := countLabels(owner)
+	if strings.HasPrefix(owner, "*.") || owner == "*" {
+		labels--
+	}
+	sig := RRSIG{
+		TypeCovered: rrs[0].Type,
+		Algorithm:   key.Algorithm,
+		Labels:      uint8(labels),
+		OriginalTTL: rrs[0].TTL,
+		Expiration:  uint32(expiration.Unix()),
+		Inception:   uint32(inception.Unix()),
+		KeyTag:      key.KeyTag(),
+		SignerName:  strings.ToLower(signer),
+	}
+
+	hash, ok := sig.Algorithm.hash()
+	if !ok {
+		return recursorRR{}, ErrUnsupportedAlgorithm
+	}
+	data := signedData(rrs, sig)
+	if hash != 0 {
+		h := hash.New()
+		h.Write(data)
+		data = h.Sum(nil)
+	}
+
+	signature, err := priv.Sign(rand.Reader, data, hash)
+	if err != nil {
+		return recursorRR{}, err
+	}
+	if pub, ok := priv.Public().(*ecdsa.PublicKey); ok {
+		// convert the ASN.1 signature to r || s
+		r, s, err := parseECDSASignature(signature)
+		if err != nil {
+			return recursorRR{}, err
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	sig.Signature = signature
+
+	return recursorRR{Name: owner, Type: TypeRRSIG, Class: rrs[0].Class, TTL: rrs[0].TTL, Data: AppendRRSIG(nil, sig)}, nil
+}
+
+// parseECDSASignature parses the ASN.1 DER ECDSA signature produced by crypto.Signer.
+func parseECDSASignature(der []byte) (r, s *big.Int, err error) {
+	integer := func(b []byte) (*big.Int, []byte, bool) {
+		if len(b) < 2 || b[0] != 0x02 || int(b[1]) > len(b)-2 || b[1] >= 0x80 {
+			return nil, nil, false
+		}
+		return new(big.Int).SetBytes(b[2 : 2+b[1]]), b[2+b[1]:], true
+	}
+	if len(der) < 2 || der[0] != 0x30 || int(der[1]) != len(der)-2 {
+		return nil, nil, ErrInvalidDNSSECRecord
+	}
+	var ok bool
+	if r, der, ok = integer(der[2:]); !ok {
+		return nil, nil, ErrInvalidDNSSECRecord
+	}
+	if s, _, ok = integer(der); !ok {
+		return nil, nil, ErrInvalidDNSSECRecord
+	}
+	return r, s, nil
+}
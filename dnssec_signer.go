@@ -0,0 +1,394 @@
+package fastdns
+
+import (
+	"context"
+	"crypto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSSECSigner signs the answers of zone online, which are generated dynamically by handlers.
+//
+// The denial of existence uses the compact NSEC records of RFC 9824 ("black lies"), the NXDOMAIN responses
+// are replied as NODATA with the NXNAME type, unless the query sets the Compact Answers OK (CO) flag.
+// The signatures of RRsets are cached and renewed after half of the validity period.
+type DNSSECSigner struct {
+	// Zone is the name of signed zone, e.g. "example.org".
+	Zone string
+
+	// PrivateKey is the key of zone, it should be an ECDSA P-256 key or an Ed25519 key.
+	PrivateKey crypto.Signer
+
+	// TTL is the TTL of DNSKEY records, use 3600 if empty.
+	TTL uint32
+
+	// NegativeTTL is the TTL of the SOA and NSEC records of negative answers, use 300 if empty.
+	NegativeTTL uint32
+
+	// MName and RName are the names of SOA record of negative answers if handlers do not reply SOA,
+	// use "ns1.<zone>" and "hostmaster.<zone>" if empty.
+	MName string
+	RName string
+
+	// Validity is the validity period of signatures, use 24h if empty.
+	Validity time.Duration
+
+	// MaxCacheEntries limits the cached signatures, use 10000 if empty.
+	MaxCacheEntries int
+
+	once   sync.Once
+	key    DNSKEY
+	err    error
+	serial uint32
+
+	mu    sync.Mutex
+	cache map[string]*signerEntry
+}
+
+type signerEntry struct {
+	rrsig   recursorRR
+	refresh int64
+}
+
+// DNSKEY returns the DNSKEY of zone, which is a KSK and ZSK, its DS record should be added to the parent zone.
+func (s *DNSSECSigner) DNSKEY() (DNSKEY, error) {
+	s.once.Do(func() {
+		if s.PrivateKey == nil {
+			s.err = ErrUnsupportedAlgorithm
+			return
+		}
+		s.key, s.err = NewDNSKEY(257, s.PrivateKey.Public())
+		s.serial = uint32(time.Now().Unix())
+	})
+	return s.key, s.err
+}
+
+// DNSSECSigningMiddleware signs the answers of handlers in the zone of signer, if the query has the DO bit.
+// The DNSKEY queries of zone apex are answered by signer.
+func DNSSECSigningMiddleware(signer *DNSSECSigner) Middleware {
+	zone := strings.ToLower(strings.TrimSuffix(signer.Zone, "."))
+	return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+		name := strings.ToLower(string(req.Domain))
+		if !isSubdomain(name, zone) || req.Question.Class != ClassINET {
+			next.ServeDNSContext(ctx, rw, req)
+			return
+		}
+
+		if _, err := signer.DNSKEY(); err != nil {
+			Error(rw, req, RcodeServFail)
+			return
+		}
+
+		opt, edns := req.OPT()
+		do := edns && opt.Flags&0x8000 != 0
+
+		if name == zone && req.Question.Type == TypeDNSKEY {
+			signer.serveDNSKEY(rw, req, zone, edns, do)
+			return
+		}
+		if !do {
+			next.ServeDNSContext(ctx, rw, req)
+			return
+		}
+
+		// the question and OPT of req are saved, as handlers may reuse req for responses
+		w := dnssecResponseWriterPool.Get().(*dnssecResponseWriter)
+		w.ResponseWriter, w.signer, w.zone, w.name = rw, signer, zone, name
+		w.question = append(w.question[:0], req.Raw[12:12+len(req.Question.Name)+4]...)
+		w.udpsize, w.co = opt.UDPSize, opt.Flags&0x4000 != 0
+		w.tcp = transportOf(ctx, rw) != TransportUDP
+		next.ServeDNSContext(ctx, w, req)
+		w.ResponseWriter, w.signer = nil, nil
+		dnssecResponseWriterPool.Put(w)
+	})
+}
+
+// serveDNSKEY replies the DNSKEY RRset of zone, which is signed if do is set.
+func (s *DNSSECSigner) serveDNSKEY(rw ResponseWriter, req *Message, zone string, edns, do bool) {
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = 3600
+	}
+	records := []recursorRR{{Name: zone, Type: TypeDNSKEY, Class: ClassINET, TTL: ttl, Data: AppendDNSKEY(nil, s.key)}}
+	if do {
+		rrsig, err := s.rrsig(records, zone)
+		if err != nil {
+			Error(rw, req, RcodeServFail)
+			return
+		}
+		records = append(records, rrsig)
+	}
+
+	req.SetResponseHeader(RcodeNoError, uint16(len(records)))
+	// AA = 1
+	req.Header.Flags |= 0b0000010000000000
+	req.Raw[2] = byte(req.Header.Flags >> 8)
+	for _, rr := range records {
+		req.Raw = appendRR(req.Raw, rr)
+	}
+	if edns {
+		req.SetEDNS(1232, do)
+	}
+
+	_, _ = rw.Write(req.Raw)
+}
+
+// rrsig returns the cached RRSIG record of RRset, or signs it if the cached one is expiring.
+func (s *DNSSECSigner) rrsig(rrs []recursorRR, zone string) (recursorRR, error) {
+	key := string(canonicalRRs(nil, rrs, RRSIG{Labels: uint8(countLabels(rrs[0].Name)), OriginalTTL: rrs[0].TTL}))
+	now := time.Now()
+
+	s.mu.Lock()
+	e := s.cache[key]
+	s.mu.Unlock()
+
+	if e != nil && now.Unix() < e.refresh {
+		rrsig := e.rrsig
+		rrsig.Name = rrs[0].Name
+		return rrsig, nil
+	}
+
+	validity := s.Validity
+	if validity <= 0 {
+		validity = 24 * time.Hour
+	}
+	// the inception is one hour before for the clock skew of validators
+	rrsig, err := signRRset(rrs, zone, s.key, s.PrivateKey, now.Add(-time.Hour), now.Add(validity))
+	if err != nil {
+		return rrsig, err
+	}
+
+	max := s.MaxCacheEntries
+	if max <= 0 {
+		max = 10000
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cache == nil {
+		s.cache = make(map[string]*signerEntry)
+	}
+	if len(s.cache) >= max {
+		// evict the expiring entries, or the random ones if the cache is still full
+		for k, e := range s.cache {
+			if e.refresh <= now.Unix() || len(s.cache) >= max {
+				delete(s.cache, k)
+			}
+		}
+	}
+	s.cache[key] = &signerEntry{rrsig: rrsig, refresh: now.Add(validity / 2).Unix()}
+
+	return rrsig, nil
+}
+
+// soa returns the SOA record of zone for negative answers.
+func (s *DNSSECSigner) soa(zone string) recursorRR {
+	mname, rname := strings.TrimSuffix(s.MName, "."), strings.TrimSuffix(s.RName, ".")
+	if mname == "" {
+		mname = strings.TrimPrefix("ns1."+zone, ".")
+	}
+	if rname == "" {
+		rname = strings.TrimPrefix("hostmaster."+zone, ".")
+	}
+	ttl := s.negativeTTL()
+
+	data := encodeName(encodeName(nil, mname), rname)
+	data = append(data,
+		byte(s.serial>>24), byte(s.serial>>16), byte(s.serial>>8), byte(s.serial),
+		0, 0, 0x0e, 0x10, // refresh 3600
+		0, 0, 0x03, 0x84, // retry 900
+		0, 0x09, 0x3a, 0x80, // expire 604800
+		byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl),
+	)
+
+	return recursorRR{Name: zone, Type: TypeSOA, Class: ClassINET, TTL: ttl, Data: data}
+}
+
+func (s *DNSSECSigner) negativeTTL() uint32 {
+	if s.NegativeTTL == 0 {
+		return 300
+	}
+	return s.NegativeTTL
+}
+
+// sign appends the signed response of payload for the query of w to dst.
+func (s *DNSSECSigner) sign(dst []byte, w *dnssecResponseWriter, payload []byte) ([]byte, error) {
+	var answers, authority, additional []recursorRR
+	if payload[4] == 0 && payload[5] == 1 {
+		msg := AcquireMessage()
+		defer ReleaseMessage(msg)
+		if err := ParseMessage(msg, payload, true); err != nil {
+			return nil, err
+		}
+		answers, authority, additional = parseRRs(msg)
+	}
+
+	zone, name := w.zone, w.name
+	rcode := Rcode(payload[3] & 0x0f)
+
+	var records [3][]recursorRR
+	signed := func(i int, section []recursorRR) error {
+		seen := make(map[recursorKey]bool)
+		for _, rr := range section {
+			records[i] = append(records[i], rr)
+			key := recursorKey{rr.Name, rr.Type}
+			if seen[key] || !isSubdomain(rr.Name, zone) || rr.Type == TypeRRSIG || (rr.Type == TypeNS && rr.Name != zone) {
+				continue
+			}
+			seen[key] = true
+			rrsig, err := s.rrsig(rrset(section, rr.Name, rr.Type), zone)
+			if err != nil {
+				return err
+			}
+			records[i] = append(records[i], rrsig)
+		}
+		return nil
+	}
+	denial := func(owner string, types ...Type) error {
+		nsec := recursorRR{
+			Name:  owner,
+			Type:  TypeNSEC,
+			Class: ClassINET,
+			TTL:   s.negativeTTL(),
+			Data:  AppendNSEC(nil, NSEC{NextDomain: "\x00." + owner, Types: append(types, TypeRRSIG, TypeNSEC)}),
+		}
+		return signed(1, []recursorRR{nsec})
+	}
+
+	if err := signed(0, answers); err != nil {
+		return nil, err
+	}
+
+	var cut string
+	for _, rr := range authority {
+		if rr.Type == TypeNS && rr.Name != zone && isSubdomain(name, rr.Name) && isSubdomain(rr.Name, zone) {
+			cut = rr.Name
+		}
+	}
+
+	switch {
+	case len(answers) == 0 && cut != "":
+		// referral, the insecure delegation is proved if there are no DS records
+		if err := signed(1, authority); err != nil {
+			return nil, err
+		}
+		if len(rrset(authority, cut, TypeDS)) == 0 {
+			if err := denial(cut, TypeNS); err != nil {
+				return nil, err
+			}
+		}
+	case len(answers) == 0:
+		// NXDOMAIN and NODATA, the compact denial of existence, see RFC 9824
+		soa := rrset(authority, zone, TypeSOA)
+		if len(soa) == 0 {
+			soa = []recursorRR{s.soa(zone)}
+		}
+		if err := signed(1, soa); err != nil {
+			return nil, err
+		}
+		types := []Type(nil)
+		if rcode == RcodeNXDomain {
+			types = append(types, TypeNXNAME)
+			if !w.co {
+				rcode = RcodeNoError
+			}
+		}
+		if err := denial(name, types...); err != nil {
+			return nil, err
+		}
+	default:
+		if err := signed(1, authority); err != nil {
+			return nil, err
+		}
+	}
+	records[2] = additional
+
+	header := len(dst)
+	dst = append(dst, payload[:4]...)
+	dst = append(dst, 0, 1, byte(len(records[0])>>8), byte(len(records[0])), byte(len(records[1])>>8), byte(len(records[1])), 0, 0)
+	// AA = 1, TC = 0
+	dst[header+2] = dst[header+2]&^0b00000010 | 0b00000100
+	dst[header+3] = dst[header+3]&0xf0 | byte(rcode)
+	dst = append(dst, w.question...)
+	question := len(dst)
+	for _, section := range records {
+		for _, rr := range section {
+			dst = appendRR(dst, rr)
+		}
+	}
+	arcount := len(records[2])
+
+	// the OPT record of response, or a new one with the DO bit
+	if offset := optOffset(payload); offset >= 0 {
+		end := skipRecord(payload, offset)
+		dst = append(dst, payload[offset:end]...)
+		dst[len(dst)-(end-offset)+7] |= 0x80
+	} else {
+		dst = AppendOPTRecord(dst, OPT{UDPSize: 1232, Flags: 0x8000})
+	}
+	arcount++
+	dst[header+10], dst[header+11] = byte(arcount>>8), byte(arcount)
+
+	size := 512
+	if w.udpsize > 512 {
+		size = int(w.udpsize)
+	}
+	if !w.tcp && len(dst)-header > size {
+		// truncated, let the client retry over TCP
+		dst = AppendOPTRecord(dst[:question], OPT{UDPSize: 1232, Flags: 0x8000})
+		dst[header+2] |= 0b00000010
+		dst[header+6], dst[header+7], dst[header+8], dst[header+9], dst[header+10], dst[header+11] = 0, 0, 0, 0, 0, 1
+	}
+
+	return dst, nil
+}
+
+// dnssecResponseWriter signs the responses written to it.
+type dnssecResponseWriter struct {
+	ResponseWriter
+	signer   *DNSSECSigner
+	zone     string
+	name     string
+	question []byte
+	udpsize  uint16
+	co       bool
+	tcp      bool
+	buf      []byte
+}
+
+var dnssecResponseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return new(dnssecResponseWriter)
+	},
+}
+
+// Unwrap returns the wrapped ResponseWriter.
+func (rw *dnssecResponseWriter) Unwrap() ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *dnssecResponseWriter) Write(p []byte) (int, error) {
+	if len(p) < 12 || (Rcode(p[3]&0x0f) != RcodeNoError && Rcode(p[3]&0x0f) != RcodeNXDomain) {
+		return rw.ResponseWriter.Write(p)
+	}
+
+	buf, err := rw.signer.sign(rw.buf[:0], rw, p)
+	if err != nil {
+		// the malformed responses of handlers are replied as SERVFAIL
+		rw.buf = append(rw.buf[:0], p[:12]...)
+		rw.buf[3] = rw.buf[3]&0xf0 | byte(RcodeServFail)
+		rw.buf[4], rw.buf[5], rw.buf[6], rw.buf[7], rw.buf[8], rw.buf[9], rw.buf[10], rw.buf[11] = 0, 0, 0, 0, 0, 0, 0, 0
+		if _, err := rw.ResponseWriter.Write(rw.buf); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	rw.buf = buf
+
+	if _, err := rw.ResponseWriter.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,146 @@
+package fastdns
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func mockSignerQuery(t *testing.T, handler Handler, domain string, typ Type, flags uint16) (*Message, []recursorRR, []recursorRR) {
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion(domain, typ, ClassINET)
+	if flags != 0 {
+		req.Raw = AppendOPTRecord(req.Raw, OPT{UDPSize: 1232, Flags: flags})
+		req.Raw[11] = 1
+		req.Header.ARCount = 1
+	}
+
+	rw := &MemResponseWriter{Raddr: netip.MustParseAddrPort("192.0.2.1:53")}
+	handler.ServeDNS(rw, req)
+
+	resp := AcquireMessage()
+	if err := ParseMessage(resp, rw.Data, true); err != nil {
+		t.Fatalf("ParseMessage(%s %s) error: %+v data=%x", domain, typ, err, rw.Data)
+	}
+	answers, authority, _ := parseRRs(resp)
+	return resp, answers, authority
+}
+
+func TestDNSSECSigningMiddleware(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer := &DNSSECSigner{Zone: "example.org", PrivateKey: priv}
+	key, err := signer.DNSKEY()
+	if err != nil || key.Algorithm != AlgorithmED25519 || key.Flags != 257 {
+		t.Fatalf("DNSSECSigner.DNSKEY() return %+v %+v", key, err)
+	}
+	keys := []DNSKEY{key}
+
+	handler := Chain(HandlerFunc(func(rw ResponseWriter, req *Message) {
+		switch string(req.Domain) {
+		case "www.example.org", "example.org":
+			if req.Question.Type == TypeA {
+				HOST(rw, req, 300, []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("2.2.2.2")})
+				return
+			}
+			req.SetResponseHeader(RcodeNoError, 0)
+			_, _ = rw.Write(req.Raw)
+		case "other.com":
+			HOST(rw, req, 300, []netip.Addr{netip.MustParseAddr("3.3.3.3")})
+		default:
+			Error(rw, req, RcodeNXDomain)
+		}
+	}), DNSSECSigningMiddleware(signer))
+
+	now := time.Now()
+
+	// DNSKEY of apex
+	resp, answers, _ := mockSignerQuery(t, handler, "example.org", TypeDNSKEY, 0x8000)
+	if dnskeys := rrset(answers, "example.org", TypeDNSKEY); len(dnskeys) != 1 || resp.Header.Flags.AA() == 0 {
+		t.Fatalf("DNSKEY query return %+v", answers)
+	} else if _, err := verifyRRset(dnskeys, answers, keys, "example.org", now); err != nil {
+		t.Errorf("verify DNSKEY error: %+v", err)
+	}
+
+	// signed answers
+	resp, answers, _ = mockSignerQuery(t, handler, "www.example.org", TypeA, 0x8000)
+	if a := rrset(answers, "www.example.org", TypeA); len(a) != 2 {
+		t.Fatalf("A query return %+v", answers)
+	} else if _, err := verifyRRset(a, answers, keys, "example.org", now); err != nil {
+		t.Errorf("verify A error: %+v", err)
+	}
+	if opt, ok := resp.OPT(); !ok || opt.Flags&0x8000 == 0 {
+		t.Errorf("A query shall reply OPT with DO bit, got %+v %v", opt, ok)
+	}
+
+	// the signature is cached
+	_, cached, _ := mockSignerQuery(t, handler, "www.example.org", TypeA, 0x8000)
+	if sig1, sig2 := rrset(answers, "www.example.org", TypeRRSIG), rrset(cached, "www.example.org", TypeRRSIG); len(sig1) != 1 || len(sig2) != 1 || string(sig1[0].Data) != string(sig2[0].Data) {
+		t.Errorf("A query shall reuse the cached signature, got %+v %+v", sig1, sig2)
+	}
+
+	// NODATA
+	resp, answers, authority := mockSignerQuery(t, handler, "www.example.org", TypeAAAA, 0x8000)
+	if len(answers) != 0 || resp.Header.Flags.Rcode() != RcodeNoError || len(rrset(authority, "example.org", TypeSOA)) != 1 {
+		t.Fatalf("AAAA query return %s %+v %+v", resp.Header.Flags.Rcode(), answers, authority)
+	}
+	if _, err := verifyDenial(authority, keys, "example.org", "www.example.org", TypeAAAA, false, now); err != nil {
+		t.Errorf("verify NODATA error: %+v", err)
+	}
+	if nsec, _ := ParseNSEC(rrset(authority, "www.example.org", TypeNSEC)[0].Data); nsec.NextDomain != "\x00.www.example.org" || hasType(nsec.Types, TypeNXNAME) {
+		t.Errorf("NODATA shall reply compact NSEC, got %+v", nsec)
+	}
+
+	// NXDOMAIN is replied as NODATA with NXNAME
+	resp, answers, authority = mockSignerQuery(t, handler, "none.example.org", TypeA, 0x8000)
+	if len(answers) != 0 || resp.Header.Flags.Rcode() != RcodeNoError || len(rrset(authority, "example.org", TypeSOA)) != 1 {
+		t.Fatalf("NXDOMAIN query return %s %+v %+v", resp.Header.Flags.Rcode(), answers, authority)
+	}
+	if _, err := verifyDenial(authority, keys, "example.org", "none.example.org", TypeA, false, now); err != nil {
+		t.Errorf("verify NXDOMAIN error: %+v", err)
+	}
+	if nsec, _ := ParseNSEC(rrset(authority, "none.example.org", TypeNSEC)[0].Data); !hasType(nsec.Types, TypeNXNAME) || hasType(nsec.Types, TypeA) {
+		t.Errorf("NXDOMAIN shall reply NSEC with NXNAME, got %+v", nsec)
+	}
+
+	// NXDOMAIN with Compact Answers OK flag
+	resp, _, _ = mockSignerQuery(t, handler, "none.example.org", TypeA, 0x8000|0x4000)
+	if resp.Header.Flags.Rcode() != RcodeNXDomain {
+		t.Errorf("NXDOMAIN query with CO flag return %s", resp.Header.Flags.Rcode())
+	}
+
+	// unsigned without DO bit or out of zone
+	if _, answers, _ = mockSignerQuery(t, handler, "www.example.org", TypeA, 0); len(answers) != 2 {
+		t.Errorf("A query without DO bit return %+v", answers)
+	}
+	if _, answers, _ = mockSignerQuery(t, handler, "other.com", TypeA, 0x8000); len(answers) != 1 {
+		t.Errorf("out of zone query return %+v", answers)
+	}
+}
+
+func TestDNSSECSigningTruncated(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer := &DNSSECSigner{Zone: "example.org", PrivateKey: priv}
+
+	handler := Chain(HandlerFunc(func(rw ResponseWriter, req *Message) {
+		ips := make([]netip.Addr, 40)
+		for i := range ips {
+			ips[i] = netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})
+		}
+		HOST(rw, req, 300, ips)
+	}), DNSSECSigningMiddleware(signer))
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	req.SetEDNS(512, true)
+
+	rw := &MemResponseWriter{}
+	handler.ServeDNS(rw, req)
+
+	if len(rw.Data) > 512 || rw.Data[2]&0b00000010 == 0 || rw.Data[7] != 0 {
+		t.Errorf("DNSSECSigningMiddleware shall truncate the large response, data=%x", rw.Data)
+	}
+}
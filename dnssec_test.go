@@ -0,0 +1,191 @@
+package fastdns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// mockKey generates the DNSSEC zone key of algorithm.
+func mockKey(t *testing.T, alg DNSSECAlgorithm) (DNSKEY, crypto.Signer) {
+	var priv crypto.Signer
+	var err error
+	switch alg {
+	case AlgorithmECDSAP256SHA256:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgorithmECDSAP384SHA384:
+		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case AlgorithmED25519:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		priv, err = rsa.GenerateKey(rand.Reader, 1024)
+	}
+	if err != nil {
+		t.Fatalf("generate %s key error: %+v", alg, err)
+	}
+
+	key, err := NewDNSKEY(257, priv.Public())
+	if err != nil {
+		t.Fatalf("NewDNSKEY(%s) error: %+v", alg, err)
+	}
+	// RSASHA512 shares the key format with RSASHA256
+	key.Algorithm = alg
+
+	return key, priv
+}
+
+func TestDNSKEYKeyTag(t *testing.T) {
+	// RFC 4034 Section 5.4
+	data, _ := base64.StdEncoding.DecodeString("AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvxegXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw==")
+	key := DNSKEY{Flags: 256, Protocol: 3, Algorithm: AlgorithmRSASHA1, PublicKey: data}
+
+	if tag := key.KeyTag(); tag != 60485 {
+		t.Errorf("DNSKEY.KeyTag() return %d, expect 60485", tag)
+	}
+
+	ds, err := key.DS("DSKEY.example.com", DigestSHA1)
+	if err != nil || ds.KeyTag != 60485 || hex.EncodeToString(ds.Digest) != "2bb183af5f22588179a53b0a98631fad1a292118" {
+		t.Errorf("DNSKEY.DS() return %+v %x %+v", ds, ds.Digest, err)
+	}
+
+	if got, err := ParseDNSKEY(AppendDNSKEY(nil, key)); err != nil || !reflect.DeepEqual(got, key) {
+		t.Errorf("ParseDNSKEY() return %+v %+v", got, err)
+	}
+	if got, err := ParseDS(AppendDS(nil, ds)); err != nil || !reflect.DeepEqual(got, ds) {
+		t.Errorf("ParseDS() return %+v %+v", got, err)
+	}
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	// RFC 5155 Appendix A
+	salt, _ := hex.DecodeString("aabbccdd")
+	cases := []struct {
+		Name string
+		Hash string
+	}{
+		{"example", "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"},
+		{"a.example", "35mthgpgcu1qg68fab165klnsnk3dpvl"},
+		{"ns1.example", "2t7b4g4vsa5smi47k61mv5bv1a22bojr"},
+		{"*.w.example", "r53bq7cc2uvmubfu5ocmm6pers9tk9en"},
+		{"x.y.w.EXAMPLE", "2vptu5timamqttgl4luu9kg21e0aor3s"},
+	}
+
+	for _, c := range cases {
+		if hash := nsec3Label(nsec3Hash(c.Name, salt, 12)); hash != c.Hash {
+			t.Errorf("nsec3Hash(%#v) return %s, expect %s", c.Name, hash, c.Hash)
+		}
+	}
+}
+
+func TestNSECRecords(t *testing.T) {
+	nsec := NSEC{NextDomain: "host.example.com", Types: []Type{TypeA, TypeMX, TypeRRSIG, TypeNSEC, Type(1234)}}
+	data := AppendNSEC(nil, nsec)
+	// RFC 4034 Section 4.3
+	if want := "04686f7374076578616d706c6503636f6d000006400100000003041b000000000000000000000000000000000000000000000000000020"; hex.EncodeToString(data) != want {
+		t.Errorf("AppendNSEC() return %x, expect %s", data, want)
+	}
+	if got, err := ParseNSEC(data); err != nil || !reflect.DeepEqual(got, nsec) {
+		t.Errorf("ParseNSEC() return %+v %+v", got, err)
+	}
+
+	nsec3 := NSEC3{HashAlgorithm: 1, Flags: 1, Iterations: 12, Salt: []byte{0xaa, 0xbb}, NextHashed: []byte{1, 2, 3}, Types: []Type{TypeNS, TypeDS, TypeRRSIG}}
+	if got, err := ParseNSEC3(AppendNSEC3(nil, nsec3)); err != nil || !reflect.DeepEqual(got, nsec3) {
+		t.Errorf("ParseNSEC3() return %+v %+v", got, err)
+	}
+	if _, err := ParseNSEC3([]byte{1, 0, 0, 12, 4, 0xaa}); err != ErrInvalidDNSSECRecord {
+		t.Errorf("ParseNSEC3() shall return ErrInvalidDNSSECRecord, got %+v", err)
+	}
+
+	// the maximum lengths of salt and hash
+	nsec3 = NSEC3{HashAlgorithm: 1, Salt: bytes.Repeat([]byte{0xaa}, 255), NextHashed: bytes.Repeat([]byte{0xbb}, 255), Types: []Type{TypeA}}
+	if got, err := ParseNSEC3(AppendNSEC3(nil, nsec3)); err != nil || !reflect.DeepEqual(got, nsec3) {
+		t.Errorf("ParseNSEC3() of maximum lengths return %+v %+v", got, err)
+	}
+	if _, err := ParseNSEC3(AppendNSEC3(nil, nsec3)[:5+255+1+200]); err != ErrInvalidDNSSECRecord {
+		t.Errorf("ParseNSEC3() of truncated hash shall return ErrInvalidDNSSECRecord, got %+v", err)
+	}
+}
+
+func TestCompareNames(t *testing.T) {
+	// RFC 4034 Section 6.1
+	names := []string{"example", "a.example", "yljkjljk.a.example", "z.a.example", "zabc.a.example", "z.example", "*.z.example"}
+	shuffled := []string{"z.example", "zabc.a.example", "example", "*.z.example", "a.example", "z.a.example", "yljkjljk.a.example"}
+
+	sort.Slice(shuffled, func(i, j int) bool { return compareNames(shuffled[i], shuffled[j]) < 0 })
+	if !reflect.DeepEqual(shuffled, names) {
+		t.Errorf("compareNames sort %v, expect %v", shuffled, names)
+	}
+
+	if !covers("a.example", "z.example", "b.example") || covers("a.example", "z.example", "z.example") || !covers("z.example", "example", "zz.example") {
+		t.Errorf("covers return wrong result")
+	}
+}
+
+func TestSignRRset(t *testing.T) {
+	now := time.Now()
+	for _, alg := range []DNSSECAlgorithm{AlgorithmRSASHA256, AlgorithmRSASHA512, AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384, AlgorithmED25519} {
+		key, priv := mockKey(t, alg)
+		rrs := []recursorRR{
+			mockRR("www.example.org", TypeA, "1.1.1.1"),
+			mockRR("www.example.org", TypeA, "2.2.2.2"),
+		}
+
+		rr, err := signRRset(rrs, "example.org", key, priv, now.Add(-time.Hour), now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("signRRset(%s) error: %+v", alg, err)
+		}
+		sig, err := ParseRRSIG(rr.Data)
+		if err != nil || sig.SignerName != "example.org" || sig.Labels != 3 || sig.TypeCovered != TypeA {
+			t.Fatalf("ParseRRSIG(%s) return %+v %+v", alg, sig, err)
+		}
+
+		// the canonical form is independent of the order and the case
+		rrs[0], rrs[1] = rrs[1], rrs[0]
+		rrs[0].Name = "WWW.Example.ORG"
+		if err := verifyRRSIG(rrs, sig, key, now); err != nil {
+			t.Errorf("verifyRRSIG(%s) error: %+v", alg, err)
+		}
+
+		// the signature is bound to the owner name
+		expanded := []recursorRR{rrs[0], rrs[1]}
+		expanded[0].Name, expanded[1].Name = "x.www.example.org", "x.www.example.org"
+		if err := verifyRRSIG(expanded, sig, key, now); err != ErrBogusSignature {
+			t.Errorf("verifyRRSIG(%s) of other owner shall return ErrBogusSignature, got %+v", alg, err)
+		}
+
+		rrs[1].Data = []byte{3, 3, 3, 3}
+		if err := verifyRRSIG(rrs, sig, key, now); err != ErrBogusSignature {
+			t.Errorf("verifyRRSIG(%s) of tampered data shall return ErrBogusSignature, got %+v", alg, err)
+		}
+		if err := verifyRRSIG(rrs[:1], sig, key, now.Add(2*time.Hour)); err != ErrBogusSignature {
+			t.Errorf("verifyRRSIG(%s) of expired signature shall return ErrBogusSignature, got %+v", alg, err)
+		}
+	}
+}
+
+func TestSignWildcard(t *testing.T) {
+	now := time.Now()
+	key, priv := mockKey(t, AlgorithmED25519)
+
+	rr, err := signRRset([]recursorRR{mockRR("*.example.org", TypeA, "1.1.1.1")}, "example.org", key, priv, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("signRRset error: %+v", err)
+	}
+	sig, _ := ParseRRSIG(rr.Data)
+	if sig.Labels != 2 {
+		t.Errorf("signRRset of wildcard return labels %d, expect 2", sig.Labels)
+	}
+	if err := verifyRRSIG([]recursorRR{mockRR("a.b.example.org", TypeA, "1.1.1.1")}, sig, key, now); err != nil {
+		t.Errorf("verifyRRSIG of wildcard expansion error: %+v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package fastdns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+)
+
+var (
+	// ErrInvalidClientSubnet is returned when dns client subnet option is malformed.
+	ErrInvalidClientSubnet = errors.New("dns client subnet option is malformed")
+)
+
+// ClientSubnet represents the EDNS Client Subnet option, see RFC 7871.
+//
+//	+0 (MSB)                            +1 (LSB)
+//	+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//	|                            FAMILY                             |
+//	+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//	|     SOURCE PREFIX-LENGTH      |     SCOPE PREFIX-LENGTH       |
+//	+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//	|                           ADDRESS...                          /
+//	+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+type ClientSubnet struct {
+	// Prefix is the client network, the bits of Prefix is SOURCE PREFIX-LENGTH.
+	Prefix netip.Prefix
+
+	// Scope is SCOPE PREFIX-LENGTH set by servers, which covers the network the response is tailored for.
+	Scope uint8
+}
+
+// ScopePrefix returns the network covered by the response, which shall be used as the
+// cache key of the response, a zero scope means the response is suitable for all clients.
+func (ecs ClientSubnet) ScopePrefix() netip.Prefix {
+	bits := int(ecs.Scope)
+	if bits > ecs.Prefix.Bits() {
+		bits = ecs.Prefix.Bits()
+	}
+	prefix, _ := ecs.Prefix.Addr().Prefix(bits)
+	return prefix
+}
+
+// ParseClientSubnet parses the data of EDNS Client Subnet option.
+func ParseClientSubnet(data []byte) (ecs ClientSubnet, err error) {
+	if len(data) < 4 {
+		return ecs, ErrInvalidClientSubnet
+	}
+
+	family := uint16(data[0])<<8 | uint16(data[1])
+	source, scope := int(data[2]), data[3]
+	address := data[4:]
+	if len(address) != (source+7)/8 {
+		return ecs, ErrInvalidClientSubnet
+	}
+
+	var addr netip.Addr
+	switch family {
+	case 1:
+		var ip [4]byte
+		if source > 32 || scope > 32 {
+			return ecs, ErrInvalidClientSubnet
+		}
+		copy(ip[:], address)
+		addr = netip.AddrFrom4(ip)
+	case 2:
+		var ip [16]byte
+		if source > 128 || scope > 128 {
+			return ecs, ErrInvalidClientSubnet
+		}
+		copy(ip[:], address)
+		addr = netip.AddrFrom16(ip)
+	default:
+		return ecs, ErrInvalidClientSubnet
+	}
+
+	ecs.Prefix, _ = addr.Prefix(source)
+	ecs.Scope = scope
+
+	return ecs, nil
+}
+
+// AppendClientSubnet appends the data of EDNS Client Subnet option to dst and returns the resulting dst.
+func AppendClientSubnet(dst []byte, ecs ClientSubnet) []byte {
+	addr := ecs.Prefix.Addr().Unmap()
+	bits := ecs.Prefix.Bits()
+
+	if bits < 0 {
+		bits = 0
+	}
+
+	var family uint16 = 2
+	if addr.Is4() {
+		family = 1
+		if bits > 32 {
+			bits -= 96
+		}
+	}
+	prefix, _ := addr.Prefix(bits)
+
+	dst = append(dst, byte(family>>8), byte(family), byte(bits), ecs.Scope)
+	// ADDRESS, truncated to the bits of SOURCE PREFIX-LENGTH
+	ip := prefix.Addr().AsSlice()
+	dst = append(dst, ip[:(bits+7)/8]...)
+
+	return dst
+}
+
+// ClientSubnet returns the EDNS Client Subnet option of msg.
+func (msg *Message) ClientSubnet() (ecs ClientSubnet, ok bool) {
+	opt, ok := msg.OPT()
+	if !ok {
+		return
+	}
+	data, ok := opt.Option(EDNSOptionClientSubnet)
+	if !ok {
+		return
+	}
+	ecs, err := ParseClientSubnet(data)
+	return ecs, err == nil
+}
+
+// ClientSubnetMiddleware echoes the EDNS Client Subnet option of requests in the responses,
+// the handlers could read it by req.ClientSubnet() and set the scope by SetClientSubnetScope.
+// The requests with malformed option are replied FORMERR.
+func ClientSubnetMiddleware() Middleware {
+	return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+		opt, ok := req.OPT()
+		if !ok {
+			next.ServeDNSContext(ctx, rw, req)
+			return
+		}
+		data, ok := opt.Option(EDNSOptionClientSubnet)
+		if !ok {
+			next.ServeDNSContext(ctx, rw, req)
+			return
+		}
+
+		// SCOPE PREFIX-LENGTH must be zero in queries
+		ecs, err := ParseClientSubnet(data)
+		if err != nil || ecs.Scope != 0 {
+			Error(rw, req, RcodeFormErr)
+			return
+		}
+
+		w := clientSubnetResponseWriterPool.Get().(*clientSubnetResponseWriter)
+		w.ResponseWriter, w.ecs = rw, ecs
+		next.ServeDNSContext(ctx, w, req)
+		w.ResponseWriter = nil
+		clientSubnetResponseWriterPool.Put(w)
+	})
+}
+
+// SetClientSubnetScope sets SCOPE PREFIX-LENGTH of the EDNS Client Subnet option in the response to rw,
+// It returns false if the request has no option or rw is not wrapped by ClientSubnetMiddleware.
+func SetClientSubnetScope(rw ResponseWriter, scope uint8) bool {
+	for {
+		if w, ok := rw.(*clientSubnetResponseWriter); ok {
+			w.ecs.Scope = scope
+			return true
+		}
+		u, ok := rw.(interface{ Unwrap() ResponseWriter })
+		if !ok {
+			return false
+		}
+		rw = u.Unwrap()
+	}
+}
+
+// clientSubnetResponseWriter adds the EDNS Client Subnet option to the responses.
+type clientSubnetResponseWriter struct {
+	ResponseWriter
+	ecs ClientSubnet
+	buf []byte
+}
+
+var clientSubnetResponseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return new(clientSubnetResponseWriter)
+	},
+}
+
+// Unwrap returns the wrapped ResponseWriter.
+func (rw *clientSubnetResponseWriter) Unwrap() ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *clientSubnetResponseWriter) Write(p []byte) (int, error) {
+	if len(p) < 12 {
+		return rw.ResponseWriter.Write(p)
+	}
+	var data [4 + 16]byte
+	rw.buf = appendEDNSOption(rw.buf[:0], p, EDNSOptionClientSubnet, AppendClientSubnet(data[:0], rw.ecs))
+	if _, err := rw.ResponseWriter.Write(rw.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
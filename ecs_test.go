@@ -0,0 +1,145 @@
+package fastdns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientSubnet(t *testing.T) {
+	var cases = []struct {
+		ClientSubnet ClientSubnet
+		Data         string
+	}{
+		{ClientSubnet{netip.MustParsePrefix("192.0.2.0/24"), 0}, "00011800c00002"},
+		{ClientSubnet{netip.MustParsePrefix("192.0.2.128/25"), 16}, "00011910c0000280"},
+		{ClientSubnet{netip.MustParsePrefix("2001:db8::/56"), 0}, "0002380020010db8000000"},
+		{ClientSubnet{netip.MustParsePrefix("0.0.0.0/0"), 0}, "00010000"},
+	}
+
+	for _, c := range cases {
+		data := AppendClientSubnet(nil, c.ClientSubnet)
+		if got := hex.EncodeToString(data); got != c.Data {
+			t.Errorf("AppendClientSubnet(%+v) got=%s want=%s", c.ClientSubnet, got, c.Data)
+		}
+		ecs, err := ParseClientSubnet(data)
+		if err != nil || ecs != c.ClientSubnet {
+			t.Errorf("ParseClientSubnet(%s) got=%+v error=%+v want=%+v", c.Data, ecs, err, c.ClientSubnet)
+		}
+	}
+
+	for _, s := range []string{"0001", "00011800c000", "0003080001", "0001210000000000000000"} {
+		data, _ := hex.DecodeString(s)
+		if _, err := ParseClientSubnet(data); err != ErrInvalidClientSubnet {
+			t.Errorf("ParseClientSubnet(%s) shall return ErrInvalidClientSubnet, got %+v", s, err)
+		}
+	}
+
+	ecs := ClientSubnet{netip.MustParsePrefix("192.0.2.0/24"), 16}
+	if prefix := ecs.ScopePrefix(); prefix != netip.MustParsePrefix("192.0.0.0/16") {
+		t.Errorf("ScopePrefix got=%s", prefix)
+	}
+	ecs.Scope = 32
+	if prefix := ecs.ScopePrefix(); prefix != netip.MustParsePrefix("192.0.2.0/24") {
+		t.Errorf("ScopePrefix shall be limited by source prefix, got=%s", prefix)
+	}
+}
+
+func TestClientSubnetMiddleware(t *testing.T) {
+	handler := Chain(HandlerFunc(func(rw ResponseWriter, req *Message) {
+		if ecs, ok := req.ClientSubnet(); ok {
+			SetClientSubnetScope(rw, uint8(ecs.Prefix.Bits()))
+		}
+		HOST1(rw, req, 300, netip.AddrFrom4([4]byte{1, 1, 1, 1}))
+	}), ClientSubnetMiddleware(), RRLMiddleware(&RRL{}))
+
+	ecs := ClientSubnet{Prefix: netip.MustParsePrefix("198.51.100.0/24")}
+
+	req := mockEDNSMessage(AppendEDNSOption(nil, EDNSOptionClientSubnet, AppendClientSubnet(nil, ecs)))
+	_ = ParseMessage(req, req.Raw, false)
+	rw := &MemResponseWriter{}
+	handler.ServeDNS(rw, req)
+	ReleaseMessage(req)
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+	if err := ParseMessage(resp, rw.Data, true); err != nil || resp.Header.ANCount != 1 {
+		t.Fatalf("ClientSubnetMiddleware response error: %+v raw=%x", err, rw.Data)
+	}
+	if got, ok := resp.ClientSubnet(); !ok || got.Prefix != ecs.Prefix || got.Scope != 24 {
+		t.Errorf("ClientSubnetMiddleware shall echo the option with scope, got=%+v", got)
+	}
+
+	// non-zero scope in query
+	ecs.Scope = 8
+	req = mockEDNSMessage(AppendEDNSOption(nil, EDNSOptionClientSubnet, AppendClientSubnet(nil, ecs)))
+	_ = ParseMessage(req, req.Raw, false)
+	rw = &MemResponseWriter{}
+	handler.ServeDNS(rw, req)
+	ReleaseMessage(req)
+	if len(rw.Data) < 4 || Rcode(rw.Data[3]&0x0f) != RcodeFormErr {
+		t.Errorf("ClientSubnetMiddleware shall reply FORMERR, got=%x", rw.Data)
+	}
+
+	if SetClientSubnetScope(&MemResponseWriter{}, 24) {
+		t.Errorf("SetClientSubnetScope shall return false for plain ResponseWriter")
+	}
+}
+
+func TestClientClientSubnet(t *testing.T) {
+	received := make(chan ClientSubnet, 2)
+
+	s := &Server{
+		Handler: Chain(HandlerFunc(func(rw ResponseWriter, req *Message) {
+			ecs, _ := req.ClientSubnet()
+			received <- ecs
+			HOST1(rw, req, 300, netip.AddrFrom4([4]byte{1, 1, 1, 1}))
+		}), ClientSubnetMiddleware()),
+		ErrorLog: log.Default(),
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		_ = s.Serve(conn)
+	}()
+
+	client := &Client{
+		AddrPort:     conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		ReadTimeout:  time.Second,
+		ClientSubnet: netip.MustParsePrefix("192.0.2.0/24"),
+	}
+
+	// adds the option of client
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if err := client.Exchange(req, resp); err != nil {
+		t.Fatalf("client exchange error: %+v", err)
+	}
+	if ecs := <-received; ecs.Prefix != client.ClientSubnet {
+		t.Errorf("client shall add the option, got %+v", ecs)
+	}
+	if bytes.Contains(req.Raw, []byte{0, byte(EDNSOptionClientSubnet)}) {
+		t.Errorf("client shall not modify the request, got %x", req.Raw)
+	}
+
+	// forwards the option of request
+	forwarded := ClientSubnet{Prefix: netip.MustParsePrefix("2001:db8::/56")}
+	req.AddEDNSOption(EDNSOptionClientSubnet, AppendClientSubnet(nil, forwarded))
+	if err := client.Exchange(req, resp); err != nil {
+		t.Fatalf("client exchange error: %+v", err)
+	}
+	if ecs := <-received; ecs.Prefix != forwarded.Prefix {
+		t.Errorf("client shall forward the option, got %+v", ecs)
+	}
+}
@@ -0,0 +1,193 @@
+package fastdns
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrInvalidExtendedError is returned when dns extended error option is malformed.
+	ErrInvalidExtendedError = errors.New("dns extended error option is malformed")
+)
+
+// ExtendedErrorCode is the INFO-CODE of Extended DNS Errors, see RFC 8914.
+type ExtendedErrorCode uint16
+
+// Extended DNS Error codes.
+const (
+	ExtendedErrorOther                      ExtendedErrorCode = 0
+	ExtendedErrorUnsupportedDNSKEYAlgorithm ExtendedErrorCode = 1
+	ExtendedErrorUnsupportedDSDigestType    ExtendedErrorCode = 2
+	ExtendedErrorStaleAnswer                ExtendedErrorCode = 3
+	ExtendedErrorForgedAnswer               ExtendedErrorCode = 4
+	ExtendedErrorDNSSECIndeterminate        ExtendedErrorCode = 5
+	ExtendedErrorDNSSECBogus                ExtendedErrorCode = 6
+	ExtendedErrorSignatureExpired           ExtendedErrorCode = 7
+	ExtendedErrorSignatureNotYetValid       ExtendedErrorCode = 8
+	ExtendedErrorDNSKEYMissing              ExtendedErrorCode = 9
+	ExtendedErrorRRSIGsMissing              ExtendedErrorCode = 10
+	ExtendedErrorNoZoneKeyBitSet            ExtendedErrorCode = 11
+	ExtendedErrorNSECMissing                ExtendedErrorCode = 12
+	ExtendedErrorCachedError                ExtendedErrorCode = 13
+	ExtendedErrorNotReady                   ExtendedErrorCode = 14
+	ExtendedErrorBlocked                    ExtendedErrorCode = 15
+	ExtendedErrorCensored                   ExtendedErrorCode = 16
+	ExtendedErrorFiltered                   ExtendedErrorCode = 17
+	ExtendedErrorProhibited                 ExtendedErrorCode = 18
+	ExtendedErrorStaleNXDomainAnswer        ExtendedErrorCode = 19
+	ExtendedErrorNotAuthoritative           ExtendedErrorCode = 20
+	ExtendedErrorNotSupported               ExtendedErrorCode = 21
+	ExtendedErrorNoReachableAuthority       ExtendedErrorCode = 22
+	ExtendedErrorNetworkError               ExtendedErrorCode = 23
+	ExtendedErrorInvalidData                ExtendedErrorCode = 24
+)
+
+func (c ExtendedErrorCode) String() string {
+	switch c {
+	case ExtendedErrorOther:
+		return "Other"
+	case ExtendedErrorUnsupportedDNSKEYAlgorithm:
+		return "Unsupported DNSKEY Algorithm"
+	case ExtendedErrorUnsupportedDSDigestType:
+		return "Unsupported DS Digest Type"
+	case ExtendedErrorStaleAnswer:
+		return "Stale Answer"
+	case ExtendedErrorForgedAnswer:
+		return "Forged Answer"
+	case ExtendedErrorDNSSECIndeterminate:
+		return "DNSSEC Indeterminate"
+	case ExtendedErrorDNSSECBogus:
+		return "DNSSEC Bogus"
+	case ExtendedErrorSignatureExpired:
+		return "Signature Expired"
+	case ExtendedErrorSignatureNotYetValid:
+		return "Signature Not Yet Valid"
+	case ExtendedErrorDNSKEYMissing:
+		return "DNSKEY Missing"
+	case ExtendedErrorRRSIGsMissing:
+		return "RRSIGs Missing"
+	case ExtendedErrorNoZoneKeyBitSet:
+		return "No Zone Key Bit Set"
+	case ExtendedErrorNSECMissing:
+		return "NSEC Missing"
+	case ExtendedErrorCachedError:
+		return "Cached Error"
+	case ExtendedErrorNotReady:
+		return "Not Ready"
+	case ExtendedErrorBlocked:
+		return "Blocked"
+	case ExtendedErrorCensored:
+		return "Censored"
+	case ExtendedErrorFiltered:
+		return "Filtered"
+	case ExtendedErrorProhibited:
+		return "Prohibited"
+	case ExtendedErrorStaleNXDomainAnswer:
+		return "Stale NXDOMAIN Answer"
+	case ExtendedErrorNotAuthoritative:
+		return "Not Authoritative"
+	case ExtendedErrorNotSupported:
+		return "Not Supported"
+	case ExtendedErrorNoReachableAuthority:
+		return "No Reachable Authority"
+	case ExtendedErrorNetworkError:
+		return "Network Error"
+	case ExtendedErrorInvalidData:
+		return "Invalid Data"
+	}
+	return strconv.Itoa(int(c))
+}
+
+// ExtendedError represents the Extended DNS Error option, see RFC 8914.
+//
+//	                                             1   1   1   1   1   1
+//	     0   1   2   3   4   5   6   7   8   9   0   1   2   3   4   5
+//	   +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//	0: |                            INFO-CODE                          |
+//	   +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//	2: / EXTRA-TEXT ...                                                /
+//	   +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+type ExtendedError struct {
+	// Code is the INFO-CODE.
+	Code ExtendedErrorCode
+
+	// Text is the optional EXTRA-TEXT in UTF-8.
+	Text string
+}
+
+// ParseExtendedError parses the data of Extended DNS Error option.
+func ParseExtendedError(data []byte) (ede ExtendedError, err error) {
+	if len(data) < 2 {
+		return ede, ErrInvalidExtendedError
+	}
+	ede.Code = ExtendedErrorCode(data[0])<<8 | ExtendedErrorCode(data[1])
+	ede.Text = string(data[2:])
+	return ede, nil
+}
+
+// AppendExtendedError appends the data of Extended DNS Error option to dst and returns the resulting dst.
+func AppendExtendedError(dst []byte, code ExtendedErrorCode, text string) []byte {
+	dst = append(dst, byte(code>>8), byte(code))
+	dst = append(dst, text...)
+	return dst
+}
+
+// ExtendedErrors returns the Extended DNS Error options of msg.
+func (msg *Message) ExtendedErrors() (edes []ExtendedError) {
+	opt, ok := msg.OPT()
+	if !ok {
+		return
+	}
+	opt.Walk(func(code EDNSOption, data []byte) bool {
+		if code == EDNSOptionExtendedError {
+			if ede, err := ParseExtendedError(data); err == nil {
+				edes = append(edes, ede)
+			}
+		}
+		return true
+	})
+	return
+}
+
+// ErrorWithExtendedError replies to the request with the specified Rcode and Extended DNS Error.
+func ErrorWithExtendedError(rw ResponseWriter, req *Message, rcode Rcode, code ExtendedErrorCode, text string) {
+	Error(WithExtendedError(rw, req, code, text), req, rcode)
+}
+
+// WithExtendedError returns a ResponseWriter adds the Extended DNS Error to the response
+// written to rw, which could be used with any response helpers, e.g.
+//
+//	fastdns.HOST(fastdns.WithExtendedError(rw, req, fastdns.ExtendedErrorStaleAnswer, ""), req, 60, ips)
+//
+// The option is added only if req has an OPT record, so it must be called before the
+// response is written into req.
+func WithExtendedError(rw ResponseWriter, req *Message, code ExtendedErrorCode, text string) ResponseWriter {
+	if _, ok := req.OPT(); !ok {
+		return rw
+	}
+	return &extendedErrorResponseWriter{
+		ResponseWriter: rw,
+		data:           AppendExtendedError(nil, code, text),
+	}
+}
+
+// extendedErrorResponseWriter adds the Extended DNS Error option to the responses.
+type extendedErrorResponseWriter struct {
+	ResponseWriter
+	data []byte
+}
+
+// Unwrap returns the wrapped ResponseWriter.
+func (rw *extendedErrorResponseWriter) Unwrap() ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *extendedErrorResponseWriter) Write(p []byte) (int, error) {
+	if len(p) < 12 {
+		return rw.ResponseWriter.Write(p)
+	}
+	if _, err := rw.ResponseWriter.Write(appendEDNSOption(nil, p, EDNSOptionExtendedError, rw.data)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,91 @@
+package fastdns
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestExtendedError(t *testing.T) {
+	data := AppendExtendedError(nil, ExtendedErrorBlocked, "blocked by policy")
+	ede, err := ParseExtendedError(data)
+	if err != nil || ede.Code != ExtendedErrorBlocked || ede.Text != "blocked by policy" {
+		t.Errorf("ParseExtendedError(%x) got=%+v error=%+v", data, ede, err)
+	}
+
+	if _, err := ParseExtendedError([]byte{0}); err != ErrInvalidExtendedError {
+		t.Errorf("ParseExtendedError shall return ErrInvalidExtendedError, got %+v", err)
+	}
+
+	if s := ExtendedErrorDNSSECBogus.String(); s != "DNSSEC Bogus" {
+		t.Errorf("ExtendedErrorCode String got=%s", s)
+	}
+	if s := ExtendedErrorCode(1000).String(); s != "1000" {
+		t.Errorf("ExtendedErrorCode String got=%s", s)
+	}
+}
+
+func TestErrorWithExtendedError(t *testing.T) {
+	req := mockEDNSMessage(nil)
+	defer ReleaseMessage(req)
+	_ = ParseMessage(req, req.Raw, false)
+
+	rw := &MemResponseWriter{}
+	ErrorWithExtendedError(rw, req, RcodeServFail, ExtendedErrorNoReachableAuthority, "upstream timeout")
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+	_ = ParseMessage(resp, rw.Data, true)
+
+	if rcode := resp.Rcode(); rcode != RcodeServFail {
+		t.Errorf("ErrorWithExtendedError rcode got=%s", rcode)
+	}
+	edes := resp.ExtendedErrors()
+	if len(edes) != 1 || edes[0].Code != ExtendedErrorNoReachableAuthority || edes[0].Text != "upstream timeout" {
+		t.Errorf("ErrorWithExtendedError got=%+v raw=%x", edes, rw.Data)
+	}
+}
+
+func TestWithExtendedError(t *testing.T) {
+	req := mockEDNSMessage(nil)
+	defer ReleaseMessage(req)
+	_ = ParseMessage(req, req.Raw, false)
+
+	rw := &MemResponseWriter{}
+	w := WithExtendedError(rw, req, ExtendedErrorStaleAnswer, "")
+	w = WithExtendedError(w, req, ExtendedErrorForgedAnswer, "rewritten")
+	HOST1(w, req, 60, netip.AddrFrom4([4]byte{1, 1, 1, 1}))
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+	if err := ParseMessage(resp, rw.Data, true); err != nil || resp.Header.ANCount != 1 || resp.Header.ARCount != 1 {
+		t.Fatalf("WithExtendedError response error: %+v raw=%x", err, rw.Data)
+	}
+
+	edes := resp.ExtendedErrors()
+	if len(edes) != 2 || edes[0].Code != ExtendedErrorForgedAnswer || edes[0].Text != "rewritten" || edes[1].Code != ExtendedErrorStaleAnswer {
+		t.Errorf("WithExtendedError got=%+v raw=%x", edes, rw.Data)
+	}
+
+	// no EDNS in request
+	req = mockMessage()
+	rw = &MemResponseWriter{}
+	if w := WithExtendedError(rw, req, ExtendedErrorBlocked, ""); w != ResponseWriter(rw) {
+		t.Errorf("WithExtendedError shall return rw for requests without EDNS")
+	}
+}
+
+func TestSetEDNS(t *testing.T) {
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	req.SetEDNS(1232, false)
+	if opt, ok := req.OPT(); !ok || opt.UDPSize != 1232 || opt.DO() || req.Header.ARCount != 1 {
+		t.Errorf("SetEDNS shall add OPT record, got %+v raw=%x", opt, req.Raw)
+	}
+
+	req.SetEDNS(4096, true)
+	if opt, ok := req.OPT(); !ok || opt.UDPSize != 4096 || !opt.DO() || req.Header.ARCount != 1 {
+		t.Errorf("SetEDNS shall update OPT record, got %+v raw=%x", opt, req.Raw)
+	}
+}
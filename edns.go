@@ -0,0 +1,234 @@
+package fastdns
+
+// EDNSOption is the option code of EDNS(0) OPT pseudo record, see RFC 6891.
+type EDNSOption uint16
+
+// EDNS(0) option codes.
+const (
+	EDNSOptionNSID          EDNSOption = 3  // Name Server Identifier, RFC 5001
+	EDNSOptionClientSubnet  EDNSOption = 8  // EDNS Client Subnet, RFC 7871
+	EDNSOptionCookie        EDNSOption = 10 // DNS Cookies, RFC 7873
+	EDNSOptionExtendedError EDNSOption = 15 // Extended DNS Errors, RFC 8914
+)
+
+func (o EDNSOption) String() string {
+	switch o {
+	case EDNSOptionNSID:
+		return "NSID"
+	case EDNSOptionClientSubnet:
+		return "CLIENT-SUBNET"
+	case EDNSOptionCookie:
+		return "COOKIE"
+	case EDNSOptionExtendedError:
+		return "EDE"
+	}
+	return ""
+}
+
+// OPT represents the EDNS(0) OPT pseudo record, see RFC 6891.
+type OPT struct {
+	// UDPSize is the maximum UDP payload size of the sender.
+	UDPSize uint16
+
+	// ExtendedRcode is the upper 8 bits of the extended 12-bit RCODE.
+	ExtendedRcode byte
+
+	// Version is the EDNS version, only version 0 is defined.
+	Version byte
+
+	// Flags is an arbitrary 16bit represents DO and Z.
+	//
+	//   0  1  2  3  4  5  6  7  8  9  A  B  C  D  E  F
+	// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+	// |DO|                    Z                       |
+	// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+	Flags uint16
+
+	// Options refers to the raw options in RDATA.
+	Options []byte
+}
+
+// DO reports whether the DNSSEC OK bit is set.
+func (opt *OPT) DO() bool {
+	return opt.Flags&0x8000 != 0
+}
+
+// Walk calls f for each option of opt in the original order.
+func (opt *OPT) Walk(f func(code EDNSOption, data []byte) bool) {
+	options := opt.Options
+	for len(options) >= 4 {
+		code := EDNSOption(options[0])<<8 | EDNSOption(options[1])
+		length := int(options[2])<<8 | int(options[3])
+		if 4+length > len(options) {
+			return
+		}
+		if !f(code, options[4:4+length]) {
+			return
+		}
+		options = options[4+length:]
+	}
+}
+
+// Option returns the data of the first option of code.
+func (opt *OPT) Option(code EDNSOption) (data []byte, ok bool) {
+	opt.Walk(func(c EDNSOption, d []byte) bool {
+		if c == code {
+			data, ok = d, true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// OPT returns the OPT pseudo record in the additional section of msg.
+func (msg *Message) OPT() (opt OPT, ok bool) {
+	offset := optOffset(msg.Raw)
+	if offset < 0 {
+		return
+	}
+
+	payload := msg.Raw[offset+1:]
+	opt.UDPSize = uint16(payload[2])<<8 | uint16(payload[3])
+	opt.ExtendedRcode = payload[4]
+	opt.Version = payload[5]
+	opt.Flags = uint16(payload[6])<<8 | uint16(payload[7])
+	opt.Options = payload[10 : 10+(int(payload[8])<<8|int(payload[9]))]
+	ok = true
+
+	return
+}
+
+// Rcode returns the extended 12-bit RCODE of msg, which combines the RCODE in header and OPT record.
+func (msg *Message) Rcode() Rcode {
+	rcode := msg.Header.Flags.Rcode()
+	if opt, ok := msg.OPT(); ok {
+		rcode |= Rcode(opt.ExtendedRcode) << 4
+	}
+	return rcode
+}
+
+// AppendOPTRecord appends the OPT pseudo record to dst and returns the resulting dst.
+func AppendOPTRecord(dst []byte, opt OPT) []byte {
+	length := len(opt.Options)
+	// fixed size array for avoid bounds check
+	answer := [...]byte{
+		// NAME
+		0x00,
+		// TYPE
+		0x00, byte(TypeOPT),
+		// CLASS
+		byte(opt.UDPSize >> 8), byte(opt.UDPSize),
+		// TTL
+		opt.ExtendedRcode, opt.Version, byte(opt.Flags >> 8), byte(opt.Flags),
+		// RDLENGTH
+		byte(length >> 8), byte(length),
+	}
+	dst = append(dst, answer[:]...)
+	// RDATA
+	dst = append(dst, opt.Options...)
+
+	return dst
+}
+
+// AppendEDNSOption appends the EDNS(0) option to dst and returns the resulting dst.
+func AppendEDNSOption(dst []byte, code EDNSOption, data []byte) []byte {
+	dst = append(dst, byte(code>>8), byte(code), byte(len(data)>>8), byte(len(data)))
+	dst = append(dst, data...)
+	return dst
+}
+
+// SetEDNS adds an OPT record to msg or updates the existing one, with the UDP payload size and DO bit.
+func (msg *Message) SetEDNS(udpsize uint16, do bool) {
+	var flags uint16
+	if do {
+		flags = 0x8000
+	}
+
+	offset := optOffset(msg.Raw)
+	if offset < 0 {
+		msg.Raw = AppendOPTRecord(msg.Raw, OPT{UDPSize: udpsize, Flags: flags})
+		// ARCOUNT
+		msg.Header.ARCount = uint16(msg.Raw[10])<<8 | uint16(msg.Raw[11]) + 1
+		msg.Raw[10], msg.Raw[11] = byte(msg.Header.ARCount>>8), byte(msg.Header.ARCount)
+		return
+	}
+
+	// CLASS
+	msg.Raw[offset+3], msg.Raw[offset+4] = byte(udpsize>>8), byte(udpsize)
+	// TTL
+	msg.Raw[offset+7], msg.Raw[offset+8] = byte(flags>>8), byte(flags)
+}
+
+// AddEDNSOption adds the EDNS(0) option to the OPT record of msg, a new OPT record is added if msg does not have one.
+func (msg *Message) AddEDNSOption(code EDNSOption, data []byte) {
+	msg.Raw = insertEDNSOption(msg.Raw, code, data)
+	msg.Header.ARCount = uint16(msg.Raw[10])<<8 | uint16(msg.Raw[11])
+}
+
+// appendEDNSOption appends the message payload to dst with the option added to its OPT record.
+func appendEDNSOption(dst []byte, payload []byte, code EDNSOption, data []byte) []byte {
+	pos := len(dst)
+	dst = append(dst, payload...)
+	return append(dst[:pos], insertEDNSOption(dst[pos:], code, data)...)
+}
+
+// insertEDNSOption inserts the option at the end of OPT RDATA of the message payload,
+// a new OPT record is appended if payload does not have one.
+func insertEDNSOption(payload []byte, code EDNSOption, data []byte) []byte {
+	if len(payload) < 12 {
+		return payload
+	}
+
+	offset := optOffset(payload)
+	if offset < 0 {
+		offset = len(payload)
+		payload = AppendOPTRecord(payload, OPT{UDPSize: 1232})
+		// ARCOUNT
+		arcount := uint16(payload[10])<<8 | uint16(payload[11]) + 1
+		payload[10], payload[11] = byte(arcount>>8), byte(arcount)
+	}
+
+	rdlength := offset + 9
+	length := int(payload[rdlength])<<8 | int(payload[rdlength+1])
+	end := rdlength + 2 + length
+
+	// grow payload then move the records after OPT
+	n := 4 + len(data)
+	payload = append(payload, data...)
+	payload = append(payload, 0, 0, 0, 0)
+	copy(payload[end+n:], payload[end:len(payload)-n])
+	AppendEDNSOption(payload[end:end], code, data)
+
+	length += n
+	payload[rdlength] = byte(length >> 8)
+	payload[rdlength+1] = byte(length)
+
+	return payload
+}
+
+// optOffset returns the offset of OPT record in the additional section of payload, or -1 if not found.
+func optOffset(payload []byte) int {
+	if len(payload) < 12 {
+		return -1
+	}
+
+	qdcount := int(payload[4])<<8 | int(payload[5])
+	ancount := int(payload[6])<<8 | int(payload[7])
+	nscount := int(payload[8])<<8 | int(payload[9])
+	arcount := int(payload[10])<<8 | int(payload[11])
+
+	offset := skipQuestions(payload, qdcount)
+	for i := 0; i < ancount+nscount+arcount && offset >= 0; i++ {
+		end := skipRecord(payload, offset)
+		if end < 0 {
+			return -1
+		}
+		if i >= ancount+nscount && payload[offset] == 0 && Type(payload[offset+1])<<8|Type(payload[offset+2]) == TypeOPT {
+			return offset
+		}
+		offset = end
+	}
+
+	return -1
+}
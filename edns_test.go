@@ -0,0 +1,134 @@
+package fastdns
+
+import (
+	"bytes"
+	"testing"
+)
+
+func mockEDNSMessage(options []byte) *Message {
+	msg := AcquireMessage()
+	msg.Header.Flags = 0
+	msg.SetRequestQuestion("example.org", TypeA, ClassINET)
+	msg.Raw[11] = 1
+	msg.Header.ARCount = 1
+	msg.Raw = AppendOPTRecord(msg.Raw, OPT{UDPSize: 4096, Flags: 0x8000, Options: options})
+	return msg
+}
+
+func TestOPT(t *testing.T) {
+	options := AppendEDNSOption(nil, EDNSOptionCookie, []byte("01234567"))
+	options = AppendEDNSOption(options, 0xfff0, nil)
+
+	msg := mockEDNSMessage(options)
+	defer ReleaseMessage(msg)
+
+	opt, ok := msg.OPT()
+	if !ok {
+		t.Fatalf("OPT shall return the OPT record of %x", msg.Raw)
+	}
+	if opt.UDPSize != 4096 || !opt.DO() || !bytes.Equal(opt.Options, options) {
+		t.Errorf("OPT mismatched: %+v", opt)
+	}
+
+	if data, ok := opt.Option(EDNSOptionCookie); !ok || string(data) != "01234567" {
+		t.Errorf("OPT Option(COOKIE) mismatched: %q", data)
+	}
+	if data, ok := opt.Option(0xfff0); !ok || len(data) != 0 {
+		t.Errorf("OPT Option(0xfff0) shall return empty data: %q", data)
+	}
+	if _, ok := opt.Option(0xfff1); ok {
+		t.Errorf("OPT Option(0xfff1) shall not be found")
+	}
+
+	var count int
+	err := msg.WalkAdditionalRecords(func(name []byte, typ Type, class Class, ttl uint32, data []byte) bool {
+		count++
+		if !bytes.Equal(name, []byte{0}) || typ != TypeOPT || class != 4096 || ttl != 0x8000 || !bytes.Equal(data, options) {
+			t.Errorf("WalkAdditionalRecords mismatched: name=%x type=%s class=%d ttl=%x data=%x", name, typ, class, ttl, data)
+		}
+		return true
+	})
+	if err != nil || count != 1 {
+		t.Errorf("WalkAdditionalRecords error: %+v count=%d", err, count)
+	}
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if _, ok := req.OPT(); ok {
+		t.Errorf("OPT shall not be found in %x", req.Raw)
+	}
+}
+
+func TestAppendEDNSOption(t *testing.T) {
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	// adds a new OPT record
+	raw := appendEDNSOption(nil, req.Raw, EDNSOptionCookie, []byte("01234567"))
+	msg := AcquireMessage()
+	defer ReleaseMessage(msg)
+	if err := ParseMessage(msg, raw, true); err != nil || msg.Header.ARCount != 1 {
+		t.Fatalf("appendEDNSOption shall add OPT record, error=%+v raw=%x", err, raw)
+	}
+	opt, _ := msg.OPT()
+	if data, ok := opt.Option(EDNSOptionCookie); !ok || string(data) != "01234567" {
+		t.Errorf("appendEDNSOption mismatched: %x", raw)
+	}
+
+	// extends the existing OPT record
+	raw = appendEDNSOption(nil, msg.Raw, 0xfff0, []byte("x"))
+	if err := ParseMessage(msg, raw, true); err != nil || msg.Header.ARCount != 1 {
+		t.Fatalf("appendEDNSOption shall keep OPT record, error=%+v raw=%x", err, raw)
+	}
+	opt, _ = msg.OPT()
+	if data, ok := opt.Option(0xfff0); !ok || string(data) != "x" {
+		t.Errorf("appendEDNSOption mismatched: %x", raw)
+	}
+	if data, ok := opt.Option(EDNSOptionCookie); !ok || string(data) != "01234567" {
+		t.Errorf("appendEDNSOption mismatched: %x", raw)
+	}
+}
+
+func TestMessageRcode(t *testing.T) {
+	msg := mockEDNSMessage(nil)
+	defer ReleaseMessage(msg)
+
+	msg.Raw[3] |= byte(RcodeBADCOOKIE & 0x0f)
+	msg.Raw[len(msg.Raw)-6] = byte(RcodeBADCOOKIE >> 4)
+	_ = ParseMessage(msg, msg.Raw, false)
+
+	if rcode := msg.Rcode(); rcode != RcodeBADCOOKIE {
+		t.Errorf("Rcode shall return BADCOOKIE, got %s", rcode)
+	}
+}
+
+func TestAddEDNSOption(t *testing.T) {
+	msg := mockEDNSMessage(AppendEDNSOption(nil, EDNSOptionCookie, []byte("01234567")))
+	defer ReleaseMessage(msg)
+
+	// a TXT record after OPT record
+	msg.Raw[11] = 2
+	msg.Raw = append(msg.Raw, 0x00, 0x00, byte(TypeTXT), 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x01, 'x')
+	_ = ParseMessage(msg, msg.Raw, false)
+
+	msg.AddEDNSOption(0xfff0, []byte("y"))
+
+	var types []Type
+	err := msg.WalkAdditionalRecords(func(name []byte, typ Type, class Class, ttl uint32, data []byte) bool {
+		types = append(types, typ)
+		if typ == TypeTXT && string(data) != "\x01x" {
+			t.Errorf("AddEDNSOption shall keep the records after OPT, got %x", data)
+		}
+		return true
+	})
+	if err != nil || len(types) != 2 || types[0] != TypeOPT || types[1] != TypeTXT {
+		t.Errorf("AddEDNSOption error: %+v types=%v raw=%x", err, types, msg.Raw)
+	}
+
+	opt, _ := msg.OPT()
+	if data, ok := opt.Option(0xfff0); !ok || string(data) != "y" {
+		t.Errorf("AddEDNSOption mismatched: %x", msg.Raw)
+	}
+}
@@ -10,6 +10,14 @@ type Handler interface {
 	ServeDNS(rw ResponseWriter, req *Message)
 }
 
+// HandlerFunc is an adapter to allow the use of ordinary functions as DNS handlers.
+type HandlerFunc func(rw ResponseWriter, req *Message)
+
+// ServeDNS calls f(rw, req).
+func (f HandlerFunc) ServeDNS(rw ResponseWriter, req *Message) {
+	f(rw, req)
+}
+
 // Error replies to the request with the specified Rcode.
 func Error(rw ResponseWriter, req *Message, rcode Rcode) {
 	req.SetResponseHeader(rcode, 0)
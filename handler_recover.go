@@ -0,0 +1,45 @@
+package fastdns
+
+import (
+	"log"
+	"runtime"
+)
+
+// recoverHandler recovers the panics of Handler, logs the stack and replies SERVFAIL.
+type recoverHandler struct {
+	Handler      Handler
+	Stats        Stats
+	ErrorLog     *log.Logger
+	PanicHandler func(rw ResponseWriter, req *Message, v interface{})
+}
+
+// ServeDNS implements Handler.
+func (h *recoverHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	defer func() {
+		if v := recover(); v != nil {
+			h.handlePanic(rw, req, v)
+		}
+	}()
+
+	h.Handler.ServeDNS(rw, req)
+}
+
+func (h *recoverHandler) handlePanic(rw ResponseWriter, req *Message, v interface{}) {
+	const size = 64 << 10
+	buf := make([]byte, size)
+	buf = buf[:runtime.Stack(buf, false)]
+	h.ErrorLog.Printf("panic serving %s: %s: %v\n%s", rw.RemoteAddr(), req.Domain, v, buf)
+
+	if stats, ok := h.Stats.(PanicStats); ok {
+		stats.UpdatePanicStats()
+	}
+
+	if h.PanicHandler != nil {
+		h.PanicHandler(rw, req, v)
+		return
+	}
+
+	if len(req.Raw) >= 12 {
+		Error(rw, req, RcodeServFail)
+	}
+}
@@ -0,0 +1,55 @@
+package fastdns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"strings"
+	"testing"
+)
+
+type mockPanicHandler struct{}
+
+func (h *mockPanicHandler) ServeDNS(rw ResponseWriter, req *Message) {
+	panic("mock panic")
+}
+
+func TestRecoverHandler(t *testing.T) {
+	var logs bytes.Buffer
+	stats := &CoreStats{}
+
+	h := &recoverHandler{
+		Handler:  &mockPanicHandler{},
+		Stats:    stats,
+		ErrorLog: log.New(&logs, "", 0),
+	}
+
+	rw, req := &MemResponseWriter{}, mockMessage()
+	h.ServeDNS(rw, req)
+
+	if got, want := hex.EncodeToString(rw.Data), "000281820000000000000000"; got != want {
+		t.Errorf("recoverHandler shall reply SERVFAIL got=%#v want=%#v", got, want)
+	}
+	if !strings.Contains(logs.String(), "mock panic") || !strings.Contains(logs.String(), "goroutine") {
+		t.Errorf("recoverHandler shall log panic stack but got %#v", logs.String())
+	}
+	if stats.PanicsTotal != 1 {
+		t.Errorf("recoverHandler shall count panics but got %d", stats.PanicsTotal)
+	}
+
+	var recovered interface{}
+	h.PanicHandler = func(rw ResponseWriter, req *Message, v interface{}) {
+		recovered = v
+		Error(rw, req, RcodeRefused)
+	}
+
+	rw, req = &MemResponseWriter{}, mockMessage()
+	h.ServeDNS(rw, req)
+
+	if recovered != "mock panic" {
+		t.Errorf("recoverHandler shall call PanicHandler but got %#v", recovered)
+	}
+	if got, want := hex.EncodeToString(rw.Data), "000281850000000000000000"; got != want {
+		t.Errorf("recoverHandler shall reply by PanicHandler got=%#v want=%#v", got, want)
+	}
+}
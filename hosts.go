@@ -0,0 +1,70 @@
+package fastdns
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Hosts is the static table of hosts(5), the names are matched case-insensitively.
+type Hosts struct {
+	addrs map[string][]netip.Addr
+	names map[netip.Addr][]string
+}
+
+// LoadHosts reads and parses the hosts file of filename, e.g. "/etc/hosts".
+func LoadHosts(filename string) (*Hosts, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseHosts(data), nil
+}
+
+// ParseHosts parses the content of hosts file, the lines with invalid addresses are ignored.
+func ParseHosts(data []byte) *Hosts {
+	hosts := &Hosts{
+		addrs: make(map[string][]netip.Addr),
+		names: make(map[netip.Addr][]string),
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			key := strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts.addrs[key] = append(hosts.addrs[key], ip)
+			hosts.names[ip] = append(hosts.names[ip], strings.TrimSuffix(name, "."))
+		}
+	}
+
+	return hosts
+}
+
+// LookupNetIP returns the addresses of name of network "ip", "ip4" or "ip6" in the order of hosts file.
+func (h *Hosts) LookupNetIP(network, name string) (ips []netip.Addr) {
+	for _, ip := range h.addrs[strings.ToLower(strings.TrimSuffix(name, "."))] {
+		if network == "ip" || (network == "ip4" && ip.Is4()) || (network == "ip6" && ip.Is6()) {
+			ips = append(ips, ip)
+		}
+	}
+	return
+}
+
+// LookupAddr returns the names of addr, the canonical name is the first one.
+func (h *Hosts) LookupAddr(addr netip.Addr) []string {
+	return h.names[addr]
+}
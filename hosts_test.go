@@ -0,0 +1,38 @@
+package fastdns
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseHosts(t *testing.T) {
+	hosts := ParseHosts([]byte(`# static hosts
+127.0.0.1	localhost
+::1		localhost ip6-localhost
+192.0.2.1	Host.Example.org host # comment
+192.0.2.2	host.example.org.
+bad		invalid.example.org
+`))
+
+	cases := []struct {
+		Network string
+		Name    string
+		IPs     []netip.Addr
+	}{
+		{"ip", "localhost", []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}},
+		{"ip6", "LOCALHOST.", []netip.Addr{netip.MustParseAddr("::1")}},
+		{"ip4", "host.example.org", []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}},
+		{"ip6", "host", nil},
+		{"ip", "invalid.example.org", nil},
+	}
+	for _, c := range cases {
+		if ips := hosts.LookupNetIP(c.Network, c.Name); !reflect.DeepEqual(ips, c.IPs) {
+			t.Errorf("Hosts.LookupNetIP(%#v, %#v) return %v, expect %v", c.Network, c.Name, ips, c.IPs)
+		}
+	}
+
+	if names := hosts.LookupAddr(netip.MustParseAddr("192.0.2.1")); !reflect.DeepEqual(names, []string{"Host.Example.org", "host"}) {
+		t.Errorf("Hosts.LookupAddr return %v", names)
+	}
+}
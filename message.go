@@ -137,7 +137,7 @@ func ParseMessage(dst *Message, payload []byte, copying bool) error {
 			break
 		}
 	}
-	if i == 0 || i+5 > len(payload) {
+	if i+5 > len(payload) {
 		return ErrInvalidQuestion
 	}
 	dst.Question.Name = payload[:i+1]
@@ -148,6 +148,11 @@ func ParseMessage(dst *Message, payload []byte, copying bool) error {
 	dst.Question.Type = Type(uint16(payload[2]) | uint16(payload[1])<<8)
 
 	// Domain
+	if i == 0 {
+		// root
+		dst.Domain = dst.Domain[:0]
+		return nil
+	}
 	i = int(dst.Question.Name[0])
 	payload = append(dst.Domain[:0], dst.Question.Name[1:]...)
 	for payload[i] != 0 {
@@ -180,7 +185,12 @@ func (msg *Message) DecodeName(dst []byte, name []byte) []byte {
 		offset = int(name[len(name)-2]&0b00111111)<<8 + int(name[len(name)-1])
 	}
 
-	for offset != 0 {
+	for hops := 0; offset != 0; hops++ {
+		// stop on the looping or out of range pointers of malformed messages
+		if hops > 127 || offset >= len(msg.Raw) {
+			dst = append(dst, 0)
+			break
+		}
 		for i := offset; i < len(msg.Raw); {
 			b := int(msg.Raw[i])
 			if b == 0 {
@@ -256,7 +266,80 @@ func (msg *Message) Walk(f func(name []byte, typ Type, class Class, ttl uint32,
 
 // WalkAdditionalRecords calls f for each item in the msg in the original order of the parsed AR.
 func (msg *Message) WalkAdditionalRecords(f func(name []byte, typ Type, class Class, ttl uint32, data []byte) bool) error {
-	panic("not implemented")
+	payload := msg.Raw
+	if len(payload) < 12 {
+		return ErrInvalidHeader
+	}
+
+	offset := skipQuestions(payload, int(msg.Header.QDCount))
+	for i := 0; i < int(msg.Header.ANCount)+int(msg.Header.NSCount) && offset >= 0; i++ {
+		offset = skipRecord(payload, offset)
+	}
+
+	for i := 0; i < int(msg.Header.ARCount); i++ {
+		if offset < 0 {
+			return ErrInvalidAnswer
+		}
+		end := skipRecord(payload, offset)
+		if end < 0 {
+			return ErrInvalidAnswer
+		}
+		j := skipName(payload, offset)
+		name := payload[offset:j]
+		typ := Type(payload[j])<<8 | Type(payload[j+1])
+		class := Class(payload[j+2])<<8 | Class(payload[j+3])
+		ttl := uint32(payload[j+4])<<24 | uint32(payload[j+5])<<16 | uint32(payload[j+6])<<8 | uint32(payload[j+7])
+		if !f(name, typ, class, ttl, payload[j+10:end]) {
+			break
+		}
+		offset = end
+	}
+
+	return nil
+}
+
+// skipName returns the offset after the name at offset of payload, or -1 if it is truncated.
+func skipName(payload []byte, offset int) int {
+	for offset >= 0 && offset < len(payload) {
+		b := payload[offset]
+		switch {
+		case b == 0:
+			return offset + 1
+		case b&0b11000000 == 0b11000000:
+			if offset+2 > len(payload) {
+				return -1
+			}
+			return offset + 2
+		default:
+			offset += int(b) + 1
+		}
+	}
+	return -1
+}
+
+// skipQuestions returns the offset after n questions of payload, or -1 if it is truncated.
+func skipQuestions(payload []byte, n int) int {
+	offset := 12
+	for i := 0; i < n && offset >= 0; i++ {
+		if offset = skipName(payload, offset); offset >= 0 {
+			if offset += 4; offset > len(payload) {
+				return -1
+			}
+		}
+	}
+	return offset
+}
+
+// skipRecord returns the offset after the resource record at offset of payload, or -1 if it is truncated.
+func skipRecord(payload []byte, offset int) int {
+	if offset = skipName(payload, offset); offset < 0 || offset+10 > len(payload) {
+		return -1
+	}
+	offset += 10 + (int(payload[offset+8])<<8 | int(payload[offset+9]))
+	if offset > len(payload) {
+		return -1
+	}
+	return offset
 }
 
 // SetRequestQuestion set question for DNS request.
@@ -291,7 +374,7 @@ func (msg *Message) SetRequestQuestion(domain string, typ Type, class Class) {
 
 	// QNAME
 	msg.Raw = EncodeDomain(msg.Raw, domain)
-	msg.Question.Name = msg.Raw[len(header) : len(header)+len(domain)+2]
+	msg.Question.Name = msg.Raw[len(header):]
 	// QTYPE
 	msg.Raw = append(msg.Raw, byte(typ>>8), byte(typ))
 	msg.Question.Type = typ
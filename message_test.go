@@ -240,3 +240,18 @@ func BenchmarkDecodeName(b *testing.B) {
 		resp.DecodeName(dst[:0], name)
 	}
 }
+
+func TestParseMessageRoot(t *testing.T) {
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("", TypeDNSKEY, ClassINET)
+
+	msg := AcquireMessage()
+	defer ReleaseMessage(msg)
+	if err := ParseMessage(msg, req.Raw, true); err != nil {
+		t.Fatalf("ParseMessage(%x) error: %+v", req.Raw, err)
+	}
+	if len(msg.Domain) != 0 || string(msg.Question.Name) != "\x00" || msg.Question.Type != TypeDNSKEY || msg.Question.Class != ClassINET {
+		t.Errorf("ParseMessage(%x) return domain=%#v question=%#v", req.Raw, string(msg.Domain), msg.Question)
+	}
+}
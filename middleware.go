@@ -0,0 +1,108 @@
+package fastdns
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Middleware wraps a Handler to add behaviour before or after it, like net/http middlewares.
+type Middleware func(Handler) Handler
+
+// Chain wraps handler with middlewares, the first middleware is the outermost one.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// MiddlewareFunc returns a Middleware from f, which calls next to continue the chain.
+// The returned handlers implement ContextHandler only if the wrapped handlers do,
+// so the per-request context is passed through the chain.
+func MiddlewareFunc(f func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler)) Middleware {
+	return func(next Handler) Handler {
+		if _, ok := next.(ContextHandler); ok {
+			return &contextMiddleware{f: f, next: ToContextHandler(next)}
+		}
+		return &middleware{f: f, next: ToContextHandler(next)}
+	}
+}
+
+type middleware struct {
+	f    func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler)
+	next ContextHandler
+}
+
+func (m *middleware) ServeDNS(rw ResponseWriter, req *Message) {
+	m.f(context.Background(), rw, req, m.next)
+}
+
+type contextMiddleware middleware
+
+func (m *contextMiddleware) ServeDNS(rw ResponseWriter, req *Message) {
+	m.f(context.Background(), rw, req, m.next)
+}
+
+func (m *contextMiddleware) ServeDNSContext(ctx context.Context, rw ResponseWriter, req *Message) {
+	m.f(ctx, rw, req, m.next)
+}
+
+// LoggingMiddleware logs the client address, question, response code and duration of each request.
+func LoggingMiddleware(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+		start := time.Now()
+		w := &rcodeResponseWriter{ResponseWriter: rw}
+		next.ServeDNSContext(ctx, w, req)
+		logger.Printf("%s] %s: CLASS %s TYPE %s RCODE %s %s", rw.RemoteAddr(), req.Domain, req.Question.Class, req.Question.Type, w.rcode, time.Since(start))
+	})
+}
+
+// MetricsMiddleware records the requests into stats.
+func MetricsMiddleware(stats Stats) Middleware {
+	return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+		start := time.Now()
+		next.ServeDNSContext(ctx, rw, req)
+		stats.UpdateStats(rw.RemoteAddr(), req, time.Since(start))
+	})
+}
+
+// RecoveryMiddleware recovers the panics of handlers, logs the stack and replies SERVFAIL.
+func RecoveryMiddleware(logger *log.Logger, stats Stats) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	h := &recoverHandler{
+		Stats:    stats,
+		ErrorLog: logger,
+	}
+	return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+		defer func() {
+			if v := recover(); v != nil {
+				h.handlePanic(rw, req, v)
+			}
+		}()
+		next.ServeDNSContext(ctx, rw, req)
+	})
+}
+
+// rcodeResponseWriter records the response code written by handler.
+type rcodeResponseWriter struct {
+	ResponseWriter
+	rcode Rcode
+}
+
+// Unwrap returns the wrapped ResponseWriter.
+func (rw *rcodeResponseWriter) Unwrap() ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *rcodeResponseWriter) Write(p []byte) (int, error) {
+	if len(p) >= 4 {
+		rw.rcode = Rcode(p[3] & 0x0f)
+	}
+	return rw.ResponseWriter.Write(p)
+}
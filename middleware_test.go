@@ -0,0 +1,108 @@
+package fastdns
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var trace []string
+
+	mark := func(name string) Middleware {
+		return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+			trace = append(trace, name)
+			next.ServeDNSContext(ctx, rw, req)
+		})
+	}
+
+	handler := Chain(HandlerFunc(func(rw ResponseWriter, req *Message) {
+		trace = append(trace, "handler")
+	}), mark("a"), mark("b"))
+
+	if _, ok := handler.(ContextHandler); ok {
+		t.Errorf("Chain of plain handler shall not implement ContextHandler")
+	}
+
+	handler.ServeDNS(&MemResponseWriter{}, mockMessage())
+	if got, want := strings.Join(trace, ","), "a,b,handler"; got != want {
+		t.Errorf("Chain error got=%#v want=%#v", got, want)
+	}
+
+	handler = Chain(NewServeMux(), mark("a"))
+	if _, ok := handler.(ContextHandler); !ok {
+		t.Errorf("Chain of ContextHandler shall implement ContextHandler")
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+
+	handler := Chain(&mockServerHandler{}, LoggingMiddleware(log.New(&logs, "", 0)))
+	handler.ServeDNS(&MemResponseWriter{}, mockMessage())
+
+	if !strings.Contains(logs.String(), "hk.phus.lu: CLASS IN TYPE A RCODE NoError") {
+		t.Errorf("LoggingMiddleware error got=%#v", logs.String())
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	stats := &CoreStats{}
+
+	handler := Chain(&mockServerHandler{}, MetricsMiddleware(stats))
+	handler.ServeDNS(&MemResponseWriter{}, mockMessage())
+
+	if stats.RequestCountTotal != 1 || stats.ResponseRcodeCountTotal_NOERROR != 1 {
+		t.Errorf("MetricsMiddleware shall record request, stats=%+v", stats)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	stats := &CoreStats{}
+
+	rw := &MemResponseWriter{}
+	handler := Chain(&mockPanicHandler{}, RecoveryMiddleware(log.New(&logs, "", 0), stats))
+	handler.ServeDNS(rw, mockMessage())
+
+	if len(rw.Data) < 4 || Rcode(rw.Data[3]&0x0f) != RcodeServFail {
+		t.Errorf("RecoveryMiddleware shall reply SERVFAIL, data=%x", rw.Data)
+	}
+	if stats.PanicsTotal != 1 {
+		t.Errorf("RecoveryMiddleware shall count panics, got %d", stats.PanicsTotal)
+	}
+	if !strings.Contains(string(stats.AppendOpenMetrics(nil)), `dns_panics_total{proto="",server="",zone=""} 1`) {
+		t.Errorf("RecoveryMiddleware shall expose panics in metrics")
+	}
+}
+
+func TestACLMiddleware(t *testing.T) {
+	handler := Chain(&mockServerHandler{}, ACLMiddleware([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}))
+
+	var cases = []struct {
+		Addr  string
+		Rcode Rcode
+	}{
+		{"10.1.2.3:53", RcodeNoError},
+		{"[::ffff:10.1.2.3]:53", RcodeNoError},
+		{"192.168.1.1:53", RcodeRefused},
+	}
+
+	for _, c := range cases {
+		rw := &MemResponseWriter{Raddr: netip.MustParseAddrPort(c.Addr)}
+		handler.ServeDNS(rw, mockMessage())
+		if len(rw.Data) < 4 || Rcode(rw.Data[3]&0x0f) != c.Rcode {
+			t.Errorf("ACLMiddleware(%s) error got=%x want rcode=%s", c.Addr, rw.Data, c.Rcode)
+		}
+	}
+
+	// no allowed prefixes refuses all clients
+	rw := &MemResponseWriter{Raddr: netip.MustParseAddrPort("10.1.2.3:53")}
+	Chain(&mockServerHandler{}, ACLMiddleware(nil)).ServeDNS(rw, mockMessage())
+	if len(rw.Data) < 4 || Rcode(rw.Data[3]&0x0f) != RcodeRefused {
+		t.Errorf("ACLMiddleware(nil) shall refuse all clients, got=%x", rw.Data)
+	}
+}
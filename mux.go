@@ -0,0 +1,138 @@
+package fastdns
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// ServeMux is a DNS request multiplexer. It matches the domain of each request against
+// the registered zones and calls the handler of the longest matching zone.
+//
+// Zones are matched case-insensitively on label boundaries, e.g. zone "example.org" matches
+// "example.org" and "www.example.org" but not "badexample.org". Zone "." matches all domains.
+type ServeMux struct {
+	// NotFound optionally handles the requests which do not match any zone, replies REFUSED if empty.
+	NotFound Handler
+
+	mu    sync.RWMutex
+	zones map[string]*muxEntry
+}
+
+type muxEntry struct {
+	handler ContextHandler
+	types   map[Type]ContextHandler
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{zones: make(map[string]*muxEntry)}
+}
+
+// Handle registers the handler for the given zone.
+func (mux *ServeMux) Handle(zone string, handler Handler) {
+	mux.handle(zone, TypeNone, handler)
+}
+
+// HandleType registers the handler for the given zone and query type,
+// it takes precedence over the handler registered by Handle for the same zone.
+func (mux *ServeMux) HandleType(zone string, typ Type, handler Handler) {
+	mux.handle(zone, typ, handler)
+}
+
+// HandleFunc registers the handler function for the given zone.
+func (mux *ServeMux) HandleFunc(zone string, handler func(rw ResponseWriter, req *Message)) {
+	mux.Handle(zone, HandlerFunc(handler))
+}
+
+func (mux *ServeMux) handle(zone string, typ Type, handler Handler) {
+	if handler == nil {
+		panic("fastdns: nil handler")
+	}
+
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if mux.zones == nil {
+		mux.zones = make(map[string]*muxEntry)
+	}
+
+	entry := mux.zones[zone]
+	if entry == nil {
+		entry = new(muxEntry)
+		mux.zones[zone] = entry
+	}
+
+	if typ == TypeNone {
+		entry.handler = ToContextHandler(handler)
+		return
+	}
+	if entry.types == nil {
+		entry.types = make(map[Type]ContextHandler)
+	}
+	entry.types[typ] = ToContextHandler(handler)
+}
+
+// Handler returns the handler to use for the given request, or nil if no zone matches.
+func (mux *ServeMux) Handler(req *Message) ContextHandler {
+	// lower case the domain on stack
+	var buf [256]byte
+	domain := buf[:0]
+	if len(req.Domain) > len(buf) {
+		domain = make([]byte, 0, len(req.Domain))
+	}
+	for _, c := range req.Domain {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		domain = append(domain, c)
+	}
+
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	for {
+		if entry := mux.zones[string(domain)]; entry != nil {
+			if h := entry.types[req.Question.Type]; h != nil {
+				return h
+			}
+			if entry.handler != nil {
+				return entry.handler
+			}
+		}
+		if len(domain) == 0 {
+			return nil
+		}
+		i := 0
+		for i < len(domain) && domain[i] != '.' {
+			i++
+		}
+		if i == len(domain) {
+			domain = domain[:0]
+		} else {
+			domain = domain[i+1:]
+		}
+	}
+}
+
+// ServeDNS dispatches the request to the handler of the longest matching zone.
+func (mux *ServeMux) ServeDNS(rw ResponseWriter, req *Message) {
+	mux.ServeDNSContext(context.Background(), rw, req)
+}
+
+// ServeDNSContext dispatches the request to the handler of the longest matching zone.
+func (mux *ServeMux) ServeDNSContext(ctx context.Context, rw ResponseWriter, req *Message) {
+	if h := mux.Handler(req); h != nil {
+		h.ServeDNSContext(ctx, rw, req)
+		return
+	}
+
+	if mux.NotFound != nil {
+		ToContextHandler(mux.NotFound).ServeDNSContext(ctx, rw, req)
+		return
+	}
+
+	Error(rw, req, RcodeRefused)
+}
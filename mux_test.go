@@ -0,0 +1,92 @@
+package fastdns
+
+import (
+	"context"
+	"testing"
+)
+
+func mockZoneHandler(name string, called *string) Handler {
+	return HandlerFunc(func(rw ResponseWriter, req *Message) {
+		*called = name
+		Error(rw, req, RcodeNoError)
+	})
+}
+
+func TestServeMux(t *testing.T) {
+	var called string
+
+	mux := NewServeMux()
+	mux.Handle(".", mockZoneHandler("root", &called))
+	mux.Handle("Example.ORG.", mockZoneHandler("example.org", &called))
+	mux.Handle("www.example.org", mockZoneHandler("www.example.org", &called))
+	mux.HandleType("example.org", TypeMX, mockZoneHandler("example.org/MX", &called))
+	mux.HandleType("mx.example.org", TypeMX, mockZoneHandler("mx.example.org/MX", &called))
+
+	var cases = []struct {
+		Domain  string
+		Type    Type
+		Handler string
+	}{
+		{"example.org", TypeA, "example.org"},
+		{"EXAMPLE.org", TypeA, "example.org"},
+		{"a.b.example.org", TypeA, "example.org"},
+		{"www.example.org", TypeA, "www.example.org"},
+		{"a.www.example.org", TypeA, "www.example.org"},
+		{"badexample.org", TypeA, "root"},
+		{"example.org", TypeMX, "example.org/MX"},
+		{"www.example.org", TypeMX, "www.example.org"},
+		{"a.mx.example.org", TypeA, "example.org"},
+		{"a.mx.example.org", TypeMX, "mx.example.org/MX"},
+		{"example.com", TypeA, "root"},
+	}
+
+	for _, c := range cases {
+		called = ""
+		req := AcquireMessage()
+		req.SetRequestQuestion(c.Domain, c.Type, ClassINET)
+		mux.ServeDNS(&MemResponseWriter{}, req)
+		if called != c.Handler {
+			t.Errorf("ServeMux(%s %s) error got=%#v want=%#v", c.Domain, c.Type, called, c.Handler)
+		}
+		ReleaseMessage(req)
+	}
+}
+
+func TestServeMuxNotFound(t *testing.T) {
+	var called string
+
+	mux := NewServeMux()
+	mux.Handle("example.org", mockZoneHandler("example.org", &called))
+
+	rw, req := &MemResponseWriter{}, AcquireMessage()
+	defer ReleaseMessage(req)
+
+	req.SetRequestQuestion("example.com", TypeA, ClassINET)
+	mux.ServeDNSContext(context.Background(), rw, req)
+	if called != "" || len(rw.Data) < 4 || Rcode(rw.Data[3]&0x0f) != RcodeRefused {
+		t.Errorf("ServeMux shall reply REFUSED for unknown zone, called=%#v data=%x", called, rw.Data)
+	}
+
+	mux.NotFound = mockZoneHandler("notfound", &called)
+	req.SetRequestQuestion("example.com", TypeA, ClassINET)
+	mux.ServeDNS(&MemResponseWriter{}, req)
+	if called != "notfound" {
+		t.Errorf("ServeMux shall call NotFound handler, called=%#v", called)
+	}
+}
+
+func BenchmarkServeMux(b *testing.B) {
+	mux := NewServeMux()
+	mux.Handle("example.org", HandlerFunc(func(rw ResponseWriter, req *Message) {}))
+	mux.Handle("example.com", HandlerFunc(func(rw ResponseWriter, req *Message) {}))
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("www.Example.org", TypeA, ClassINET)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mux.Handler(req)
+	}
+}
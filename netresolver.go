@@ -0,0 +1,183 @@
+package fastdns
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Exchanger executes DNS transactions, it is implemented by Client, DoHClient and DoTClient.
+type Exchanger interface {
+	Exchange(req, resp *Message) error
+}
+
+// contextExchanger is implemented by the clients which support context, e.g. Client, DoHClient and DoTClient.
+type contextExchanger interface {
+	ExchangeContext(ctx context.Context, req, resp *Message) error
+}
+
+// NewResolver returns a net.Resolver which uses the pure Go resolver with the Dial of ResolverDial(client),
+// so that the lookups of net/http and other packages are served by client.
+//
+// Note that the pure Go resolver is not used on Windows before Go 1.19 and Plan 9.
+func NewResolver(client Exchanger) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     ResolverDial(client),
+	}
+}
+
+// ResolverDial returns a net.Resolver Dial function, the returned connections are in-process shims
+// which exchange the queries written by net.Resolver with client instead of sending them to address.
+func ResolverDial(client Exchanger) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return &resolverConn{
+			ctx:     ctx,
+			client:  client,
+			network: network,
+			address: address,
+		}, nil
+	}
+}
+
+// resolverConn is a stream net.Conn with the length prefixed framing of DNS over TCP, the pure Go resolver
+// uses it as a stream connection because it does not implement net.PacketConn.
+type resolverConn struct {
+	ctx     context.Context
+	client  Exchanger
+	network string
+	address string
+
+	mu       sync.Mutex
+	wbuf     []byte
+	rbuf     []byte
+	deadline time.Time
+	closed   bool
+}
+
+// Write exchanges the framed queries of p with the client, and buffers the framed responses for Read.
+func (c *resolverConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.wbuf = append(c.wbuf, p...)
+	ctx, deadline := c.ctx, c.deadline
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		if len(c.wbuf) < 2 || len(c.wbuf) < 2+(int(c.wbuf[0])<<8|int(c.wbuf[1])) {
+			c.mu.Unlock()
+			return len(p), nil
+		}
+		length := int(c.wbuf[0])<<8 | int(c.wbuf[1])
+		req := AcquireMessage()
+		err := ParseMessage(req, c.wbuf[2:2+length], true)
+		c.wbuf = append(c.wbuf[:0], c.wbuf[2+length:]...)
+		c.mu.Unlock()
+
+		if err != nil {
+			ReleaseMessage(req)
+			return 0, err
+		}
+
+		resp := AcquireMessage()
+		err = c.exchange(ctx, deadline, req, resp)
+		if err == ErrInvalidHeader && len(resp.Raw) >= 12 && resp.Raw[3]&0x0f != 0 {
+			// the error responses may not have the question section, which net.Resolver expects
+			resp.Raw = append(append(resp.Raw[:12], req.Raw[12:12+len(req.Question.Name)]...),
+				byte(req.Question.Type>>8), byte(req.Question.Type), byte(req.Question.Class>>8), byte(req.Question.Class))
+			resp.Raw[4], resp.Raw[5] = 0, 1
+			err = nil
+		}
+		if err == nil {
+			c.mu.Lock()
+			c.rbuf = append(c.rbuf, byte(len(resp.Raw)>>8), byte(len(resp.Raw)))
+			c.rbuf = append(c.rbuf, resp.Raw...)
+			c.mu.Unlock()
+		}
+		ReleaseMessage(req)
+		ReleaseMessage(resp)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *resolverConn) exchange(ctx context.Context, deadline time.Time, req, resp *Message) error {
+	client, ok := c.client.(contextExchanger)
+	if !ok {
+		return c.client.Exchange(req, resp)
+	}
+
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	return client.ExchangeContext(ctx, req, resp)
+}
+
+// Read reads the buffered framed responses, it returns io.EOF if there are no responses.
+func (c *resolverConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if len(c.rbuf) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, c.rbuf)
+	c.rbuf = append(c.rbuf[:0], c.rbuf[n:]...)
+
+	return n, nil
+}
+
+func (c *resolverConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.wbuf, c.rbuf = nil, nil
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *resolverConn) LocalAddr() net.Addr {
+	return resolverAddr{network: c.network, address: "fastdns"}
+}
+
+func (c *resolverConn) RemoteAddr() net.Addr {
+	return resolverAddr{network: c.network, address: c.address}
+}
+
+func (c *resolverConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *resolverConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *resolverConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+type resolverAddr struct {
+	network string
+	address string
+}
+
+func (a resolverAddr) Network() string { return a.network }
+
+func (a resolverAddr) String() string { return a.address }
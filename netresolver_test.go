@@ -0,0 +1,77 @@
+package fastdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNewResolver(t *testing.T) {
+	client, cleanup := mockLookupClient(t)
+	defer cleanup()
+
+	resolver := NewResolver(client)
+	ctx := context.Background()
+
+	addrs, err := resolver.LookupHost(ctx, "example.org.")
+	if err != nil || len(addrs) != 2 {
+		t.Errorf("net.Resolver LookupHost(example.org) return %v %+v", addrs, err)
+	}
+
+	mxs, err := resolver.LookupMX(ctx, "example.org.")
+	if err != nil || len(mxs) != 2 || mxs[0].Host != "mx1.example.org." {
+		t.Errorf("net.Resolver LookupMX(example.org) return %v %+v", mxs, err)
+	}
+
+	txts, err := resolver.LookupTXT(ctx, "example.org.")
+	if err != nil || !reflect.DeepEqual(txts, []string{"v=spf1 -all"}) {
+		t.Errorf("net.Resolver LookupTXT(example.org) return %v %+v", txts, err)
+	}
+
+	_, err = resolver.LookupHost(ctx, "nxdomain.example.org.")
+	var e *net.DNSError
+	if !errors.As(err, &e) || !e.IsNotFound {
+		t.Errorf("net.Resolver LookupHost(nxdomain.example.org) shall return not found error, got %+v", err)
+	}
+}
+
+func TestResolverConn(t *testing.T) {
+	client, cleanup := mockLookupClient(t)
+	defer cleanup()
+
+	conn, err := ResolverDial(client)(context.Background(), "udp", "127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("ResolverDial error: %+v", err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(net.PacketConn); ok {
+		t.Fatalf("resolverConn shall be a stream connection")
+	}
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+
+	frame := append([]byte{byte(len(req.Raw) >> 8), byte(len(req.Raw))}, req.Raw...)
+	// the frame may be written in pieces
+	for _, p := range [][]byte{frame[:1], frame[1:7], frame[7:]} {
+		if _, err := conn.Write(p); err != nil {
+			t.Fatalf("resolverConn write error: %+v", err)
+		}
+	}
+
+	buf := make([]byte, 1232)
+	n, err := conn.Read(buf)
+	if err != nil || n < 2 || int(buf[0])<<8|int(buf[1]) != n-2 {
+		t.Fatalf("resolverConn read error: %+v %x", err, buf[:n])
+	}
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+	if err := ParseMessage(resp, buf[2:n], true); err != nil || resp.Header.ID != req.Header.ID || resp.Header.ANCount != 1 {
+		t.Errorf("resolverConn mismatched response: %+v %x", err, resp.Raw)
+	}
+}
@@ -0,0 +1,99 @@
+package fastdns
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Identity identifies the server instance in responses of the EDNS NSID option (RFC 5001)
+// and the CHAOS TXT queries of id.server, hostname.bind (RFC 4892) and version.bind.
+type Identity struct {
+	// Hostname is the name of server host, use os.Hostname() if empty.
+	Hostname string
+
+	// Index is the index of server instance, e.g. ForkServer.Index(), it is appended to the
+	// identifier as "hostname/index" if not zero.
+	Index int
+
+	// Version answers version.bind and version.server queries, these queries are refused if empty.
+	Version string
+
+	// DisableNSID disables the NSID option in responses.
+	DisableNSID bool
+
+	// DisableCHAOS disables the CHAOS queries, which are passed to the next handler.
+	DisableCHAOS bool
+
+	once sync.Once
+	id   string
+}
+
+// ID returns the server identifier, which is "hostname/index" or "hostname" if index is zero.
+func (id *Identity) ID() string {
+	id.once.Do(func() {
+		hostname := id.Hostname
+		if hostname == "" {
+			hostname, _ = os.Hostname()
+		}
+		id.id = hostname
+		if id.Index != 0 {
+			id.id += "/" + strconv.Itoa(id.Index)
+		}
+	})
+	return id.id
+}
+
+// IdentityMiddleware answers the server identification queries by id, and adds the NSID
+// option to the responses of requests which carry an empty NSID option.
+func IdentityMiddleware(id *Identity) Middleware {
+	return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+		if !id.DisableNSID {
+			if opt, ok := req.OPT(); ok {
+				if _, ok := opt.Option(EDNSOptionNSID); ok {
+					rw = &nsidResponseWriter{ResponseWriter: rw, nsid: id.ID()}
+				}
+			}
+		}
+
+		if !id.DisableCHAOS && req.Question.Class == ClassCHAOS && (req.Question.Type == TypeTXT || req.Question.Type == TypeANY) {
+			switch domain := b2s(req.Domain); {
+			case strings.EqualFold(domain, "id.server"), strings.EqualFold(domain, "hostname.bind"):
+				TXT(rw, req, 0, id.ID())
+				return
+			case strings.EqualFold(domain, "version.bind"), strings.EqualFold(domain, "version.server"):
+				if id.Version == "" {
+					Error(rw, req, RcodeRefused)
+				} else {
+					TXT(rw, req, 0, id.Version)
+				}
+				return
+			}
+		}
+
+		next.ServeDNSContext(ctx, rw, req)
+	})
+}
+
+// nsidResponseWriter adds the NSID option to the responses.
+type nsidResponseWriter struct {
+	ResponseWriter
+	nsid string
+}
+
+// Unwrap returns the wrapped ResponseWriter.
+func (rw *nsidResponseWriter) Unwrap() ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *nsidResponseWriter) Write(p []byte) (int, error) {
+	if len(p) < 12 {
+		return rw.ResponseWriter.Write(p)
+	}
+	if _, err := rw.ResponseWriter.Write(appendEDNSOption(nil, p, EDNSOptionNSID, []byte(rw.nsid))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
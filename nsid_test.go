@@ -0,0 +1,99 @@
+package fastdns
+
+import (
+	"testing"
+)
+
+func TestIdentityID(t *testing.T) {
+	if id := (&Identity{Hostname: "ns1", Index: 3}).ID(); id != "ns1/3" {
+		t.Errorf("Identity ID got=%s", id)
+	}
+	if id := (&Identity{Hostname: "ns1"}).ID(); id != "ns1" {
+		t.Errorf("Identity ID got=%s", id)
+	}
+	if id := (&Identity{}).ID(); id == "" {
+		t.Errorf("Identity ID shall default to hostname")
+	}
+}
+
+func TestIdentityMiddleware(t *testing.T) {
+	id := &Identity{Hostname: "ns1", Index: 2, Version: "fastdns"}
+	handler := Chain(&mockServerHandler{}, IdentityMiddleware(id))
+
+	var cases = []struct {
+		Domain string
+		Class  Class
+		Rcode  Rcode
+		TXT    string
+	}{
+		{"id.server", ClassCHAOS, RcodeNoError, "ns1/2"},
+		{"HOSTNAME.BIND", ClassCHAOS, RcodeNoError, "ns1/2"},
+		{"version.bind", ClassCHAOS, RcodeNoError, "fastdns"},
+		{"id.server", ClassINET, RcodeNoError, ""},
+	}
+
+	for _, c := range cases {
+		req := AcquireMessage()
+		req.Header.Flags = 0
+		req.SetRequestQuestion(c.Domain, TypeTXT, c.Class)
+		rw := &MemResponseWriter{}
+		handler.ServeDNS(rw, req)
+		ReleaseMessage(req)
+
+		resp := AcquireMessage()
+		if err := ParseMessage(resp, rw.Data, true); err != nil || resp.Rcode() != c.Rcode {
+			t.Errorf("IdentityMiddleware(%s %s) error: %+v raw=%x", c.Domain, c.Class, err, rw.Data)
+		}
+		var txt string
+		_ = resp.Walk(func(name []byte, typ Type, class Class, ttl uint32, data []byte) bool {
+			if typ == TypeTXT && class == ClassCHAOS {
+				txt = string(data[1:])
+			}
+			return true
+		})
+		if txt != c.TXT {
+			t.Errorf("IdentityMiddleware(%s %s) txt got=%#v want=%#v", c.Domain, c.Class, txt, c.TXT)
+		}
+		ReleaseMessage(resp)
+	}
+
+	// version.bind is refused without version
+	id = &Identity{Hostname: "ns1"}
+	handler = Chain(&mockServerHandler{}, IdentityMiddleware(id))
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("version.bind", TypeTXT, ClassCHAOS)
+	rw := &MemResponseWriter{}
+	handler.ServeDNS(rw, req)
+	if len(rw.Data) < 4 || Rcode(rw.Data[3]&0x0f) != RcodeRefused {
+		t.Errorf("IdentityMiddleware shall refuse version.bind, got=%x", rw.Data)
+	}
+}
+
+func TestIdentityMiddlewareNSID(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		id := &Identity{Hostname: "ns1", Index: 1, DisableNSID: disabled}
+		handler := Chain(&mockServerHandler{}, IdentityMiddleware(id))
+
+		req := mockEDNSMessage(AppendEDNSOption(nil, EDNSOptionNSID, nil))
+		_ = ParseMessage(req, req.Raw, false)
+		rw := &MemResponseWriter{}
+		handler.ServeDNS(rw, req)
+		ReleaseMessage(req)
+
+		resp := AcquireMessage()
+		_ = ParseMessage(resp, rw.Data, true)
+		opt, _ := resp.OPT()
+		nsid, ok := opt.Option(EDNSOptionNSID)
+		if disabled && ok {
+			t.Errorf("IdentityMiddleware shall not add NSID if disabled, got %x", rw.Data)
+		}
+		if !disabled && string(nsid) != "ns1/1" {
+			t.Errorf("IdentityMiddleware shall add NSID, got %q raw=%x", nsid, rw.Data)
+		}
+		if resp.Header.ANCount != 1 {
+			t.Errorf("IdentityMiddleware shall pass the request to handler, raw=%x", rw.Data)
+		}
+		ReleaseMessage(resp)
+	}
+}
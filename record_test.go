@@ -57,7 +57,7 @@ func TestAppendCNAMERecord(t *testing.T) {
 			300,
 		},
 		{
-			"c00c000500010000012c00090470687573026c7500c028000500010000012c000c02686b0470687573026c7500c040000100010000012c000401010101c040000100010000012c000408080808",
+			"c00c000500010000012c00090470687573026c7500c028000500010000012c000c02686b0470687573026c7500c03d000100010000012c000401010101c03d000100010000012c000408080808",
 			[]string{"phus.lu", "hk.phus.lu"},
 			[]netip.Addr{netip.AddrFrom4([4]byte{1, 1, 1, 1}), netip.AddrFrom4([4]byte{8, 8, 8, 8})},
 			300,
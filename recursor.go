@@ -0,0 +1,877 @@
+package fastdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRecursorLoop is returned when dns recursor exceeds the limits of queries or depth.
+	ErrRecursorLoop = errors.New("dns recursor exceeds the limits of queries or depth")
+	// ErrNoServers is returned when dns recursor has no reachable servers of a zone.
+	ErrNoServers = errors.New("dns recursor has no reachable servers of the zone")
+)
+
+const (
+	// recursorMaxQueries is the maximum number of upstream queries of a resolution.
+	recursorMaxQueries = 128
+	// recursorMaxDepth is the maximum depth of the CNAME/DNAME chains and the glueless NS resolutions.
+	recursorMaxDepth = 12
+	// recursorMaxTTL caps the TTL of cached records.
+	recursorMaxTTL = 86400
+	// recursorNegativeTTL is the TTL of negative responses without SOA, it also caps the negative TTL.
+	recursorNegativeTTL = 60
+	// recursorMaxClients is the maximum number of server clients, the least recently used one is evicted.
+	recursorMaxClients = 256
+)
+
+// rootHints is the IPv4 addresses of the root servers a to m.
+var rootHints = []netip.Addr{
+	netip.AddrFrom4([4]byte{198, 41, 0, 4}),
+	netip.AddrFrom4([4]byte{170, 247, 170, 2}),
+	netip.AddrFrom4([4]byte{192, 33, 4, 12}),
+	netip.AddrFrom4([4]byte{199, 7, 91, 13}),
+	netip.AddrFrom4([4]byte{192, 203, 230, 10}),
+	netip.AddrFrom4([4]byte{192, 5, 5, 241}),
+	netip.AddrFrom4([4]byte{192, 112, 36, 4}),
+	netip.AddrFrom4([4]byte{198, 97, 190, 53}),
+	netip.AddrFrom4([4]byte{192, 36, 148, 17}),
+	netip.AddrFrom4([4]byte{192, 58, 128, 30}),
+	netip.AddrFrom4([4]byte{193, 0, 14, 129}),
+	netip.AddrFrom4([4]byte{199, 7, 83, 42}),
+	netip.AddrFrom4([4]byte{202, 12, 27, 33}),
+}
+
+// Recursor is an iterative recursive resolver which starts from the root hints, it follows the referrals,
+// resolves the glueless NS names, follows the CNAME/DNAME chains across zones and caches the records.
+//
+// Recursor is a Handler which serves the recursive queries, and an Exchanger which can be used as a client,
+// e.g. NewResolver(recursor). The cache is shared by all the queries of recursor.
+//
+// If DNSSEC is enabled, Recursor validates the answers from the trust anchors of root zone, the Bogus answers
+// are replied with SERVFAIL, and the AD bit is set for the Secure answers if the query has the AD or DO bit.
+type Recursor struct {
+	// Roots is the addresses of root servers, use the built-in root hints if empty.
+	Roots []netip.Addr
+
+	// ReadTimeout is the maximum duration for reading the response of servers, use 2s if empty.
+	ReadTimeout time.Duration
+
+	// DisableQNAMEMinimisation disables the QNAME minimisation (RFC 9156), which sends the
+	// full query name to the root and TLD servers.
+	DisableQNAMEMinimisation bool
+
+	// MaxCacheEntries limits the entries of cache, use 10000 if empty.
+	MaxCacheEntries int
+
+	// DNSSEC enables the DNSSEC validation (RFC 4035), the queries to servers are sent with the DO bit.
+	DNSSEC bool
+
+	// TrustAnchors is the DS records of root zone, use the built-in root KSKs if empty.
+	TrustAnchors []DS
+
+	// remap maps the server addresses for testing.
+	remap map[netip.Addr]netip.AddrPort
+
+	mu      sync.Mutex
+	clients map[netip.AddrPort]*recursorClient
+	used    int64
+	cache   map[recursorKey]*recursorEntry
+	zones   map[string]*recursorZone
+}
+
+// recursorRR is a resource record with the lowercase owner name and the uncompressed data.
+type recursorRR struct {
+	Name  string
+	Type  Type
+	Class Class
+	TTL   uint32
+	Data  []byte
+}
+
+type recursorClient struct {
+	*Client
+	used int64
+}
+
+type recursorKey struct {
+	name string
+	typ  Type
+}
+
+type recursorEntry struct {
+	rcode    Rcode
+	records  []recursorRR
+	security Security
+	expires  int64
+}
+
+// recursorState is the state of a resolution.
+type recursorState struct {
+	ctx     context.Context
+	queries int
+}
+
+// ServeDNS implements Handler.
+func (r *Recursor) ServeDNS(rw ResponseWriter, req *Message) {
+	r.ServeDNSContext(context.Background(), rw, req)
+}
+
+// ServeDNSContext implements ContextHandler.
+func (r *Recursor) ServeDNSContext(ctx context.Context, rw ResponseWriter, req *Message) {
+	r.respond(ctx, req)
+	_, _ = rw.Write(req.Raw)
+}
+
+// Exchange executes a recursive resolution of req, returning a Response for the provided Request.
+func (r *Recursor) Exchange(req, resp *Message) error {
+	return r.ExchangeContext(context.Background(), req, resp)
+}
+
+// ExchangeContext executes a recursive resolution of req with ctx, returning a Response for the provided Request.
+func (r *Recursor) ExchangeContext(ctx context.Context, req, resp *Message) error {
+	_, err := r.ExchangeSecurity(ctx, req, resp)
+	return err
+}
+
+// ExchangeSecurity is ExchangeContext which also returns the DNSSEC validation state of the answers,
+// it is always SecurityIndeterminate if DNSSEC is disabled.
+func (r *Recursor) ExchangeSecurity(ctx context.Context, req, resp *Message) (Security, error) {
+	if err := ParseMessage(resp, req.Raw, true); err != nil {
+		return SecurityIndeterminate, err
+	}
+	security := r.respond(ctx, resp)
+	return security, ParseMessage(resp, resp.Raw, false)
+}
+
+// respond resolves the question of msg and turns msg to the response, the question section is kept.
+func (r *Recursor) respond(ctx context.Context, msg *Message) Security {
+	opt, edns := msg.OPT()
+	do := edns && opt.Flags&0x8000 != 0
+	ad := msg.Header.Flags&0b0000000000100000 != 0
+
+	s := &recursorState{ctx: ctx}
+	rcode, records, security, err := r.resolve(s, strings.ToLower(string(msg.Domain)), msg.Question.Type, 0)
+	if err != nil {
+		rcode, records = RcodeServFail, nil
+	}
+
+	msg.SetResponseHeader(RcodeNoError, uint16(len(records)))
+	// RCODE and RA = 1, AD = 0
+	msg.Header.Flags &^= 0b0000000000100000
+	msg.Header.Flags |= Flags(rcode&0x0f) | 0b0000000010000000
+	if security == SecuritySecure && (do || ad) {
+		// AD = 1, see RFC 6840 Section 5.8
+		msg.Header.Flags |= 0b0000000000100000
+	}
+	msg.Raw[2], msg.Raw[3] = byte(msg.Header.Flags>>8), byte(msg.Header.Flags)
+	for _, rr := range records {
+		msg.Raw = appendRR(msg.Raw, rr)
+	}
+
+	if edns {
+		msg.SetEDNS(1232, do)
+		if security == SecurityBogus {
+			msg.AddEDNSOption(EDNSOptionExtendedError, AppendExtendedError(nil, ExtendedErrorDNSSECBogus, ""))
+		}
+	}
+
+	return security
+}
+
+// resolve resolves name of typ iteratively, it returns the rcode, the answers including the CNAME/DNAME chain
+// and the DNSSEC validation state of answers. The Bogus answers are returned as SERVFAIL.
+func (r *Recursor) resolve(s *recursorState, name string, typ Type, depth int) (Rcode, []recursorRR, Security, error) {
+	if depth > recursorMaxDepth {
+		return RcodeServFail, nil, SecurityIndeterminate, ErrRecursorLoop
+	}
+
+	if e := r.get(name, typ); e != nil {
+		return e.rcode, e.records, e.security, nil
+	}
+	if typ != TypeCNAME {
+		if e := r.get(name, TypeCNAME); e != nil && len(e.records) != 0 {
+			return r.follow(s, e.security, e.records, rdataName(e.records[0]), typ, depth)
+		}
+	}
+
+	zone, servers, z := r.closest(s, name, depth)
+	if z.security == SecurityBogus {
+		return RcodeServFail, nil, SecurityBogus, nil
+	}
+
+	// the number of labels of the minimised query name
+	n := countLabels(zone) + 1
+	if r.DisableQNAMEMinimisation {
+		n = countLabels(name)
+	}
+
+	for {
+		qname, qtype := name, typ
+		if m := countLabels(name); n < m {
+			// RFC 9156 suggests QTYPE A for the minimised queries
+			qname, qtype = ancestorName(name, n), TypeA
+		}
+
+		rcode, answers, authority, additional, err := r.query(s, servers, qname, qtype)
+		if err != nil && qname != name && err == ErrNoServers {
+			// the servers may be broken with the minimised queries, let's send the full name
+			n = countLabels(name)
+			continue
+		}
+		if err != nil {
+			return RcodeServFail, nil, SecurityIndeterminate, err
+		}
+
+		// DNAME redirects the names under its owner
+		for _, rr := range answers {
+			if rr.Type == TypeDNAME && rr.Name != name && isSubdomain(name, rr.Name) && isSubdomain(rr.Name, zone) {
+				security := validateAnswer(z, []recursorRR{rr}, answers, authority, zone)
+				if security == SecurityBogus {
+					return RcodeServFail, nil, SecurityBogus, nil
+				}
+				target := strings.TrimSuffix(name[:len(name)-len(rr.Name)], ".")
+				if t := rdataName(rr); t != "" {
+					target += "." + t
+				}
+				cname := recursorRR{Name: name, Type: TypeCNAME, Class: ClassINET, TTL: rr.TTL, Data: encodeName(nil, target)}
+				return r.follow(s, security, []recursorRR{rr, cname}, target, typ, depth)
+			}
+		}
+
+		// referral to the child zone
+		if cut, nss := referral(rcode, answers, authority, zone, name); cut != "" {
+			r.storeReferral(cut, nss, additional, zone)
+			if r.DNSSEC {
+				if z = r.delegate(s, z, zone, cut, authority, depth); z.security == SecurityBogus {
+					return RcodeServFail, nil, SecurityBogus, nil
+				}
+			}
+			if zone, servers = cut, r.addrs(s, cut, depth); len(servers) == 0 {
+				return RcodeServFail, nil, SecurityIndeterminate, ErrNoServers
+			}
+			if !r.DisableQNAMEMinimisation {
+				n = countLabels(zone) + 1
+			}
+			continue
+		}
+
+		if qname != name {
+			if rcode == RcodeNXDomain {
+				// there is nothing under the nonexistent name, see RFC 8020
+				security := validateDenial(z, authority, zone, qname, qtype, true)
+				return r.negative(name, typ, RcodeNXDomain, authority, security)
+			}
+			// no zone cut at qname, let's go deeper
+			n++
+			continue
+		}
+
+		if rcode == RcodeNXDomain {
+			security := validateDenial(z, authority, zone, name, typ, true)
+			return r.negative(name, typ, RcodeNXDomain, authority, security)
+		}
+
+		var records []recursorRR
+		for _, rr := range answers {
+			if rr.Name == name && (rr.Type == typ || typ == TypeANY) && (rr.Type != TypeRRSIG || typ == TypeRRSIG) {
+				records = append(records, rr)
+			}
+		}
+		if len(records) != 0 {
+			security := SecurityIndeterminate
+			if typ != TypeRRSIG {
+				security = validateAnswer(z, records, answers, authority, zone)
+			}
+			if security == SecurityBogus {
+				return RcodeServFail, nil, SecurityBogus, nil
+			}
+			r.set(name, typ, RcodeNoError, records, minTTL(records), security)
+			return RcodeNoError, records, security, nil
+		}
+
+		for _, rr := range answers {
+			if rr.Name == name && rr.Type == TypeCNAME {
+				chain := []recursorRR{rr}
+				security := validateAnswer(z, chain, answers, authority, zone)
+				if security == SecurityBogus {
+					return RcodeServFail, nil, SecurityBogus, nil
+				}
+				r.set(name, TypeCNAME, RcodeNoError, chain, rr.TTL, security)
+				return r.follow(s, security, chain, rdataName(rr), typ, depth)
+			}
+		}
+
+		// NODATA
+		security := validateDenial(z, authority, zone, name, typ, false)
+		return r.negative(name, typ, RcodeNoError, authority, security)
+	}
+}
+
+// negative caches and returns the NXDOMAIN or NODATA response of name and typ.
+func (r *Recursor) negative(name string, typ Type, rcode Rcode, authority []recursorRR, security Security) (Rcode, []recursorRR, Security, error) {
+	if security == SecurityBogus {
+		return RcodeServFail, nil, SecurityBogus, nil
+	}
+	r.set(name, typ, rcode, nil, negativeTTL(authority), security)
+	return rcode, nil, security, nil
+}
+
+// follow resolves the target of chain, and returns the answers prefixed by chain.
+func (r *Recursor) follow(s *recursorState, security Security, chain []recursorRR, target string, typ Type, depth int) (Rcode, []recursorRR, Security, error) {
+	if target == "" {
+		return RcodeServFail, nil, SecurityIndeterminate, ErrInvalidAnswer
+	}
+	rcode, records, next, err := r.resolve(s, target, typ, depth+1)
+	if err != nil || next == SecurityBogus {
+		return rcode, nil, next, err
+	}
+	return rcode, append(append([]recursorRR(nil), chain...), records...), security.combine(next), nil
+}
+
+// closest returns the closest known zone of name, its server addresses and DNSSEC state.
+func (r *Recursor) closest(s *recursorState, name string, depth int) (zone string, servers []netip.AddrPort, z *recursorZone) {
+	for zone = name; zone != ""; zone = parentName(zone) {
+		if e := r.get(zone, TypeNS); e != nil && len(e.records) != 0 {
+			if z = r.zone(zone); z == nil {
+				// the DNSSEC state of zone is expired, let's validate it again from the ancestors
+				continue
+			}
+			if servers = r.addrs(s, zone, depth); len(servers) != 0 {
+				return zone, servers, z
+			}
+		}
+	}
+
+	roots := r.Roots
+	if len(roots) == 0 {
+		roots = rootHints
+	}
+	for _, ip := range roots {
+		servers = append(servers, r.addrport(ip))
+	}
+
+	if z = r.zone(""); z == nil {
+		z = r.rootZone(s, servers)
+	}
+
+	return "", servers, z
+}
+
+// addrs returns the server addresses of zone from cache, the glueless NS names are resolved.
+func (r *Recursor) addrs(s *recursorState, zone string, depth int) (servers []netip.AddrPort) {
+	e := r.get(zone, TypeNS)
+	if e == nil {
+		return nil
+	}
+
+	var glueless []string
+	for _, ns := range e.records {
+		host := rdataName(ns)
+		found := false
+		for _, typ := range []Type{TypeA, TypeAAAA} {
+			if a := r.get(host, typ); a != nil {
+				for _, rr := range a.records {
+					if ip, ok := netip.AddrFromSlice(rr.Data); ok && rr.Type == typ {
+						servers = append(servers, r.addrport(ip))
+						found = true
+					}
+				}
+			}
+		}
+		if !found {
+			glueless = append(glueless, host)
+		}
+	}
+
+	if len(servers) != 0 {
+		return servers
+	}
+
+	for _, host := range glueless {
+		rcode, records, _, err := r.resolve(s, host, TypeA, depth+1)
+		if err != nil || rcode != RcodeNoError {
+			continue
+		}
+		for _, rr := range records {
+			if ip, ok := netip.AddrFromSlice(rr.Data); ok && rr.Type == TypeA {
+				servers = append(servers, r.addrport(ip))
+			}
+		}
+		if len(servers) != 0 {
+			break
+		}
+	}
+
+	return servers
+}
+
+func (r *Recursor) addrport(ip netip.Addr) netip.AddrPort {
+	if addr, ok := r.remap[ip]; ok {
+		return addr
+	}
+	return netip.AddrPortFrom(ip, 53)
+}
+
+// storeReferral caches the NS records of cut and the in-bailiwick glue records of zone.
+func (r *Recursor) storeReferral(cut string, nss []recursorRR, additional []recursorRR, zone string) {
+	r.set(cut, TypeNS, RcodeNoError, nss, minTTL(nss), SecurityIndeterminate)
+
+	glues := make(map[recursorKey][]recursorRR)
+	for _, rr := range additional {
+		if (rr.Type != TypeA && rr.Type != TypeAAAA) || !isSubdomain(rr.Name, zone) {
+			continue
+		}
+		for _, ns := range nss {
+			if rdataName(ns) == rr.Name {
+				key := recursorKey{rr.Name, rr.Type}
+				glues[key] = append(glues[key], rr)
+				break
+			}
+		}
+	}
+	for key, records := range glues {
+		r.set(key.name, key.typ, RcodeNoError, records, minTTL(records), SecurityIndeterminate)
+	}
+}
+
+// query sends the non-recursive query of name to the servers in turn, and returns the parsed response
+// of NOERROR or NXDOMAIN.
+func (r *Recursor) query(s *recursorState, servers []netip.AddrPort, name string, typ Type) (rcode Rcode, answers, authority, additional []recursorRR, err error) {
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+
+	req.Header.Flags = 0
+	req.SetRequestQuestion(name, typ, ClassINET)
+	// RD = 0
+	req.Header.Flags &^= 0b0000000100000000
+	req.Raw[2] = byte(req.Header.Flags >> 8)
+	// the cryptographically random ID against the off-path spoofing
+	req.Header.ID = randUint16()
+	req.Raw[0], req.Raw[1] = byte(req.Header.ID>>8), byte(req.Header.ID)
+	req.SetEDNS(1232, r.DNSSEC)
+	question := req.Raw[12 : 12+len(req.Question.Name)+4]
+
+	err = ErrNoServers
+	start := int(fastrandn(uint32(len(servers))))
+	for i := range servers {
+		if s.queries++; s.queries > recursorMaxQueries {
+			return RcodeServFail, nil, nil, nil, ErrRecursorLoop
+		}
+		if err = s.ctx.Err(); err != nil {
+			return RcodeServFail, nil, nil, nil, err
+		}
+
+		addr := servers[(start+i)%len(servers)]
+		err = r.client(addr).ExchangeContext(s.ctx, req, resp)
+		if err == nil && resp.Header.Flags.TC() != 0 {
+			// retry the truncated responses over TCP, e.g. the large DNSKEY and NSEC3 answers
+			err = r.exchangeTCP(s.ctx, addr, req, resp)
+		}
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return RcodeServFail, nil, nil, nil, s.ctx.Err()
+			}
+			// the error responses without the question section are not trusted, try the next server
+			continue
+		}
+		// drop the mismatched responses, which shall not be cached
+		if resp.Header.ID != req.Header.ID || resp.Header.QDCount != 1 || len(resp.Raw) < 12+len(question) || !bytes.EqualFold(resp.Raw[12:12+len(question)], question) {
+			err = ErrInvalidHeader
+			continue
+		}
+		if resp.Header.Flags.TC() != 0 {
+			continue
+		}
+
+		rcode = resp.Header.Flags.Rcode()
+		if rcode != RcodeNoError && rcode != RcodeNXDomain {
+			continue
+		}
+
+		answers, authority, additional = parseRRs(resp)
+		return rcode, answers, authority, additional, nil
+	}
+
+	if err == nil {
+		err = ErrNoServers
+	}
+	return RcodeServFail, nil, nil, nil, err
+}
+
+// client returns the client of server addr, the idle sockets of the least recently used client are closed
+// if there are too many clients.
+func (r *Recursor) client(addr netip.AddrPort) *Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.used++
+	if client := r.clients[addr]; client != nil {
+		client.used = r.used
+		return client.Client
+	}
+
+	if r.clients == nil {
+		r.clients = make(map[netip.AddrPort]*recursorClient)
+	}
+	if len(r.clients) >= recursorMaxClients {
+		var lru netip.AddrPort
+		var used int64
+		for key, client := range r.clients {
+			if used == 0 || client.used < used {
+				lru, used = key, client.used
+			}
+		}
+		r.clients[lru].closeIdleConns()
+		delete(r.clients, lru)
+	}
+
+	client := &recursorClient{
+		Client: &Client{
+			AddrPort:     addr,
+			ReadTimeout:  r.readTimeout(),
+			MaxIdleConns: 4,
+		},
+		used: r.used,
+	}
+	r.clients[addr] = client
+
+	return client.Client
+}
+
+func (r *Recursor) readTimeout() time.Duration {
+	if r.ReadTimeout <= 0 {
+		return 2 * time.Second
+	}
+	return r.ReadTimeout
+}
+
+// exchangeTCP exchanges req with the server addr over TCP, see RFC 7766.
+func (r *Recursor) exchangeTCP(ctx context.Context, addr netip.AddrPort, req, resp *Message) error {
+	ctx, cancel := context.WithTimeout(ctx, r.readTimeout())
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	go func() {
+		// abort the exchange once ctx is done
+		<-ctx.Done()
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	}()
+
+	msg := AcquireMessage()
+	defer ReleaseMessage(msg)
+	msg.Raw = append(append(msg.Raw[:0], byte(len(req.Raw)>>8), byte(len(req.Raw))), req.Raw...)
+	if _, err = conn.Write(msg.Raw); err != nil {
+		return err
+	}
+
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return err
+	}
+	n := int(length[0])<<8 | int(length[1])
+	if cap(resp.Raw) < n {
+		resp.Raw = make([]byte, n)
+	}
+	resp.Raw = resp.Raw[:n]
+	if _, err = io.ReadFull(conn, resp.Raw); err != nil {
+		return err
+	}
+
+	return ParseMessage(resp, resp.Raw, false)
+}
+
+// get returns the unexpired cache entry of name and typ, the TTLs of records are decreased.
+func (r *Recursor) get(name string, typ Type) *recursorEntry {
+	r.mu.Lock()
+	e := r.cache[recursorKey{name, typ}]
+	r.mu.Unlock()
+
+	now := time.Now().Unix()
+	if e == nil || e.expires <= now {
+		return nil
+	}
+
+	records := make([]recursorRR, len(e.records))
+	for i, rr := range e.records {
+		rr.TTL = uint32(e.expires - now)
+		records[i] = rr
+	}
+
+	return &recursorEntry{rcode: e.rcode, records: records, security: e.security, expires: e.expires}
+}
+
+func (r *Recursor) set(name string, typ Type, rcode Rcode, records []recursorRR, ttl uint32, security Security) {
+	if ttl == 0 {
+		return
+	}
+	if ttl > recursorMaxTTL {
+		ttl = recursorMaxTTL
+	}
+
+	max := r.MaxCacheEntries
+	if max <= 0 {
+		max = 10000
+	}
+
+	now := time.Now().Unix()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cache == nil {
+		r.cache = make(map[recursorKey]*recursorEntry)
+	}
+	if len(r.cache) >= max {
+		// evict the expired entries, or the random ones if the cache is still full
+		for key, e := range r.cache {
+			if e.expires <= now || len(r.cache) >= max {
+				delete(r.cache, key)
+			}
+		}
+	}
+	r.cache[recursorKey{name, typ}] = &recursorEntry{
+		rcode:    rcode,
+		records:  records,
+		security: security,
+		expires:  now + int64(ttl),
+	}
+}
+
+// referral returns the child zone cut of zone and its NS records if the response is a referral for name.
+func referral(rcode Rcode, answers, authority []recursorRR, zone, name string) (cut string, nss []recursorRR) {
+	if rcode != RcodeNoError || len(answers) != 0 {
+		return "", nil
+	}
+	for _, rr := range authority {
+		if rr.Type != TypeNS || rr.Name == zone || !isSubdomain(rr.Name, zone) || !isSubdomain(name, rr.Name) {
+			continue
+		}
+		if cut == "" {
+			cut = rr.Name
+		}
+		if rr.Name == cut {
+			nss = append(nss, rr)
+		}
+	}
+	return cut, nss
+}
+
+// negativeTTL returns the TTL of negative responses from the SOA record of authority, see RFC 2308.
+func negativeTTL(authority []recursorRR) uint32 {
+	for _, rr := range authority {
+		if rr.Type == TypeSOA && len(rr.Data) >= 20 {
+			d := rr.Data[len(rr.Data)-4:]
+			ttl := uint32(d[0])<<24 | uint32(d[1])<<16 | uint32(d[2])<<8 | uint32(d[3])
+			if rr.TTL < ttl {
+				ttl = rr.TTL
+			}
+			if ttl > recursorNegativeTTL*60 {
+				ttl = recursorNegativeTTL * 60
+			}
+			return ttl
+		}
+	}
+	return recursorNegativeTTL
+}
+
+func minTTL(records []recursorRR) uint32 {
+	var ttl uint32
+	for i, rr := range records {
+		if i == 0 || rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+	}
+	return ttl
+}
+
+// parseRRs parses the answer, authority and additional sections of msg, it stops on malformed records.
+func parseRRs(msg *Message) (answers, authority, additional []recursorRR) {
+	payload := msg.Raw
+	offset := skipQuestions(payload, int(msg.Header.QDCount))
+	sections := []*[]recursorRR{&answers, &authority, &additional}
+	counts := []uint16{msg.Header.ANCount, msg.Header.NSCount, msg.Header.ARCount}
+	for i, section := range sections {
+		for j := 0; j < int(counts[i]) && offset >= 0; j++ {
+			rr, end := parseRR(payload, offset)
+			if end < 0 {
+				return
+			}
+			if rr.Type != TypeOPT {
+				*section = append(*section, rr)
+			}
+			offset = end
+		}
+	}
+	return
+}
+
+// parseRR parses the resource record at offset of payload, it returns the offset after it or -1 if it is malformed.
+func parseRR(payload []byte, offset int) (rr recursorRR, end int) {
+	name, n := readName(payload, offset)
+	if n < 0 || n+10 > len(payload) {
+		return rr, -1
+	}
+	end = n + 10 + (int(payload[n+8])<<8 | int(payload[n+9]))
+	if end > len(payload) {
+		return rr, -1
+	}
+
+	rr.Name = strings.ToLower(name)
+	rr.Type = Type(payload[n])<<8 | Type(payload[n+1])
+	rr.Class = Class(payload[n+2])<<8 | Class(payload[n+3])
+	rr.TTL = uint32(payload[n+4])<<24 | uint32(payload[n+5])<<16 | uint32(payload[n+6])<<8 | uint32(payload[n+7])
+
+	// decompress the names of data
+	data := n + 10
+	prefix, names, suffix, ok := rdataNames(rr.Type)
+	if !ok {
+		rr.Data = append([]byte(nil), payload[data:end]...)
+		return rr, end
+	}
+
+	if data+prefix > end {
+		return rr, -1
+	}
+	rr.Data = append([]byte(nil), payload[data:data+prefix]...)
+	offset = data + prefix
+	for i := 0; i < names; i++ {
+		if name, offset = readName(payload, offset); offset < 0 || offset > end {
+			return rr, -1
+		}
+		rr.Data = encodeName(rr.Data, name)
+	}
+	if offset+suffix != end {
+		return rr, -1
+	}
+	rr.Data = append(rr.Data, payload[offset:end]...)
+
+	return rr, end
+}
+
+// rdataNames returns the layout of the data of types which have the compressible names, that is the
+// length of prefix, the number of names and the length of suffix.
+func rdataNames(typ Type) (prefix, names, suffix int, ok bool) {
+	switch typ {
+	case TypeNS, TypeCNAME, TypeDNAME, TypePTR:
+		return 0, 1, 0, true
+	case TypeMX:
+		return 2, 1, 0, true
+	case TypeSRV:
+		return 6, 1, 0, true
+	case TypeSOA:
+		return 0, 2, 20, true
+	}
+	return 0, 0, 0, false
+}
+
+// readName returns the dotted name at offset of payload and the offset after it, or -1 if it is malformed.
+func readName(payload []byte, offset int) (string, int) {
+	var b []byte
+	end := -1
+	for hops := 0; hops < 128; hops++ {
+		if offset >= len(payload) {
+			return "", -1
+		}
+		n := int(payload[offset])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return string(b), end
+		case n&0b11000000 == 0b11000000:
+			if offset+1 >= len(payload) {
+				return "", -1
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = (n&0b00111111)<<8 | int(payload[offset+1])
+		case n&0b11000000 != 0:
+			return "", -1
+		default:
+			if offset+1+n > len(payload) {
+				return "", -1
+			}
+			if len(b) != 0 {
+				b = append(b, '.')
+			}
+			b = append(b, payload[offset+1:offset+1+n]...)
+			offset += 1 + n
+		}
+	}
+	return "", -1
+}
+
+// rdataName returns the lowercase target name of NS, CNAME, DNAME and PTR records.
+func rdataName(rr recursorRR) string {
+	name, end := readName(rr.Data, 0)
+	if end < 0 {
+		return ""
+	}
+	return strings.ToLower(name)
+}
+
+// appendRR appends the uncompressed resource record to dst.
+func appendRR(dst []byte, rr recursorRR) []byte {
+	dst = encodeName(dst, rr.Name)
+	return append(append(dst,
+		byte(rr.Type>>8), byte(rr.Type),
+		byte(rr.Class>>8), byte(rr.Class),
+		byte(rr.TTL>>24), byte(rr.TTL>>16), byte(rr.TTL>>8), byte(rr.TTL),
+		byte(len(rr.Data)>>8), byte(len(rr.Data)),
+	), rr.Data...)
+}
+
+// encodeName is EncodeDomain with the support of root name.
+func encodeName(dst []byte, name string) []byte {
+	if name == "" {
+		return append(dst, 0)
+	}
+	return EncodeDomain(dst, name)
+}
+
+// isSubdomain reports whether child is equal to or under parent, the root name is empty.
+func isSubdomain(child, parent string) bool {
+	return parent == "" || child == parent ||
+		(len(child) > len(parent) && child[len(child)-len(parent)-1] == '.' && child[len(child)-len(parent):] == parent)
+}
+
+// parentName returns the parent of name, the parent of top level domains is the root name.
+func parentName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// ancestorName returns the ancestor of name which has n labels.
+func ancestorName(name string, n int) string {
+	for m := countLabels(name); m > n; m-- {
+		name = parentName(name)
+	}
+	return name
+}
+
+func countLabels(name string) int {
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, ".") + 1
+}
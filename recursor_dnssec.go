@@ -0,0 +1,443 @@
+package fastdns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// nsec3MaxIterations is the maximum NSEC3 iterations of secure denial of existence, the proofs with more
+// iterations are treated as insecure, see RFC 9276.
+const nsec3MaxIterations = 150
+
+// rootAnchors is the DS records of the root KSK-2017 and KSK-2024.
+var rootAnchors = []DS{
+	{KeyTag: 20326, Algorithm: AlgorithmRSASHA256, DigestType: DigestSHA256, Digest: mustDecodeHex("e06d44b80b8f1d39a95c0b0d7c65d08458e880409bbf683457104237c7f8ec8d")},
+	{KeyTag: 38696, Algorithm: AlgorithmRSASHA256, DigestType: DigestSHA256, Digest: mustDecodeHex("683d2d0acb8c9b712a1948b27f741219298d0a450d612c483af444a4c0fb2b16")},
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// recursorZone is the validated DNSSEC state of a zone and its zone keys.
+type recursorZone struct {
+	security Security
+	keys     []DNSKEY
+	expires  int64
+}
+
+// zone returns the unexpired DNSSEC state of zone, it returns an indeterminate state if DNSSEC is disabled.
+func (r *Recursor) zone(zone string) *recursorZone {
+	if !r.DNSSEC {
+		return &recursorZone{security: SecurityIndeterminate}
+	}
+
+	r.mu.Lock()
+	z := r.zones[zone]
+	r.mu.Unlock()
+
+	if z == nil || z.expires <= time.Now().Unix() {
+		return nil
+	}
+	return z
+}
+
+func (r *Recursor) setZone(zone string, z *recursorZone, ttl uint32) {
+	if ttl > recursorMaxTTL {
+		ttl = recursorMaxTTL
+	}
+	z.expires = time.Now().Unix() + int64(ttl)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.zones == nil {
+		r.zones = make(map[string]*recursorZone)
+	}
+	r.zones[zone] = z
+}
+
+// rootZone returns the DNSSEC state of root zone, which is validated by the trust anchors.
+func (r *Recursor) rootZone(s *recursorState, servers []netip.AddrPort) *recursorZone {
+	if z := r.zone(""); z != nil {
+		return z
+	}
+	anchors := r.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = rootAnchors
+	}
+	return r.trust(s, "", servers, anchors)
+}
+
+// delegate validates the delegation from zone to the child zone cut by the DS records or the denial of
+// existence of DS records in authority, and returns the DNSSEC state of cut.
+func (r *Recursor) delegate(s *recursorState, parent *recursorZone, zone, cut string, authority []recursorRR, depth int) *recursorZone {
+	ttl := minTTL(rrset(authority, cut, TypeNS))
+	if parent.security != SecuritySecure {
+		z := &recursorZone{security: parent.security}
+		r.setZone(cut, z, ttl)
+		return z
+	}
+
+	now := time.Now()
+	records := rrset(authority, cut, TypeDS)
+	if len(records) == 0 {
+		// the insecure delegation is proved by the NSEC/NSEC3 records of parent zone
+		if _, err := verifyDenial(authority, parent.keys, zone, cut, TypeDS, false, now); err != nil {
+			z := &recursorZone{security: SecurityBogus}
+			r.setZone(cut, z, recursorNegativeTTL)
+			return z
+		}
+		z := &recursorZone{security: SecurityInsecure}
+		r.setZone(cut, z, ttl)
+		return z
+	}
+
+	if _, err := verifyRRset(records, authority, parent.keys, zone, now); err != nil {
+		z := &recursorZone{security: SecurityBogus}
+		r.setZone(cut, z, recursorNegativeTTL)
+		return z
+	}
+
+	var dss []DS
+	for _, rr := range records {
+		if ds, err := ParseDS(rr.Data); err == nil {
+			dss = append(dss, ds)
+		}
+	}
+
+	return r.trust(s, cut, r.addrs(s, cut, depth), dss)
+}
+
+// trust queries the DNSKEY RRset of zone, and validates it with the DS records of zone.
+func (r *Recursor) trust(s *recursorState, zone string, servers []netip.AddrPort, dss []DS) *recursorZone {
+	supported := false
+	for _, ds := range dss {
+		if _, ok := ds.Algorithm.hash(); ok && (ds.DigestType == DigestSHA1 || ds.DigestType == DigestSHA256 || ds.DigestType == DigestSHA384) {
+			supported = true
+		}
+	}
+	if !supported {
+		// the zone is insecure if there are no supported algorithms, see RFC 4035 Section 5.2
+		z := &recursorZone{security: SecurityInsecure}
+		r.setZone(zone, z, recursorNegativeTTL)
+		return z
+	}
+
+	z := &recursorZone{security: SecurityBogus}
+	ttl := uint32(recursorNegativeTTL)
+
+	rcode, answers, _, _, err := r.query(s, servers, zone, TypeDNSKEY)
+	records := rrset(answers, zone, TypeDNSKEY)
+	if err != nil || rcode != RcodeNoError || len(records) == 0 {
+		r.setZone(zone, z, ttl)
+		return z
+	}
+
+	var keys []DNSKEY
+	for _, rr := range records {
+		if key, err := ParseDNSKEY(rr.Data); err == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	now := time.Now()
+	for _, ds := range dss {
+		for _, key := range keys {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if digest, err := dsDigest(zone, key, ds.DigestType); err != nil || !bytes.Equal(digest, ds.Digest) {
+				continue
+			}
+			if _, err := verifyRRset(records, answers, []DNSKEY{key}, zone, now); err == nil {
+				z = &recursorZone{security: SecuritySecure, keys: keys}
+				ttl = minTTL(records)
+				r.setZone(zone, z, ttl)
+				return z
+			}
+		}
+	}
+
+	r.setZone(zone, z, ttl)
+	return z
+}
+
+// validateAnswer validates the RRsets of records in answers which are signed by zone, the wildcard expansions
+// are proved by the NSEC/NSEC3 records in authority.
+func validateAnswer(z *recursorZone, records, answers, authority []recursorRR, zone string) Security {
+	if z.security != SecuritySecure {
+		return z.security
+	}
+
+	now := time.Now()
+	security := SecuritySecure
+	for i, rr := range records {
+		if i > 0 && rr.Name == records[i-1].Name && rr.Type == records[i-1].Type {
+			continue
+		}
+		labels, err := verifyRRset(rrset(records, rr.Name, rr.Type), answers, z.keys, zone, now)
+		if err != nil {
+			return SecurityBogus
+		}
+		if n := countLabels(rr.Name); labels < n && !(strings.HasPrefix(rr.Name, "*.") && labels == n-1) {
+			// the wildcard expansion, the next closer name must not exist
+			insecure, err := verifyWildcard(authority, z.keys, zone, rr.Name, labels, now)
+			if err != nil {
+				return SecurityBogus
+			}
+			if insecure {
+				security = SecurityInsecure
+			}
+		}
+	}
+
+	return security
+}
+
+// validateDenial validates the NXDOMAIN or NODATA response of name and typ by the NSEC/NSEC3 records in authority.
+func validateDenial(z *recursorZone, authority []recursorRR, zone, name string, typ Type, nxdomain bool) Security {
+	if z.security != SecuritySecure {
+		return z.security
+	}
+
+	insecure, err := verifyDenial(authority, z.keys, zone, name, typ, nxdomain, time.Now())
+	switch {
+	case err != nil:
+		return SecurityBogus
+	case insecure:
+		return SecurityInsecure
+	}
+	return SecuritySecure
+}
+
+// rrset returns the records of name and typ in section.
+func rrset(section []recursorRR, name string, typ Type) (records []recursorRR) {
+	for _, rr := range section {
+		if rr.Name == name && rr.Type == typ {
+			records = append(records, rr)
+		}
+	}
+	return
+}
+
+// verifyRRset verifies the RRset by the RRSIG records of signer in section, and returns the labels of
+// the valid signature.
+func verifyRRset(rrs, section []recursorRR, keys []DNSKEY, signer string, now time.Time) (int, error) {
+	if len(rrs) == 0 || !isSubdomain(rrs[0].Name, signer) {
+		return 0, ErrBogusSignature
+	}
+
+	for _, rr := range section {
+		if rr.Type != TypeRRSIG || rr.Name != rrs[0].Name {
+			continue
+		}
+		sig, err := ParseRRSIG(rr.Data)
+		if err != nil || sig.TypeCovered != rrs[0].Type || strings.ToLower(sig.SignerName) != signer || int(sig.Labels) > countLabels(rr.Name) {
+			continue
+		}
+		for _, key := range keys {
+			if verifyRRSIG(rrs, sig, key, now) == nil {
+				return int(sig.Labels), nil
+			}
+		}
+	}
+
+	return 0, ErrBogusSignature
+}
+
+type nsecRR struct {
+	owner string
+	NSEC
+}
+
+type nsec3RR struct {
+	hash []byte
+	NSEC3
+}
+
+// denialRecords returns the NSEC and NSEC3 records of zone in section which are signed by keys.
+func denialRecords(section []recursorRR, keys []DNSKEY, zone string, now time.Time) (nsecs []nsecRR, nsec3s []nsec3RR) {
+	for _, rr := range section {
+		if (rr.Type != TypeNSEC && rr.Type != TypeNSEC3) || !isSubdomain(rr.Name, zone) {
+			continue
+		}
+		if _, err := verifyRRset([]recursorRR{rr}, section, keys, zone, now); err != nil {
+			continue
+		}
+		switch rr.Type {
+		case TypeNSEC:
+			if nsec, err := ParseNSEC(rr.Data); err == nil {
+				nsec.NextDomain = strings.ToLower(nsec.NextDomain)
+				nsecs = append(nsecs, nsecRR{rr.Name, nsec})
+			}
+		case TypeNSEC3:
+			label := rr.Name
+			if i := strings.IndexByte(label, '.'); i >= 0 && label[i+1:] == zone {
+				label = label[:i]
+			} else if zone != "" || i >= 0 {
+				continue
+			}
+			hash, err := base32HexEncoding.DecodeString(strings.ToUpper(label))
+			if err != nil {
+				continue
+			}
+			if nsec3, err := ParseNSEC3(rr.Data); err == nil {
+				nsec3s = append(nsec3s, nsec3RR{hash, nsec3})
+			}
+		}
+	}
+	return
+}
+
+// verifyDenial verifies the nonexistence of name (NXDOMAIN) or typ at name (NODATA) by the signed NSEC/NSEC3
+// records of zone in section, see RFC 4035 Section 5.4 and RFC 5155 Section 8. It reports insecure if the
+// proof relies on the NSEC3 Opt-Out or the unsupported NSEC3 parameters.
+func verifyDenial(section []recursorRR, keys []DNSKEY, zone, name string, typ Type, nxdomain bool, now time.Time) (insecure bool, err error) {
+	nsecs, nsec3s := denialRecords(section, keys, zone, now)
+	switch {
+	case len(nsecs) != 0:
+		return false, nsecDenial(nsecs, name, typ, nxdomain)
+	case len(nsec3s) != 0:
+		return nsec3Denial(nsec3s, zone, name, typ, nxdomain)
+	}
+	return false, ErrBogusDenial
+}
+
+func nsecDenial(nsecs []nsecRR, name string, typ Type, nxdomain bool) error {
+	if !nxdomain {
+		for _, n := range nsecs {
+			if n.owner == name {
+				if hasType(n.Types, typ) || hasType(n.Types, TypeCNAME) {
+					return ErrBogusDenial
+				}
+				return nil
+			}
+			// the empty non-terminal, whose descendant is the next name
+			if covers(n.owner, n.NextDomain, name) && n.NextDomain != name && isSubdomain(n.NextDomain, name) {
+				return nil
+			}
+		}
+		return ErrBogusDenial
+	}
+
+	for _, n := range nsecs {
+		if !covers(n.owner, n.NextDomain, name) || isSubdomain(n.NextDomain, name) {
+			continue
+		}
+		// the closest encloser is the longest ancestor of name which is the ancestor of owner or next name
+		ce := parentName(name)
+		for ce != "" && !isSubdomain(n.owner, ce) && !isSubdomain(n.NextDomain, ce) {
+			ce = parentName(ce)
+		}
+		wildcard := strings.TrimSuffix("*."+ce, ".")
+		for _, w := range nsecs {
+			if covers(w.owner, w.NextDomain, wildcard) {
+				return nil
+			}
+		}
+	}
+
+	return ErrBogusDenial
+}
+
+func nsec3Denial(nsec3s []nsec3RR, zone, name string, typ Type, nxdomain bool) (insecure bool, err error) {
+	params := nsec3s[0].NSEC3
+	if params.HashAlgorithm != 1 || params.Iterations > nsec3MaxIterations {
+		return true, nil
+	}
+
+	hash := func(name string) []byte {
+		return nsec3Hash(name, params.Salt, params.Iterations)
+	}
+	match := func(name string) *nsec3RR {
+		h := hash(name)
+		for i := range nsec3s {
+			if bytes.Equal(nsec3s[i].hash, h) {
+				return &nsec3s[i]
+			}
+		}
+		return nil
+	}
+	cover := func(name string) *nsec3RR {
+		h := hash(name)
+		for i := range nsec3s {
+			if coversHash(nsec3s[i].hash, nsec3s[i].NextHashed, h) {
+				return &nsec3s[i]
+			}
+		}
+		return nil
+	}
+
+	if !nxdomain {
+		if m := match(name); m != nil {
+			if hasType(m.Types, typ) || hasType(m.Types, TypeCNAME) {
+				return false, ErrBogusDenial
+			}
+			return false, nil
+		}
+		if typ != TypeDS {
+			return false, ErrBogusDenial
+		}
+	}
+
+	// the closest encloser proof, see RFC 5155 Section 7.2.1
+	ce, found := name, false
+	for ce != zone && ce != "" && !found {
+		ce = parentName(ce)
+		found = match(ce) != nil
+	}
+	if !found {
+		return false, ErrBogusDenial
+	}
+	next := cover(ancestorName(name, countLabels(ce)+1))
+	if next == nil {
+		return false, ErrBogusDenial
+	}
+	optout := next.Flags&0x01 != 0
+
+	if !nxdomain {
+		// the Opt-Out span covers the insecure delegations only
+		if !optout {
+			return false, ErrBogusDenial
+		}
+		return true, nil
+	}
+
+	if cover(strings.TrimSuffix("*."+ce, ".")) == nil {
+		return false, ErrBogusDenial
+	}
+	return optout, nil
+}
+
+// verifyWildcard verifies the wildcard expansion of name from the signature labels, the next closer name
+// must be covered by the NSEC/NSEC3 records of zone in section.
+func verifyWildcard(section []recursorRR, keys []DNSKEY, zone, name string, labels int, now time.Time) (insecure bool, err error) {
+	nsecs, nsec3s := denialRecords(section, keys, zone, now)
+	next := ancestorName(name, labels+1)
+	for _, n := range nsecs {
+		if covers(n.owner, n.NextDomain, next) {
+			return false, nil
+		}
+	}
+	if len(nsec3s) != 0 {
+		params := nsec3s[0].NSEC3
+		if params.HashAlgorithm != 1 || params.Iterations > nsec3MaxIterations {
+			return true, nil
+		}
+		h := nsec3Hash(next, params.Salt, params.Iterations)
+		for _, n := range nsec3s {
+			if coversHash(n.hash, n.NextHashed, h) {
+				return n.Flags&0x01 != 0, nil
+			}
+		}
+	}
+	return false, ErrBogusDenial
+}
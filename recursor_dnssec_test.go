@@ -0,0 +1,322 @@
+package fastdns
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign signs the zone of m by a new key of alg, the denial of existence uses NSEC3 with params if it is not nil.
+func (m *mockAuthority) sign(t *testing.T, alg DNSSECAlgorithm, params *NSEC3) DNSKEY {
+	key, priv := mockKey(t, alg)
+	m.signWith(t, key, priv, params)
+	return key
+}
+
+func (m *mockAuthority) signWith(t *testing.T, key DNSKEY, priv crypto.Signer, params *NSEC3) {
+	now := time.Now()
+	m.sigs = make(map[recursorKey][]recursorRR)
+	sign := func(rrs []recursorRR) {
+		rr, err := signRRset(rrs, m.zone, key, priv, now.Add(-time.Hour), now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("sign %s %s error: %+v", rrs[0].Name, rrs[0].Type, err)
+		}
+		k := recursorKey{rrs[0].Name, rrs[0].Type}
+		m.sigs[k] = append(m.sigs[k], rr)
+	}
+
+	m.records = append(m.records, recursorRR{Name: m.zone, Type: TypeDNSKEY, Class: ClassINET, TTL: 300, Data: AppendDNSKEY(nil, key)})
+
+	// the RRsets and the types of owner names, the NS records of delegations are not signed
+	types := map[string][]Type{m.zone: {TypeSOA}}
+	var keys []recursorKey
+	sets := make(map[recursorKey][]recursorRR)
+	for _, rr := range m.records {
+		if !hasType(types[rr.Name], rr.Type) {
+			types[rr.Name] = append(types[rr.Name], rr.Type)
+		}
+		if rr.Type == TypeNS && rr.Name != m.zone {
+			continue
+		}
+		k := recursorKey{rr.Name, rr.Type}
+		if sets[k] == nil {
+			keys = append(keys, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+	for _, k := range keys {
+		sign(sets[k])
+	}
+	sign([]recursorRR{mockRR(m.zone, TypeSOA, "ns."+m.zone)})
+
+	insecure := func(owner string) bool {
+		return owner != m.zone && hasType(types[owner], TypeNS) && !hasType(types[owner], TypeDS)
+	}
+
+	if params == nil {
+		owners := make([]string, 0, len(types))
+		for owner := range types {
+			owners = append(owners, owner)
+		}
+		sort.Slice(owners, func(i, j int) bool { return compareNames(owners[i], owners[j]) < 0 })
+		for i, owner := range owners {
+			nsec := NSEC{NextDomain: owners[(i+1)%len(owners)], Types: append(types[owner], TypeNSEC)}
+			if !insecure(owner) {
+				nsec.Types = append(nsec.Types, TypeRRSIG)
+			}
+			rr := recursorRR{Name: owner, Type: TypeNSEC, Class: ClassINET, TTL: 300, Data: AppendNSEC(nil, nsec)}
+			m.denials = append(m.denials, rr)
+			sign([]recursorRR{rr})
+		}
+		return
+	}
+
+	// the empty non-terminals have NSEC3 records
+	for owner := range types {
+		for n := parentName(owner); owner != m.zone && n != m.zone; n = parentName(n) {
+			if _, ok := types[n]; !ok {
+				types[n] = nil
+			}
+		}
+	}
+	type hashed struct {
+		owner string
+		hash  []byte
+	}
+	var hashes []hashed
+	for owner := range types {
+		hashes = append(hashes, hashed{owner, nsec3Hash(owner, params.Salt, params.Iterations)})
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i].hash, hashes[j].hash) < 0 })
+	for i, h := range hashes {
+		nsec3 := *params
+		nsec3.NextHashed = hashes[(i+1)%len(hashes)].hash
+		nsec3.Types = types[h.owner]
+		if len(nsec3.Types) != 0 && !insecure(h.owner) {
+			nsec3.Types = append(nsec3.Types, TypeRRSIG)
+		}
+		rr := recursorRR{Name: strings.TrimSuffix(nsec3Label(h.hash)+"."+m.zone, "."), Type: TypeNSEC3, Class: ClassINET, TTL: 300, Data: AppendNSEC3(nil, nsec3)}
+		m.denials = append(m.denials, rr)
+		sign([]recursorRR{rr})
+	}
+}
+
+// proofs returns the signed NSEC/NSEC3 records which match or cover name, its ancestors and their wildcards.
+func (m *mockAuthority) proofs(name string) (records []recursorRR) {
+	var names []string
+	for n := name; ; n = parentName(n) {
+		names = append(names, n, strings.TrimSuffix("*."+n, "."))
+		if n == m.zone || n == "" {
+			break
+		}
+	}
+
+	for _, rr := range m.denials {
+		match := false
+		switch rr.Type {
+		case TypeNSEC:
+			nsec, _ := ParseNSEC(rr.Data)
+			for _, n := range names {
+				match = match || rr.Name == n || covers(rr.Name, nsec.NextDomain, n)
+			}
+		case TypeNSEC3:
+			nsec3, _ := ParseNSEC3(rr.Data)
+			label := rr.Name
+			if i := strings.IndexByte(label, '.'); i >= 0 {
+				label = label[:i]
+			}
+			hash, _ := base32HexEncoding.DecodeString(strings.ToUpper(label))
+			for _, n := range names {
+				h := nsec3Hash(n, nsec3.Salt, nsec3.Iterations)
+				match = match || bytes.Equal(hash, h) || coversHash(hash, nsec3.NextHashed, h)
+			}
+		}
+		if match {
+			records = append(append(records, rr), m.sigs[recursorKey{rr.Name, rr.Type}]...)
+		}
+	}
+
+	return records
+}
+
+func mockDS(t *testing.T, owner string, key DNSKEY) recursorRR {
+	ds, err := key.DS(owner, DigestSHA256)
+	if err != nil {
+		t.Fatalf("DNSKEY.DS(%s) error: %+v", owner, err)
+	}
+	return recursorRR{Name: owner, Type: TypeDS, Class: ClassINET, TTL: 300, Data: AppendDS(nil, ds)}
+}
+
+// mockSignedRecursor signs the mock zones except example.net, and returns a validating Recursor which
+// trusts the mock root key. The zone glueless.org is bogus, its DS record does not match its key.
+func mockSignedRecursor(t *testing.T) (*Recursor, func()) {
+	authorities := mockAuthorities()
+	zones := make(map[string]*mockAuthority)
+	for _, authority := range authorities {
+		zones[authority.zone] = authority
+	}
+
+	zones["example.org"].records = append(zones["example.org"].records,
+		mockRR("*.wild.example.org", TypeA, "6.6.6.6"),
+		mockRR("bad.example.org", TypeA, "7.7.7.7"),
+	)
+	exampleOrgKey := zones["example.org"].sign(t, AlgorithmECDSAP256SHA256, nil)
+	for i, rr := range zones["example.org"].records {
+		if rr.Name == "bad.example.org" {
+			zones["example.org"].records[i].Data = []byte{8, 8, 8, 8}
+		}
+	}
+
+	zones["glueless.org"].sign(t, AlgorithmECDSAP256SHA256, nil)
+	bogusKey, _ := mockKey(t, AlgorithmECDSAP256SHA256)
+
+	zones["org"].records = append(zones["org"].records, mockDS(t, "example.org", exampleOrgKey), mockDS(t, "glueless.org", bogusKey))
+	orgKey := zones["org"].sign(t, AlgorithmED25519, nil)
+
+	netKey := zones["net"].sign(t, AlgorithmRSASHA256, &NSEC3{HashAlgorithm: 1, Iterations: 5, Salt: []byte{0xab, 0xcd}})
+
+	zones[""].records = append(zones[""].records, mockDS(t, "org", orgKey), mockDS(t, "net", netKey))
+	rootKey := zones[""].sign(t, AlgorithmECDSAP384SHA384, nil)
+
+	recursor, _, cleanup := startMockRecursor(t, authorities)
+	recursor.DNSSEC = true
+	anchor, _ := rootKey.DS("", DigestSHA384)
+	recursor.TrustAnchors = []DS{anchor}
+
+	return recursor, cleanup
+}
+
+func TestRecursorDNSSEC(t *testing.T) {
+	recursor, cleanup := mockSignedRecursor(t)
+	defer cleanup()
+
+	cases := []struct {
+		Domain   string
+		Type     Type
+		Rcode    Rcode
+		Security Security
+		Addr     string
+	}{
+		{"www.example.org", TypeA, RcodeNoError, SecuritySecure, "1.1.1.1"},
+		{"x.wild.example.org", TypeA, RcodeNoError, SecuritySecure, "6.6.6.6"},
+		{"www.example.org", TypeTXT, RcodeNoError, SecuritySecure, ""},
+		{"b.example.org", TypeA, RcodeNoError, SecuritySecure, ""},
+		{"nxdomain.example.org", TypeA, RcodeNXDomain, SecuritySecure, ""},
+		{"nxdomain.org", TypeA, RcodeNXDomain, SecuritySecure, ""},
+		{"www.nxdomain.net", TypeA, RcodeNXDomain, SecuritySecure, ""},
+		{"www.example.net", TypeA, RcodeNoError, SecurityInsecure, "2.2.2.2"},
+		{"alias.example.org", TypeA, RcodeNoError, SecurityInsecure, "2.2.2.2"},
+		{"x.dname.example.org", TypeA, RcodeNoError, SecurityInsecure, "4.4.4.4"},
+		{"bad.example.org", TypeA, RcodeServFail, SecurityBogus, ""},
+		{"www.glueless.org", TypeA, RcodeServFail, SecurityBogus, ""},
+	}
+
+	for _, c := range cases {
+		req, resp := AcquireMessage(), AcquireMessage()
+		req.SetRequestQuestion(c.Domain, c.Type, ClassINET)
+		req.SetEDNS(1232, true)
+
+		security, err := recursor.ExchangeSecurity(context.Background(), req, resp)
+		if err != nil {
+			t.Fatalf("recursor exchange %s error: %+v", c.Domain, err)
+		}
+		if security != c.Security || resp.Rcode() != c.Rcode {
+			t.Errorf("recursor resolve %s %s return %s %s, expect %s %s", c.Domain, c.Type, security, resp.Rcode(), c.Security, c.Rcode)
+		}
+		if ad := resp.Header.Flags.AD() == 1; ad != (c.Security == SecuritySecure) {
+			t.Errorf("recursor resolve %s %s return AD=%v", c.Domain, c.Type, ad)
+		}
+		if edes := resp.ExtendedErrors(); (c.Security == SecurityBogus) != (len(edes) == 1 && edes[0].Code == ExtendedErrorDNSSECBogus) {
+			t.Errorf("recursor resolve %s %s return extended errors %+v", c.Domain, c.Type, edes)
+		}
+
+		var addr string
+		walkAnswers(resp, func(owner string, typ Type, data []byte) bool {
+			if typ == TypeA {
+				ip, _ := netip.AddrFromSlice(data)
+				addr = ip.String()
+			}
+			return true
+		})
+		if addr != c.Addr {
+			t.Errorf("recursor resolve %s %s return %s, expect %s", c.Domain, c.Type, addr, c.Addr)
+		}
+
+		ReleaseMessage(req)
+		ReleaseMessage(resp)
+	}
+
+	// the AD bit is set only if the query has the AD or DO bit
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	if security, err := recursor.ExchangeSecurity(context.Background(), req, resp); err != nil || security != SecuritySecure || resp.Header.Flags.AD() != 0 {
+		t.Errorf("recursor exchange return %s AD=%d %+v", security, resp.Header.Flags.AD(), err)
+	}
+}
+
+func TestRecursorDNSSECTrustAnchor(t *testing.T) {
+	recursor, cleanup := mockSignedRecursor(t)
+	defer cleanup()
+
+	// the root key does not match the trust anchor
+	key, _ := mockKey(t, AlgorithmECDSAP384SHA384)
+	anchor, _ := key.DS("", DigestSHA384)
+	recursor.TrustAnchors = []DS{anchor}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+
+	security, err := recursor.ExchangeSecurity(context.Background(), req, resp)
+	if err != nil || security != SecurityBogus || resp.Rcode() != RcodeServFail {
+		t.Errorf("recursor exchange return %s %s %+v, expect Bogus SERVFAIL", security, resp.Rcode(), err)
+	}
+
+	// the signed zones are resolved without validation
+	recursor.DNSSEC = false
+	security, err = recursor.ExchangeSecurity(context.Background(), req, resp)
+	if err != nil || security != SecurityIndeterminate || resp.Rcode() != RcodeNoError || resp.Header.ANCount != 1 {
+		t.Errorf("recursor exchange return %s %s %+v, expect Indeterminate NOERROR", security, resp.Rcode(), err)
+	}
+}
+
+func TestVerifyWildcard(t *testing.T) {
+	key, priv := mockKey(t, AlgorithmECDSAP256SHA256)
+	now := time.Now()
+
+	nsec := func(owner, next string) []recursorRR {
+		rr := recursorRR{Name: owner, Type: TypeNSEC, Class: ClassINET, TTL: 300, Data: AppendNSEC(nil, NSEC{NextDomain: next, Types: []Type{TypeA, TypeNSEC, TypeRRSIG}})}
+		sig, err := signRRset([]recursorRR{rr}, "example.com", key, priv, now.Add(-time.Hour), now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("sign %s NSEC error: %+v", owner, err)
+		}
+		return []recursorRR{rr, sig}
+	}
+
+	cases := []struct {
+		Section []recursorRR
+		Name    string
+		Err     error
+	}{
+		// the next closer name b.example.com is covered
+		{nsec("a.example.com", "c.example.com"), "b.example.com", nil},
+		{nsec("a.example.com", "c.example.com"), "x.b.example.com", nil},
+		// the qname is covered but the next closer name b.example.com exists
+		{nsec("b.example.com", "c.example.com"), "a.b.example.com", ErrBogusDenial},
+	}
+
+	for _, c := range cases {
+		// the labels of RRSIG of *.example.com
+		if _, err := verifyWildcard(c.Section, []DNSKEY{key}, "example.com", c.Name, 2, now); err != c.Err {
+			t.Errorf("verifyWildcard(%s) with NSEC %s return %+v, expect %+v", c.Name, c.Section[0].Name, err, c.Err)
+		}
+	}
+}
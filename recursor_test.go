@@ -0,0 +1,468 @@
+package fastdns
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockAuthority is an authoritative server of zone with the records and the delegations to child zones.
+type mockAuthority struct {
+	zone    string
+	records []recursorRR
+	glues   []recursorRR
+
+	// sigs and denials are the RRSIG and NSEC/NSEC3 records of the signed zone, see sign.
+	sigs    map[recursorKey][]recursorRR
+	denials []recursorRR
+
+	// truncate replies the queries over UDP with TC bit, so they are retried over TCP.
+	truncate bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func mockRR(name string, typ Type, data string) recursorRR {
+	rr := recursorRR{Name: name, Type: typ, Class: ClassINET, TTL: 300}
+	switch typ {
+	case TypeA:
+		ip := netip.MustParseAddr(data).As4()
+		rr.Data = ip[:]
+	case TypeSOA:
+		rr.Data = append(encodeName(encodeName(nil, data), "hostmaster."+data), 0, 0, 0, 1, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 60)
+	default:
+		rr.Data = encodeName(nil, data)
+	}
+	return rr
+}
+
+func (m *mockAuthority) ServeDNS(rw ResponseWriter, req *Message) {
+	name := strings.ToLower(string(req.Domain))
+	typ := req.Question.Type
+	opt, ok := req.OPT()
+	do := ok && opt.Flags&0x8000 != 0 && m.sigs != nil
+
+	m.mu.Lock()
+	m.queries = append(m.queries, name+" "+typ.String())
+	m.mu.Unlock()
+
+	if _, tcp := rw.(*tcpResponseWriter); m.truncate && !tcp {
+		req.SetResponseHeader(RcodeNoError, 0)
+		// TC = 1
+		req.Raw[2] |= 0b00000010
+		_, _ = rw.Write(req.Raw)
+		return
+	}
+
+	var answers, authority, additional []recursorRR
+	rcode := RcodeNoError
+
+	// delegations
+	for _, rr := range m.records {
+		if rr.Type == TypeNS && rr.Name != m.zone && isSubdomain(name, rr.Name) {
+			authority = append(authority, rr)
+		}
+	}
+	if len(authority) != 0 {
+		for _, glue := range m.glues {
+			for _, ns := range authority {
+				if rdataName(ns) == glue.Name {
+					additional = append(additional, glue)
+				}
+			}
+		}
+		if cut := authority[0].Name; do {
+			if ds := rrset(m.records, cut, TypeDS); len(ds) != 0 {
+				authority = append(append(authority, ds...), m.sigs[recursorKey{cut, TypeDS}]...)
+			} else {
+				authority = append(authority, m.proofs(cut)...)
+			}
+		}
+	} else {
+		exists := false
+		for _, rr := range m.records {
+			switch {
+			case rr.Name == name && (rr.Type == typ || rr.Type == TypeCNAME):
+				answers = append(answers, rr)
+			case rr.Type == TypeDNAME && rr.Name != name && isSubdomain(name, rr.Name):
+				target := name[:len(name)-len(rr.Name)] + rdataName(rr)
+				answers = append(answers, rr, recursorRR{Name: name, Type: TypeCNAME, Class: ClassINET, TTL: rr.TTL, Data: encodeName(nil, target)})
+			}
+			if isSubdomain(rr.Name, name) {
+				exists = true
+			}
+		}
+		if do {
+			signed := make(map[recursorKey]bool)
+			for _, rr := range answers {
+				if key := (recursorKey{rr.Name, rr.Type}); !signed[key] {
+					signed[key] = true
+					answers = append(answers, m.sigs[key]...)
+				}
+			}
+		}
+		// wildcard of the closest encloser
+		for n := name; !exists && n != m.zone && n != ""; {
+			n = parentName(n)
+			wildcard := strings.TrimSuffix("*."+n, ".")
+			for _, rr := range m.records {
+				if rr.Name == wildcard {
+					exists = true
+					if rr.Type == typ {
+						rr.Name = name
+						answers = append(answers, rr)
+					}
+				}
+			}
+			if exists && do {
+				for _, sig := range m.sigs[recursorKey{wildcard, typ}] {
+					sig.Name = name
+					answers = append(answers, sig)
+				}
+				authority = append(authority, m.proofs(name)...)
+			}
+		}
+		if len(answers) == 0 {
+			if !exists {
+				rcode = RcodeNXDomain
+			}
+			authority = append(authority, mockRR(m.zone, TypeSOA, "ns."+m.zone))
+			if do {
+				authority = append(append(authority, m.sigs[recursorKey{m.zone, TypeSOA}]...), m.proofs(name)...)
+			}
+		}
+	}
+
+	req.SetResponseHeader(RcodeNoError, uint16(len(answers)))
+	// AA = 1
+	req.Header.Flags |= Flags(rcode) | 0b0000010000000000
+	req.Raw[2], req.Raw[3] = byte(req.Header.Flags>>8), byte(req.Header.Flags)
+	req.Raw[8], req.Raw[9] = byte(len(authority)>>8), byte(len(authority))
+	req.Raw[10], req.Raw[11] = byte(len(additional)>>8), byte(len(additional))
+	for _, rr := range append(append(answers, authority...), additional...) {
+		req.Raw = appendRR(req.Raw, rr)
+	}
+
+	_, _ = rw.Write(req.Raw)
+}
+
+func (m *mockAuthority) Queries() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.queries...)
+}
+
+// mockAuthorities returns the authoritative servers of root, TLD and leaf zones by their addresses.
+func mockAuthorities() map[string]*mockAuthority {
+	return map[string]*mockAuthority{
+		"192.0.2.1": {
+			zone: "",
+			records: []recursorRR{
+				mockRR("org", TypeNS, "a0.org"),
+				mockRR("net", TypeNS, "a0.net"),
+			},
+			glues: []recursorRR{
+				mockRR("a0.org", TypeA, "192.0.2.10"),
+				mockRR("a0.net", TypeA, "192.0.2.20"),
+			},
+		},
+		"192.0.2.10": {
+			zone: "org",
+			records: []recursorRR{
+				mockRR("example.org", TypeNS, "ns1.example.org"),
+				mockRR("glueless.org", TypeNS, "ns.example.net"),
+			},
+			glues: []recursorRR{
+				mockRR("ns1.example.org", TypeA, "192.0.2.100"),
+			},
+		},
+		"192.0.2.20": {
+			zone: "net",
+			records: []recursorRR{
+				mockRR("example.net", TypeNS, "ns1.example.net"),
+			},
+			glues: []recursorRR{
+				mockRR("ns1.example.net", TypeA, "192.0.2.200"),
+			},
+		},
+		"192.0.2.100": {
+			zone: "example.org",
+			records: []recursorRR{
+				mockRR("example.org", TypeNS, "ns1.example.org"),
+				mockRR("www.example.org", TypeA, "1.1.1.1"),
+				mockRR("alias.example.org", TypeCNAME, "www.example.net"),
+				mockRR("dname.example.org", TypeDNAME, "example.net"),
+				mockRR("a.b.example.org", TypeA, "3.3.3.3"),
+			},
+		},
+		"192.0.2.200": {
+			zone: "example.net",
+			records: []recursorRR{
+				mockRR("example.net", TypeNS, "ns1.example.net"),
+				mockRR("www.example.net", TypeA, "2.2.2.2"),
+				mockRR("x.example.net", TypeA, "4.4.4.4"),
+				mockRR("ns.example.net", TypeA, "192.0.2.150"),
+			},
+		},
+		"192.0.2.150": {
+			zone: "glueless.org",
+			records: []recursorRR{
+				mockRR("www.glueless.org", TypeA, "5.5.5.5"),
+			},
+		},
+	}
+}
+
+// mockRecursor starts the mock authoritative servers, and returns a Recursor which resolves from the mock
+// root server.
+func mockRecursor(t *testing.T) (*Recursor, map[string]*mockAuthority, func()) {
+	return startMockRecursor(t, mockAuthorities())
+}
+
+func startMockRecursor(t *testing.T, authorities map[string]*mockAuthority) (*Recursor, map[string]*mockAuthority, func()) {
+	recursor := &Recursor{
+		Roots: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		remap: make(map[netip.Addr]netip.AddrPort),
+	}
+
+	var conns []io.Closer
+	zones := make(map[string]*mockAuthority)
+	for ip, authority := range authorities {
+		// the truncated responses are retried over TCP on the same port
+		var conn net.PacketConn
+		var ln net.Listener
+		var err error
+		for i := 0; i < 10 && conn == nil; i++ {
+			if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				t.Fatalf("listen tcp error: %+v", err)
+			}
+			if conn, err = net.ListenPacket("udp", ln.Addr().String()); err != nil {
+				ln.Close()
+			}
+		}
+		if err != nil {
+			t.Fatalf("listen packet error: %+v", err)
+		}
+		conns = append(conns, conn, ln)
+
+		s := &Server{
+			Handler:  authority,
+			ErrorLog: log.Default(),
+		}
+		go func() {
+			_ = s.Serve(conn)
+		}()
+		go func() {
+			_ = s.ServeListener(ln)
+		}()
+
+		recursor.remap[netip.MustParseAddr(ip)] = conn.LocalAddr().(*net.UDPAddr).AddrPort()
+		zones[authority.zone] = authority
+	}
+
+	return recursor, zones, func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+func TestRecursorResolve(t *testing.T) {
+	recursor, zones, cleanup := mockRecursor(t)
+	defer cleanup()
+
+	cases := []struct {
+		Domain string
+		Rcode  Rcode
+		Types  []Type
+		Addr   string
+	}{
+		{"www.example.org", RcodeNoError, []Type{TypeA}, "1.1.1.1"},
+		{"WWW.Example.ORG", RcodeNoError, []Type{TypeA}, "1.1.1.1"},
+		{"alias.example.org", RcodeNoError, []Type{TypeCNAME, TypeA}, "2.2.2.2"},
+		{"x.dname.example.org", RcodeNoError, []Type{TypeDNAME, TypeCNAME, TypeA}, "4.4.4.4"},
+		{"www.glueless.org", RcodeNoError, []Type{TypeA}, "5.5.5.5"},
+		{"a.b.example.org", RcodeNoError, []Type{TypeA}, "3.3.3.3"},
+		{"b.example.org", RcodeNoError, nil, ""},
+		{"nxdomain.example.org", RcodeNXDomain, nil, ""},
+		{"www.nxdomain.example.org", RcodeNXDomain, nil, ""},
+	}
+
+	for _, c := range cases {
+		req, resp := AcquireMessage(), AcquireMessage()
+		req.SetRequestQuestion(c.Domain, TypeA, ClassINET)
+
+		if err := recursor.Exchange(req, resp); err != nil {
+			t.Fatalf("recursor exchange %s error: %+v", c.Domain, err)
+		}
+		if resp.Rcode() != c.Rcode || resp.Header.Flags.RA() == 0 || resp.Header.ID != req.Header.ID {
+			t.Errorf("recursor resolve %s return rcode %s, expect %s", c.Domain, resp.Rcode(), c.Rcode)
+		}
+
+		var types []Type
+		var addr string
+		walkAnswers(resp, func(owner string, typ Type, data []byte) bool {
+			types = append(types, typ)
+			if typ == TypeA {
+				ip, _ := netip.AddrFromSlice(data)
+				addr = ip.String()
+			}
+			return true
+		})
+		if !reflect.DeepEqual(types, c.Types) || addr != c.Addr {
+			t.Errorf("recursor resolve %s return %v %s, expect %v %s", c.Domain, types, addr, c.Types, c.Addr)
+		}
+
+		ReleaseMessage(req)
+		ReleaseMessage(resp)
+	}
+
+	// QNAME minimisation, the root and TLD servers do not see the full names
+	for _, q := range zones[""].Queries() {
+		if q != "org A" && q != "net A" {
+			t.Errorf("recursor shall send the minimised queries to root server, got %#v", q)
+		}
+	}
+	for _, q := range zones["org"].Queries() {
+		if strings.Count(q, ".") > 1 {
+			t.Errorf("recursor shall send the minimised queries to TLD server, got %#v", q)
+		}
+	}
+
+	// cache
+	n := len(zones["example.org"].Queries())
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+	if err := recursor.Exchange(req, resp); err != nil || resp.Header.ANCount != 1 {
+		t.Errorf("recursor exchange error: %+v %x", err, resp.Raw)
+	}
+	if m := len(zones["example.org"].Queries()); m != n {
+		t.Errorf("recursor shall answer from cache, got %d queries", m-n)
+	}
+}
+
+func TestRecursorDisableQNAMEMinimisation(t *testing.T) {
+	recursor, zones, cleanup := mockRecursor(t)
+	defer cleanup()
+
+	recursor.DisableQNAMEMinimisation = true
+
+	ips, err := NewResolver(recursor).LookupNetIP(context.Background(), "ip4", "www.example.org.")
+	if err != nil || len(ips) != 1 || ips[0] != netip.MustParseAddr("1.1.1.1") {
+		t.Errorf("recursor lookup www.example.org return %v %+v", ips, err)
+	}
+
+	if queries := zones[""].Queries(); len(queries) == 0 || queries[0] != "www.example.org A" {
+		t.Errorf("recursor shall send the full query name to root server, got %v", queries)
+	}
+}
+
+func TestRecursorServeDNS(t *testing.T) {
+	recursor, _, cleanup := mockRecursor(t)
+	defer cleanup()
+
+	rw, req := &MemResponseWriter{}, AcquireMessage()
+	defer ReleaseMessage(req)
+	req.SetRequestQuestion("alias.example.org", TypeA, ClassINET)
+
+	recursor.ServeDNS(rw, req)
+
+	resp := AcquireMessage()
+	defer ReleaseMessage(resp)
+	if err := ParseMessage(resp, rw.Data, true); err != nil || resp.Header.ANCount != 2 {
+		t.Errorf("recursor serve dns error: %+v %x", err, rw.Data)
+	}
+}
+
+func TestRecursorTCP(t *testing.T) {
+	authorities := mockAuthorities()
+	authorities["192.0.2.100"].truncate = true
+	recursor, zones, cleanup := startMockRecursor(t, authorities)
+	defer cleanup()
+
+	ips, err := NewResolver(recursor).LookupNetIP(context.Background(), "ip4", "www.example.org.")
+	if err != nil || len(ips) != 1 || ips[0] != netip.MustParseAddr("1.1.1.1") {
+		t.Errorf("recursor shall retry the truncated responses over TCP, got %v %+v", ips, err)
+	}
+	if n := len(zones["example.org"].Queries()); n != 2 {
+		t.Errorf("recursor shall query over UDP and TCP, got %d queries", n)
+	}
+}
+
+func TestRecursorContext(t *testing.T) {
+	// the root server which never replies
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	recursor := &Recursor{
+		Roots:       []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")},
+		ReadTimeout: 5 * time.Second,
+		remap: map[netip.Addr]netip.AddrPort{
+			netip.MustParseAddr("192.0.2.1"): conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+			netip.MustParseAddr("192.0.2.2"): conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		},
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+	req.SetRequestQuestion("www.example.org", TypeA, ClassINET)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_ = recursor.ExchangeContext(ctx, req, resp)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("recursor shall stop querying servers by the deadline of context, took %s", elapsed)
+	}
+}
+
+func TestRecursorClients(t *testing.T) {
+	recursor := &Recursor{}
+
+	first := recursor.client(netip.MustParseAddrPort("192.0.2.1:53"))
+	for i := 0; i < 2*recursorMaxClients; i++ {
+		// keep the first client recently used
+		if c := recursor.client(netip.MustParseAddrPort("192.0.2.1:53")); c != first {
+			t.Fatalf("recursor shall reuse the recently used client")
+		}
+		recursor.client(netip.AddrPortFrom(netip.AddrFrom4([4]byte{198, 51, byte(i >> 8), byte(i)}), 53))
+	}
+
+	if n := len(recursor.clients); n > recursorMaxClients {
+		t.Errorf("recursor shall evict the least recently used clients, got %d clients", n)
+	}
+}
+
+func TestReadName(t *testing.T) {
+	payload := []byte("\x03www\x07example\x03org\x00\x03abc\xc0\x04\xc0\x14")
+	cases := []struct {
+		Offset int
+		Name   string
+		End    int
+	}{
+		{0, "www.example.org", 17},
+		{17, "abc.example.org", 23},
+		{23, "", -1},
+		{30, "", -1},
+	}
+
+	for _, c := range cases {
+		if name, end := readName(payload, c.Offset); name != c.Name || end != c.End {
+			t.Errorf("readName(%d) return %#v %d, expect %#v %d", c.Offset, name, end, c.Name, c.End)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package fastdns
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResolvConf is the stub resolver configuration of resolv.conf(5).
+type ResolvConf struct {
+	// Nameservers is the addresses of nameservers, at most 3 nameservers are used as glibc does.
+	// It defaults to 127.0.0.1:53 if resolv.conf has no nameserver.
+	Nameservers []netip.AddrPort
+
+	// Search is the search list of domain names without the trailing dot, the last one of
+	// "search" and "domain" directives wins.
+	Search []string
+
+	// Ndots is the minimum number of dots in a name to be queried as is before the search list, default 1.
+	Ndots int
+
+	// Timeout is the timeout of a query to a nameserver, default 5s.
+	Timeout time.Duration
+
+	// Attempts is the number of rounds over the nameservers, default 2.
+	Attempts int
+
+	// Rotate queries the nameservers in round robin order instead of the listed order.
+	Rotate bool
+
+	// EDNS0 advertises the EDNS0 UDP payload size in the queries.
+	EDNS0 bool
+}
+
+// resolvConfMaxNameservers is the limitation of nameservers in glibc, MAXNS of resolv.h.
+const resolvConfMaxNameservers = 3
+
+// LoadResolvConf reads and parses the resolv.conf of filename, e.g. "/etc/resolv.conf".
+// The search list defaults to the domain of hostname as glibc does.
+func LoadResolvConf(filename string) (*ResolvConf, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := ParseResolvConf(data)
+	if len(conf.Search) == 0 {
+		if hostname, err := os.Hostname(); err == nil {
+			if i := strings.IndexByte(hostname, '.'); i >= 0 && i+1 < len(hostname) {
+				conf.Search = []string{strings.TrimSuffix(hostname[i+1:], ".")}
+			}
+		}
+	}
+
+	return conf, nil
+}
+
+// ParseResolvConf parses the content of resolv.conf, the unknown directives and options are ignored.
+func ParseResolvConf(data []byte) *ResolvConf {
+	conf := &ResolvConf{
+		Ndots:    1,
+		Timeout:  5 * time.Second,
+		Attempts: 2,
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 || len(conf.Nameservers) >= resolvConfMaxNameservers {
+				continue
+			}
+			if ip, err := netip.ParseAddr(fields[1]); err == nil {
+				conf.Nameservers = append(conf.Nameservers, netip.AddrPortFrom(ip, 53))
+			}
+		case "domain":
+			if len(fields) >= 2 {
+				conf.Search = []string{strings.TrimSuffix(fields[1], ".")}
+			}
+		case "search":
+			conf.Search = conf.Search[:0]
+			for _, domain := range fields[1:] {
+				if domain = strings.TrimSuffix(domain, "."); domain != "" {
+					conf.Search = append(conf.Search, domain)
+				}
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				name, value, _ := strings.Cut(option, ":")
+				n, _ := strconv.Atoi(value)
+				switch name {
+				case "ndots":
+					conf.Ndots = clamp(n, 0, 15)
+				case "timeout":
+					conf.Timeout = time.Duration(clamp(n, 1, 30)) * time.Second
+				case "attempts":
+					conf.Attempts = clamp(n, 1, 5)
+				case "rotate":
+					conf.Rotate = true
+				case "edns0":
+					conf.EDNS0 = true
+				}
+			}
+		}
+	}
+
+	if len(conf.Nameservers) == 0 {
+		conf.Nameservers = []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:53")}
+	}
+
+	return conf
+}
+
+// NameList returns the names to query for name in order, by applying the search list as glibc does.
+// The names with a trailing dot are queried as is, and the names with at least Ndots dots are queried
+// as is before the search list, otherwise after the search list.
+func (conf *ResolvConf) NameList(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{strings.TrimSuffix(name, ".")}
+	}
+
+	names := make([]string, 0, len(conf.Search)+1)
+	asis := strings.Count(name, ".") >= conf.Ndots
+	if asis {
+		names = append(names, name)
+	}
+	for _, domain := range conf.Search {
+		names = append(names, name+"."+domain)
+	}
+	if !asis {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func clamp(n, min, max int) int {
+	switch {
+	case n < min:
+		return min
+	case n > max:
+		return max
+	}
+	return n
+}
@@ -0,0 +1,73 @@
+package fastdns
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	data := []byte(`# generated by resolvconf
+domain corp.example.com
+search example.com. example.org
+nameserver 192.0.2.1
+nameserver 2001:db8::1 ; comment
+nameserver bad
+nameserver 192.0.2.2
+nameserver 192.0.2.3
+options ndots:2 timeout:60 attempts:3 rotate edns0 single-request
+`)
+
+	conf := ParseResolvConf(data)
+	want := &ResolvConf{
+		Nameservers: []netip.AddrPort{
+			netip.MustParseAddrPort("192.0.2.1:53"),
+			netip.MustParseAddrPort("[2001:db8::1]:53"),
+			netip.MustParseAddrPort("192.0.2.2:53"),
+		},
+		Search:   []string{"example.com", "example.org"},
+		Ndots:    2,
+		Timeout:  30 * time.Second,
+		Attempts: 3,
+		Rotate:   true,
+		EDNS0:    true,
+	}
+	if !reflect.DeepEqual(conf, want) {
+		t.Errorf("ParseResolvConf return %+v, expect %+v", conf, want)
+	}
+
+	conf = ParseResolvConf([]byte("search example.com\ndomain example.net\n"))
+	want = &ResolvConf{
+		Nameservers: []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:53")},
+		Search:      []string{"example.net"},
+		Ndots:       1,
+		Timeout:     5 * time.Second,
+		Attempts:    2,
+	}
+	if !reflect.DeepEqual(conf, want) {
+		t.Errorf("ParseResolvConf of defaults return %+v, expect %+v", conf, want)
+	}
+}
+
+func TestResolvConfNameList(t *testing.T) {
+	conf := &ResolvConf{Search: []string{"a.example", "b.example"}, Ndots: 1}
+
+	cases := []struct {
+		Name  string
+		Ndots int
+		Names []string
+	}{
+		{"www", 1, []string{"www.a.example", "www.b.example", "www"}},
+		{"www.google.com", 1, []string{"www.google.com", "www.google.com.a.example", "www.google.com.b.example"}},
+		{"www.google", 2, []string{"www.google.a.example", "www.google.b.example", "www.google"}},
+		{"www.google.com.", 5, []string{"www.google.com"}},
+	}
+
+	for _, c := range cases {
+		conf.Ndots = c.Ndots
+		if names := conf.NameList(c.Name); !reflect.DeepEqual(names, c.Names) {
+			t.Errorf("NameList(%#v) with ndots:%d return %v, expect %v", c.Name, c.Ndots, names, c.Names)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package fastdns
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// RRLClass is the response class of Response Rate Limiting.
+type RRLClass byte
+
+// Response classes of Response Rate Limiting.
+const (
+	RRLClassAnswer   RRLClass = iota // NOERROR responses
+	RRLClassNXDomain                 // NXDOMAIN responses
+	RRLClassError                    // other error responses
+)
+
+func (c RRLClass) String() string {
+	switch c {
+	case RRLClassAnswer:
+		return "answer"
+	case RRLClassNXDomain:
+		return "nxdomain"
+	case RRLClassError:
+		return "error"
+	}
+	return ""
+}
+
+// RRL implements BIND-style Response Rate Limiting for authoritative servers, which
+// limits the responses per client prefix and response class with token buckets.
+type RRL struct {
+	// ResponsesPerSecond limits the NOERROR responses per client prefix, zero means no limit.
+	ResponsesPerSecond int
+
+	// NXDomainsPerSecond limits the NXDOMAIN responses per client prefix, zero means no limit.
+	NXDomainsPerSecond int
+
+	// ErrorsPerSecond limits the other error responses per client prefix, zero means no limit.
+	ErrorsPerSecond int
+
+	// Window is the number of seconds over which the rate is averaged, use 15 if empty.
+	Window int
+
+	// Slip sends a truncated response instead of dropping every Slip limited responses,
+	// use 2 if empty and -1 to drop all.
+	Slip int
+
+	// IPv4PrefixLength groups the IPv4 clients by the prefix, use 24 if empty.
+	IPv4PrefixLength int
+
+	// IPv6PrefixLength groups the IPv6 clients by the prefix, use 56 if empty.
+	IPv6PrefixLength int
+
+	// MaxTableSize limits the number of client prefixes and response classes tracked, use 100000 if empty.
+	// The spoofed sources of reflection floods are evicted once the table is full.
+	MaxTableSize int
+
+	// LogOnly only logs and counts the limited responses but still sends them.
+	LogOnly bool
+
+	// Stats optionally records the limited responses if it implements RRLStats.
+	Stats Stats
+
+	// Logger optionally logs the client prefixes when they become limited.
+	Logger *log.Logger
+
+	mu      sync.Mutex
+	buckets map[rrlKey]*rrlBucket
+	cleaned time.Time
+}
+
+type rrlKey struct {
+	prefix netip.Prefix
+	class  RRLClass
+}
+
+type rrlBucket struct {
+	balance float64
+	updated time.Time
+	slip    int
+	limited bool
+}
+
+// RRLMiddleware limits the responses of handlers by rrl, the requests over other transports than UDP are
+// not limited as their sources cannot be spoofed.
+func RRLMiddleware(rrl *RRL) Middleware {
+	return MiddlewareFunc(func(ctx context.Context, rw ResponseWriter, req *Message, next ContextHandler) {
+		if transportOf(ctx, rw) != TransportUDP {
+			next.ServeDNSContext(ctx, rw, req)
+			return
+		}
+		w := rrlResponseWriterPool.Get().(*rrlResponseWriter)
+		w.ResponseWriter, w.rrl, w.req = rw, rrl, req
+		next.ServeDNSContext(ctx, w, req)
+		w.ResponseWriter, w.rrl, w.req = nil, nil, nil
+		rrlResponseWriterPool.Put(w)
+	})
+}
+
+// Allow reports whether a response of class is allowed to send to addr, and
+// whether a truncated response should be sent instead if it is not allowed.
+func (r *RRL) Allow(addr netip.Addr, class RRLClass) (allow, slip bool) {
+	var rate int
+	switch class {
+	case RRLClassAnswer:
+		rate = r.ResponsesPerSecond
+	case RRLClassNXDomain:
+		rate = r.NXDomainsPerSecond
+	default:
+		rate = r.ErrorsPerSecond
+	}
+	if rate <= 0 {
+		return true, false
+	}
+
+	window := r.Window
+	if window <= 0 {
+		window = 15
+	}
+
+	addr = addr.Unmap()
+	bits := r.IPv4PrefixLength
+	if bits <= 0 {
+		bits = 24
+	}
+	if addr.Is6() {
+		if bits = r.IPv6PrefixLength; bits <= 0 {
+			bits = 56
+		}
+	}
+	prefix, _ := addr.Prefix(bits)
+
+	now := time.Now()
+
+	r.mu.Lock()
+	if r.buckets == nil {
+		r.buckets = make(map[rrlKey]*rrlBucket)
+		r.cleaned = now
+	}
+	if now.Sub(r.cleaned) > time.Duration(window)*time.Second {
+		// drop the buckets which are idle for a window
+		for key, bucket := range r.buckets {
+			if now.Sub(bucket.updated) > time.Duration(window)*time.Second {
+				delete(r.buckets, key)
+			}
+		}
+		r.cleaned = now
+	}
+
+	key := rrlKey{prefix, class}
+	bucket := r.buckets[key]
+	if bucket == nil {
+		r.evict(now)
+		bucket = &rrlBucket{balance: float64(rate), updated: now}
+		r.buckets[key] = bucket
+	}
+
+	// refill the tokens, the credit is limited to one second and the debt is limited to one window
+	bucket.balance += now.Sub(bucket.updated).Seconds() * float64(rate)
+	if bucket.balance > float64(rate) {
+		bucket.balance = float64(rate)
+	}
+	bucket.balance--
+	if min := -float64(rate * window); bucket.balance < min {
+		bucket.balance = min
+	}
+	bucket.updated = now
+
+	allow = bucket.balance >= 0
+	if !allow {
+		bucket.slip++
+		if s := r.Slip; s == 0 && bucket.slip%2 == 0 || s > 0 && bucket.slip%s == 0 {
+			slip = true
+		}
+	}
+
+	var logging bool
+	if !allow && !bucket.limited {
+		logging = true
+	}
+	bucket.limited = !allow
+	r.mu.Unlock()
+
+	if !allow {
+		if stats, ok := r.Stats.(RRLStats); ok {
+			stats.UpdateRRLStats(class, slip)
+		}
+		if logging && r.Logger != nil {
+			r.Logger.Printf("rrl: limit %s responses to %s", class, prefix)
+		}
+	}
+
+	if r.LogOnly {
+		return true, false
+	}
+
+	return
+}
+
+// evict drops the buckets which are not limited, and then the others if the table is full, until
+// the table is 90% full. It amortizes the scan of table during floods.
+func (r *RRL) evict(now time.Time) {
+	max := r.MaxTableSize
+	if max <= 0 {
+		max = 100000
+	}
+	if len(r.buckets) < max {
+		return
+	}
+	target := max - max/10 - 1
+	for key, bucket := range r.buckets {
+		if len(r.buckets) <= target {
+			return
+		}
+		if !bucket.limited || now.Sub(bucket.updated) > time.Second {
+			delete(r.buckets, key)
+		}
+	}
+	for key := range r.buckets {
+		if len(r.buckets) <= target {
+			return
+		}
+		delete(r.buckets, key)
+	}
+}
+
+type rrlResponseWriter struct {
+	ResponseWriter
+	rrl *RRL
+	req *Message
+	buf []byte
+}
+
+var rrlResponseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return new(rrlResponseWriter)
+	},
+}
+
+// Unwrap returns the wrapped ResponseWriter.
+func (rw *rrlResponseWriter) Unwrap() ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *rrlResponseWriter) Write(p []byte) (int, error) {
+	if len(p) < 12 {
+		return rw.ResponseWriter.Write(p)
+	}
+
+	class := RRLClassError
+	switch Rcode(p[3] & 0x0f) {
+	case RcodeNoError:
+		class = RRLClassAnswer
+	case RcodeNXDomain:
+		class = RRLClassNXDomain
+	}
+
+	allow, slip := rw.rrl.Allow(rw.RemoteAddr().Addr(), class)
+	switch {
+	case allow:
+		return rw.ResponseWriter.Write(p)
+	case slip:
+		// send a truncated response with question only, to let the real clients retry over TCP.
+		n := 12
+		if p[4] == 0 && p[5] == 1 && 12+len(rw.req.Question.Name)+4 <= len(p) {
+			n += len(rw.req.Question.Name) + 4
+		}
+		rw.buf = append(rw.buf[:0], p[:n]...)
+		rw.buf[2] |= 0b00000010
+		rw.buf[6], rw.buf[7], rw.buf[8], rw.buf[9], rw.buf[10], rw.buf[11] = 0, 0, 0, 0, 0, 0
+		if _, err := rw.ResponseWriter.Write(rw.buf); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	default:
+		// drop the response silently
+		return len(p), nil
+	}
+}
@@ -0,0 +1,145 @@
+package fastdns
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestRRLAllow(t *testing.T) {
+	rrl := &RRL{
+		ResponsesPerSecond: 2,
+		Slip:               2,
+	}
+
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	var allows, slips int
+	for i := 0; i < 6; i++ {
+		allow, slip := rrl.Allow(addr, RRLClassAnswer)
+		if allow {
+			allows++
+		}
+		if slip {
+			slips++
+		}
+	}
+	if allows != 2 || slips != 2 {
+		t.Errorf("RRL Allow error allows=%d slips=%d", allows, slips)
+	}
+
+	// same /24 prefix shares the bucket
+	if allow, _ := rrl.Allow(netip.MustParseAddr("192.0.2.200"), RRLClassAnswer); allow {
+		t.Errorf("RRL Allow shall limit the same prefix")
+	}
+	// other classes and prefixes are not limited
+	if allow, _ := rrl.Allow(addr, RRLClassNXDomain); !allow {
+		t.Errorf("RRL Allow shall not limit unlimited class")
+	}
+	if allow, _ := rrl.Allow(netip.MustParseAddr("192.0.3.1"), RRLClassAnswer); !allow {
+		t.Errorf("RRL Allow shall not limit other prefix")
+	}
+}
+
+func TestRRLMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	stats := &CoreStats{}
+
+	rrl := &RRL{
+		ResponsesPerSecond: 1,
+		Slip:               2,
+		Stats:              stats,
+		Logger:             log.New(&logs, "", 0),
+	}
+
+	handler := Chain(&mockServerHandler{}, RRLMiddleware(rrl))
+
+	var datas [][]byte
+	for i := 0; i < 3; i++ {
+		rw := &MemResponseWriter{Raddr: netip.MustParseAddrPort("[2001:db8::1]:53")}
+		handler.ServeDNS(rw, mockMessage())
+		datas = append(datas, rw.Data)
+	}
+
+	if len(datas[0]) == 0 || datas[0][2]&0b00000010 != 0 {
+		t.Errorf("RRLMiddleware shall send first response, data=%x", datas[0])
+	}
+	if len(datas[1]) != 0 {
+		t.Errorf("RRLMiddleware shall drop second response, data=%x", datas[1])
+	}
+	if len(datas[2]) == 0 || datas[2][2]&0b00000010 == 0 || datas[2][7] != 0 {
+		t.Errorf("RRLMiddleware shall slip third response, data=%x", datas[2])
+	}
+
+	if stats.RRLLimitedTotal_ANSWER != 2 || stats.RRLSlippedTotal_ANSWER != 1 {
+		t.Errorf("RRLMiddleware shall count limited responses, stats=%+v", stats)
+	}
+	if got := logs.String(); strings.Count(got, "\n") != 1 || !strings.Contains(got, "2001:db8::/56") {
+		t.Errorf("RRLMiddleware shall log limited prefix once, got=%#v", got)
+	}
+	if !strings.Contains(string(stats.AppendOpenMetrics(nil)), `dns_rrl_limited_total{server="",zone="",class="answer"} 2`) {
+		t.Errorf("RRLMiddleware shall expose limited responses in metrics")
+	}
+}
+
+func TestRRLLogOnly(t *testing.T) {
+	rrl := &RRL{
+		ErrorsPerSecond: 1,
+		LogOnly:         true,
+	}
+
+	for i := 0; i < 3; i++ {
+		if allow, _ := rrl.Allow(netip.MustParseAddr("192.0.2.1"), RRLClassError); !allow {
+			t.Errorf("RRL LogOnly shall allow all responses")
+		}
+	}
+}
+
+func TestRRLMaxTableSize(t *testing.T) {
+	rrl := &RRL{
+		ResponsesPerSecond: 1,
+		MaxTableSize:       100,
+	}
+
+	// the limited prefix survives the flood of spoofed sources
+	limited := netip.MustParseAddr("198.51.100.1")
+	rrl.Allow(limited, RRLClassAnswer)
+	rrl.Allow(limited, RRLClassAnswer)
+
+	for i := 0; i < 1000; i++ {
+		rrl.Allow(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 1}), RRLClassAnswer)
+		if n := len(rrl.buckets); n > rrl.MaxTableSize {
+			t.Fatalf("RRL table size %d exceeds MaxTableSize %d", n, rrl.MaxTableSize)
+		}
+	}
+
+	if allow, _ := rrl.Allow(limited, RRLClassAnswer); allow {
+		t.Errorf("RRL shall keep limiting the prefix after eviction")
+	}
+}
+
+func TestRRLMiddlewareTCP(t *testing.T) {
+	rrl := &RRL{
+		ResponsesPerSecond: 1,
+	}
+
+	handler := Chain(ContextHandlerFunc(func(_ context.Context, rw ResponseWriter, req *Message) {
+		(&mockServerHandler{}).ServeDNS(rw, req)
+	}), RRLMiddleware(rrl)).(ContextHandler)
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := NewRequestContext(context.Background(), TransportTCP, 0)
+		rw := &MemResponseWriter{Raddr: netip.MustParseAddrPort("192.0.2.1:53")}
+		handler.ServeDNSContext(ctx, rw, mockMessage())
+		cancel()
+		if len(rw.Data) == 0 || rw.Data[2]&0b00000010 != 0 {
+			t.Errorf("RRLMiddleware shall not limit TCP responses, data=%x", rw.Data)
+		}
+	}
+	if len(rrl.buckets) != 0 {
+		t.Errorf("RRLMiddleware shall not track TCP clients, buckets=%d", len(rrl.buckets))
+	}
+}
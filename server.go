@@ -1,7 +1,9 @@
 package fastdns
 
 import (
+	"context"
 	"errors"
+	"io"
 	"log"
 	"net"
 	"runtime"
@@ -29,30 +31,99 @@ type Server struct {
 	// The maximum number of concurrent clients the server may serve.
 	Concurrency int
 
+	// ListenConfig optionally specifies the socket options of listeners.
+	ListenConfig *ListenConfig
+
+	// OverloadPolicy specifies how to handle requests when Concurrency workers are all busy.
+	OverloadPolicy OverloadPolicy
+
+	// Backlog is the maximum number of requests queued by OverloadQueue policy, use 1024 if empty.
+	Backlog int
+
+	// HandlerTimeout is the deadline of per-request context passed to ContextHandler, use 5s if empty.
+	HandlerTimeout time.Duration
+
+	// ReadTimeout is the maximum duration for reading a request over TCP once its length is received,
+	// use 2s if empty.
+	ReadTimeout time.Duration
+
+	// IdleTimeout is the maximum duration to wait for the next request over TCP before closing the
+	// connection, use 10s if empty. See RFC 7766 section 6.2.3.
+	IdleTimeout time.Duration
+
+	// BaseContext optionally specifies the parent of per-request context passed to ContextHandler,
+	// cancel it to cancel the in-flight requests on shutdown.
+	BaseContext func() context.Context
+
+	// PanicHandler optionally handles the panics recovered from Handler instead of replying SERVFAIL.
+	// The panic stack is always logged to ErrorLog.
+	PanicHandler func(rw ResponseWriter, req *Message, v interface{})
+
+	// User optionally specifies the user to switch to after the listeners are bound,
+	// it only works on linux.
+	User string
+
+	// Group optionally specifies the group to switch to after the listeners are bound,
+	// the primary group of User is used if empty.
+	Group string
+
 	// Index indicates the index of Server instances.
 	index int
 }
 
 // ListenAndServe serves DNS requests from the given UDP addr.
 func (s *Server) ListenAndServe(addr string) error {
+	if s.ErrorLog == nil {
+		s.ErrorLog = log.Default()
+	}
+
 	if s.Index() == 0 {
 		// only prefork for linux(reuse_port)
 		return s.spawn(addr, s.MaxProcs)
 	}
 
-	if s.ErrorLog == nil {
-		s.ErrorLog = log.Default()
-	}
-
-	conn, err := listen("udp", addr)
+	conn, err := listen("udp", addr, s.ListenConfig, s.ErrorLog)
 	if err != nil {
 		s.ErrorLog.Printf("server-%d listen on addr=%s failed: %+v", s.Index(), addr, err)
 		return err
 	}
 
+	if err = setuser(s.User, s.Group); err != nil {
+		s.ErrorLog.Printf("server-%d set user=%s group=%s failed: %+v", s.Index(), s.User, s.Group, err)
+		return err
+	}
+
 	// s.ErrorLog.Printf("server-%d pid-%d serving dns on %s", s.Index(), os.Getpid(), conn.LocalAddr())
 
-	return serve(conn, s.Handler, s.Stats, s.ErrorLog, s.Concurrency)
+	return serve(conn, s.handler(), s.Stats, s.ErrorLog, s.Concurrency, s.OverloadPolicy, s.Backlog, true)
+}
+
+// Serve serves DNS requests from the given UDP conn, it enables IP_PKTINFO on conn to reply from
+// the destination address of requests.
+func (s *Server) Serve(conn net.PacketConn) error {
+	if s.ErrorLog == nil {
+		s.ErrorLog = log.Default()
+	}
+
+	c, ok := conn.(*net.UDPConn)
+	if !ok {
+		return ErrUnsupportedConn
+	}
+
+	if err := enableOOB(c); err != nil {
+		s.ErrorLog.Printf("server-%d enable pktinfo on addr=%s failed: %+v", s.Index(), c.LocalAddr(), err)
+	}
+
+	return serve(c, s.handler(), s.Stats, s.ErrorLog, s.Concurrency, s.OverloadPolicy, s.Backlog, true)
+}
+
+// ServeListener serves DNS requests over TCP from the given listener.
+func (s *Server) ServeListener(ln net.Listener) error {
+	if s.ErrorLog == nil {
+		s.ErrorLog = log.Default()
+	}
+
+	return serveTCP(ln, s.handler(), s.Stats, s.ErrorLog, s.ReadTimeout, s.IdleTimeout)
 }
 
 // Index indicates the index of Server instances.
@@ -61,6 +132,30 @@ func (s *Server) Index() (index int) {
 	return
 }
 
+func (s *Server) handler() Handler {
+	return newServerHandler(s.Handler, s.Stats, s.ErrorLog, s.PanicHandler, s.HandlerTimeout, s.BaseContext)
+}
+
+func newServerHandler(handler Handler, stats Stats, logger *log.Logger, panicHandler func(ResponseWriter, *Message, interface{}), timeout time.Duration, baseContext func() context.Context) Handler {
+	if ch, ok := handler.(ContextHandler); ok {
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+		handler = &contextHandler{
+			Handler:     ch,
+			Timeout:     timeout,
+			BaseContext: baseContext,
+		}
+	}
+
+	return &recoverHandler{
+		Handler:      handler,
+		Stats:        stats,
+		ErrorLog:     logger,
+		PanicHandler: panicHandler,
+	}
+}
+
 func (s *Server) spawn(addr string, maxProcs int) (err error) {
 	type racer struct {
 		index int
@@ -74,20 +169,39 @@ func (s *Server) spawn(addr string, maxProcs int) (err error) {
 		maxProcs = 1
 	}
 
+	// bind all the listeners before dropping privileges
+	conns := make([]*net.UDPConn, maxProcs)
+	for i := range conns {
+		if conns[i], err = listen("udp", addr, s.ListenConfig, s.ErrorLog); err != nil {
+			s.ErrorLog.Printf("server listen on addr=%s failed: %+v", addr, err)
+			return
+		}
+	}
+
+	if err = setuser(s.User, s.Group); err != nil {
+		s.ErrorLog.Printf("server set user=%s group=%s failed: %+v", s.User, s.Group, err)
+		return
+	}
+
 	ch := make(chan racer, maxProcs)
 
 	// create multiple receive worker for performance
 	for i := 1; i <= maxProcs; i++ {
 		go func(index int) {
 			server := &Server{
-				Handler:     s.Handler,
-				Stats:       s.Stats,
-				ErrorLog:    s.ErrorLog,
-				MaxProcs:    s.MaxProcs,
-				Concurrency: s.Concurrency,
-				index:       index,
+				Handler:        s.Handler,
+				Stats:          s.Stats,
+				ErrorLog:       s.ErrorLog,
+				MaxProcs:       s.MaxProcs,
+				Concurrency:    s.Concurrency,
+				OverloadPolicy: s.OverloadPolicy,
+				Backlog:        s.Backlog,
+				HandlerTimeout: s.HandlerTimeout,
+				BaseContext:    s.BaseContext,
+				PanicHandler:   s.PanicHandler,
+				index:          index,
 			}
-			err := server.ListenAndServe(addr)
+			err := server.Serve(conns[index-1])
 			ch <- racer{index, err}
 		}(i)
 	}
@@ -104,14 +218,19 @@ func (s *Server) spawn(addr string, maxProcs int) (err error) {
 
 		go func(index int) {
 			server := &Server{
-				Handler:     s.Handler,
-				Stats:       s.Stats,
-				ErrorLog:    s.ErrorLog,
-				MaxProcs:    s.MaxProcs,
-				Concurrency: s.Concurrency,
-				index:       index,
+				Handler:        s.Handler,
+				Stats:          s.Stats,
+				ErrorLog:       s.ErrorLog,
+				MaxProcs:       s.MaxProcs,
+				Concurrency:    s.Concurrency,
+				OverloadPolicy: s.OverloadPolicy,
+				Backlog:        s.Backlog,
+				HandlerTimeout: s.HandlerTimeout,
+				BaseContext:    s.BaseContext,
+				PanicHandler:   s.PanicHandler,
+				index:          index,
 			}
-			err := server.ListenAndServe(addr)
+			err := server.Serve(conns[index-1])
 			ch <- racer{index, err}
 		}(sig.index)
 	}
@@ -119,6 +238,25 @@ func (s *Server) spawn(addr string, maxProcs int) (err error) {
 	return
 }
 
+// OverloadPolicy specifies how the server handles requests when all the workers are busy.
+type OverloadPolicy int
+
+const (
+	// OverloadDrop drops the requests silently.
+	OverloadDrop OverloadPolicy = iota
+	// OverloadRefused replies REFUSED to the requests.
+	OverloadRefused
+	// OverloadServFail replies SERVFAIL to the requests.
+	OverloadServFail
+	// OverloadQueue queues the requests in a bounded backlog, and drops them if the backlog is full.
+	OverloadQueue
+)
+
+var (
+	// ErrUnsupportedConn is returned when the packet conn passed to Serve is not an UDP conn.
+	ErrUnsupportedConn = errors.New("dns server only supports *net.UDPConn")
+)
+
 type udpCtx struct {
 	rw      *udpResponseWriter
 	req     *Message
@@ -130,6 +268,7 @@ var udpCtxPool = &sync.Pool{
 	New: func() interface{} {
 		ctx := new(udpCtx)
 		ctx.rw = new(udpResponseWriter)
+		ctx.rw.OOB = make([]byte, 0, 128)
 		ctx.req = new(Message)
 		ctx.req.Raw = make([]byte, 0, 1024)
 		ctx.req.Domain = make([]byte, 0, 256)
@@ -137,10 +276,20 @@ var udpCtxPool = &sync.Pool{
 	},
 }
 
-func serve(conn *net.UDPConn, handler Handler, stats Stats, logger *log.Logger, concurrency int) error {
+// serve serves DNS requests from conn, the socket drops of conn are recorded to stats only if reportDrops
+// is set, as the counter of a socket shared by processes is not additive.
+func serve(conn *net.UDPConn, handler Handler, stats Stats, logger *log.Logger, concurrency int, overload OverloadPolicy, backlog int, reportDrops bool) error {
 	if concurrency == 0 {
 		concurrency = 256 * 1024
 	}
+	if overload == OverloadQueue && backlog == 0 {
+		backlog = 1024
+	}
+	if overload != OverloadQueue {
+		backlog = 0
+	}
+
+	workerstats, _ := stats.(WorkerStats)
 
 	pool := &workerPool{
 		WorkerFunc:            serveCtx,
@@ -148,14 +297,24 @@ func serve(conn *net.UDPConn, handler Handler, stats Stats, logger *log.Logger,
 		LogAllErrors:          false,
 		MaxIdleWorkerDuration: 2 * time.Minute,
 		Logger:                logger,
+		Stats:                 workerstats,
+		Backlog:               backlog,
 	}
 	pool.Start()
 
+	// the number of packets dropped by the socket receive queue, see SO_RXQ_OVFL
+	var drops uint32
+	sockstats, _ := stats.(SocketStats)
+	if !reportDrops {
+		sockstats = nil
+	}
+
 	for {
 		ctx := udpCtxPool.Get().(*udpCtx)
 
 		ctx.req.Raw = ctx.req.Raw[:cap(ctx.req.Raw)]
-		n, addrPort, err := conn.ReadFromUDPAddrPort(ctx.req.Raw)
+		ctx.rw.OOB = ctx.rw.OOB[:cap(ctx.rw.OOB)]
+		n, oobn, _, addrPort, err := conn.ReadMsgUDPAddrPort(ctx.req.Raw, ctx.rw.OOB)
 		if err != nil {
 			udpCtxPool.Put(ctx)
 			time.Sleep(10 * time.Millisecond)
@@ -166,14 +325,63 @@ func serve(conn *net.UDPConn, handler Handler, stats Stats, logger *log.Logger,
 		ctx.req.Raw = ctx.req.Raw[:n]
 		ctx.rw.Conn = conn
 		ctx.rw.AddrPort = addrPort
+		// reply from the destination address of request on multi-homed hosts.
+		var overflow uint32
+		var hasOverflow bool
+		ctx.rw.LocalIP, overflow, hasOverflow = parseOOB(ctx.rw.OOB[:oobn])
+		ctx.rw.OOB = appendPktinfo(ctx.rw.OOB[:0], ctx.rw.LocalIP)
+
+		if n := socketDrops(&drops, overflow, hasOverflow); n != 0 && sockstats != nil {
+			sockstats.UpdateSocketStats(n)
+		}
 
 		ctx.handler = handler
 		ctx.stats = stats
 
-		pool.Serve(ctx)
+		if !pool.Serve(ctx) {
+			overloadCtx(ctx, overload, workerstats)
+		}
 	}
 }
 
+// socketDrops returns the number of packets newly dropped since drops by the SO_RXQ_OVFL counter overflow,
+// and updates drops. The packets without the counter are skipped, as kernel omits the zero counter, and so
+// are the decreased counters, e.g. wrapped around.
+func socketDrops(drops *uint32, overflow uint32, hasOverflow bool) uint64 {
+	if !hasOverflow || overflow == *drops {
+		return 0
+	}
+	var n uint64
+	if overflow > *drops {
+		n = uint64(overflow) - uint64(*drops)
+	}
+	*drops = overflow
+	return n
+}
+
+// overloadCtx handles the ctx rejected by worker pool in the reader goroutine.
+func overloadCtx(ctx *udpCtx, overload OverloadPolicy, stats WorkerStats) {
+	switch overload {
+	case OverloadRefused, OverloadServFail:
+		rcode := RcodeRefused
+		if overload == OverloadServFail {
+			rcode = RcodeServFail
+		}
+		if ParseMessage(ctx.req, ctx.req.Raw, false) == nil {
+			Error(ctx.rw, ctx.req, rcode)
+			if ctx.stats != nil {
+				ctx.stats.UpdateStats(ctx.rw.RemoteAddr(), ctx.req, 0)
+			}
+		}
+	default:
+		if stats != nil {
+			stats.UpdateWorkerStats(0, 0, 1)
+		}
+	}
+
+	udpCtxPool.Put(ctx)
+}
+
 func serveCtx(ctx *udpCtx) error {
 	var start time.Time
 	if ctx.stats != nil {
@@ -197,3 +405,81 @@ func serveCtx(ctx *udpCtx) error {
 
 	return err
 }
+
+func serveTCP(ln net.Listener, handler Handler, stats Stats, logger *log.Logger, readTimeout, idleTimeout time.Duration) error {
+	if readTimeout == 0 {
+		readTimeout = 2 * time.Second
+	}
+	if idleTimeout == 0 {
+		idleTimeout = 10 * time.Second
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go func() {
+			err := serveTCPConn(conn, handler, stats, readTimeout, idleTimeout)
+			if err != nil && err != io.EOF {
+				logger.Printf("error when serving connection %q<->%q: %s", conn.LocalAddr(), conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func serveTCPConn(conn net.Conn, handler Handler, stats Stats, readTimeout, idleTimeout time.Duration) error {
+	defer conn.Close()
+
+	rw := &tcpResponseWriter{Conn: conn}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		rw.AddrPort = addr.AddrPort()
+	}
+
+	req := AcquireMessage()
+	defer ReleaseMessage(req)
+
+	var length [2]byte
+	for {
+		// close the idle connection silently
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+		n := int(length[0])<<8 | int(length[1])
+		if cap(req.Raw) < n {
+			req.Raw = make([]byte, n)
+		}
+		req.Raw = req.Raw[:n]
+		if _, err := io.ReadFull(conn, req.Raw); err != nil {
+			return err
+		}
+
+		var start time.Time
+		if stats != nil {
+			start = time.Now()
+		}
+
+		err := ParseMessage(req, req.Raw, false)
+		if err != nil {
+			Error(rw, req, RcodeFormErr)
+		} else {
+			handler.ServeDNS(rw, req)
+		}
+
+		if stats != nil {
+			stats.UpdateStats(rw.RemoteAddr(), req, time.Since(start))
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package fastdns
 
 import (
+	"context"
 	"errors"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
+	"time"
 )
 
 // ForkServer implements a prefork DNS server.
@@ -31,18 +34,78 @@ type ForkServer struct {
 
 	// The maximum number of concurrent clients the server may serve.
 	Concurrency int
+
+	// InheritListener makes the parent process bind the UDP socket and pass it to
+	// child processes, instead of each child binding its own SO_REUSEPORT socket.
+	// It is implied if sockets are passed by systemd socket activation, and the TCP
+	// sockets of systemd are served by child processes as well. The socket receive queue
+	// drops of the shared sockets are reported by the first child only.
+	InheritListener bool
+
+	// ListenConfig optionally specifies the socket options of listeners.
+	ListenConfig *ListenConfig
+
+	// User optionally specifies the user to switch to after the listeners are bound,
+	// it only works on linux. The parent process switches before forking so child
+	// processes inherit the reduced privileges, which requires InheritListener to
+	// serve on privileged ports.
+	User string
+
+	// Group optionally specifies the group to switch to after the listeners are bound,
+	// the primary group of User is used if empty.
+	Group string
+
+	// OverloadPolicy specifies how to handle requests when Concurrency workers are all busy.
+	OverloadPolicy OverloadPolicy
+
+	// Backlog is the maximum number of requests queued by OverloadQueue policy, use 1024 if empty.
+	Backlog int
+
+	// HandlerTimeout is the deadline of per-request context passed to ContextHandler, use 5s if empty.
+	HandlerTimeout time.Duration
+
+	// ReadTimeout is the maximum duration for reading a request over TCP once its length is received,
+	// use 2s if empty.
+	ReadTimeout time.Duration
+
+	// IdleTimeout is the maximum duration to wait for the next request over TCP before closing the
+	// connection, use 10s if empty. See RFC 7766 section 6.2.3.
+	IdleTimeout time.Duration
+
+	// BaseContext optionally specifies the parent of per-request context passed to ContextHandler,
+	// cancel it to cancel the in-flight requests on shutdown.
+	BaseContext func() context.Context
+
+	// PanicHandler optionally handles the panics recovered from Handler instead of replying SERVFAIL.
+	// The panic stack is always logged to ErrorLog.
+	PanicHandler func(rw ResponseWriter, req *Message, v interface{})
+
+	// SteerByCPU makes the parent process bind a SO_REUSEPORT socket for each child process
+	// and attach a classic BPF program selecting the socket by the receiving CPU, so that
+	// the child process pinned by SetAffinity handles packets from its own RX queue.
+	// It only works on linux.
+	SteerByCPU bool
 }
 
 // ListenAndServe serves DNS requests from the given UDP addr.
 func (s *ForkServer) ListenAndServe(addr string) error {
-	if s.Index() == 0 {
-		return s.fork(addr, s.MaxProcs)
-	}
-
 	if s.ErrorLog == nil {
 		s.ErrorLog = log.Default()
 	}
 
+	if s.Index() == 0 {
+		files, err := s.listenFiles(addr, s.MaxProcs)
+		if err != nil {
+			s.ErrorLog.Printf("forkserver listen on addr=%s failed: %+v", addr, err)
+			return err
+		}
+		if err = setuser(s.User, s.Group); err != nil {
+			s.ErrorLog.Printf("forkserver set user=%s group=%s failed: %+v", s.User, s.Group, err)
+			return err
+		}
+		return s.fork(addr, s.MaxProcs, files)
+	}
+
 	if s.SetAffinity {
 		// set cpu affinity for performance
 		err := taskset((s.Index() - 1) % runtime.NumCPU())
@@ -51,16 +114,133 @@ func (s *ForkServer) ListenAndServe(addr string) error {
 		}
 	}
 
-	// so_reuseport listen for performance
-	conn, err := listen("udp", addr)
+	// sockets passed by parent process
+	conns, lns, err := inheritedSockets()
 	if err != nil {
-		s.ErrorLog.Printf("forkserver-%d listen on addr=%s failed: %+v", s.Index(), addr, err)
+		s.ErrorLog.Printf("forkserver-%d inherit listeners failed: %+v", s.Index(), err)
+		return err
+	}
+
+	// the inherited sockets are shared by all children unless SteerByCPU, so the drops are counted once
+	reportDrops := len(conns) == 0 || s.SteerByCPU || s.Index() == 1
+
+	for _, conn := range conns {
+		// the sockets of systemd are not created by listen
+		if err := enableOOB(conn); err != nil {
+			s.ErrorLog.Printf("forkserver-%d enable pktinfo on addr=%s failed: %+v", s.Index(), conn.LocalAddr(), err)
+		}
+	}
+
+	if len(conns) == 0 {
+		// so_reuseport listen for performance
+		conn, err := listen("udp", addr, s.ListenConfig, s.ErrorLog)
+		if err != nil {
+			s.ErrorLog.Printf("forkserver-%d listen on addr=%s failed: %+v", s.Index(), addr, err)
+			return err
+		}
+		conns = append(conns, conn)
+	}
+
+	if err = setuser(s.User, s.Group); err != nil {
+		s.ErrorLog.Printf("forkserver-%d set user=%s group=%s failed: %+v", s.Index(), s.User, s.Group, err)
 		return err
 	}
 
 	// s.ErrorLog.Printf("forkserver-%d pid-%d serving dns on %s", s.Index(), os.Getpid(), conn.LocalAddr())
 
-	return serve(conn, s.Handler, s.Stats, s.ErrorLog, s.Concurrency)
+	handler := newServerHandler(s.Handler, s.Stats, s.ErrorLog, s.PanicHandler, s.HandlerTimeout, s.BaseContext)
+
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			err := serveTCP(ln, handler, s.Stats, s.ErrorLog, s.ReadTimeout, s.IdleTimeout)
+			s.ErrorLog.Printf("forkserver-%d serve on addr=%s failed: %+v", s.Index(), ln.Addr(), err)
+		}(ln)
+	}
+
+	for _, conn := range conns[1:] {
+		go func(conn *net.UDPConn) {
+			err := serve(conn, handler, s.Stats, s.ErrorLog, s.Concurrency, s.OverloadPolicy, s.Backlog, reportDrops)
+			s.ErrorLog.Printf("forkserver-%d serve on addr=%s failed: %+v", s.Index(), conn.LocalAddr(), err)
+		}(conn)
+	}
+
+	return serve(conns[0], handler, s.Stats, s.ErrorLog, s.Concurrency, s.OverloadPolicy, s.Backlog, reportDrops)
+}
+
+// listenFiles returns the sockets to be passed to each child process.
+func (s *ForkServer) listenFiles(addr string, maxProcs int) (files [][]*os.File, err error) {
+	if maxProcs == 0 {
+		maxProcs = runtime.NumCPU()
+	}
+	if runtime.GOOS != "linux" {
+		maxProcs = 1
+	}
+
+	if s.SteerByCPU {
+		// the socket index in reuseport group is the order of binding
+		conns := make([]*net.UDPConn, maxProcs)
+		for i := range conns {
+			if conns[i], err = listen("udp", addr, s.ListenConfig, s.ErrorLog); err != nil {
+				return
+			}
+		}
+		if err = attachReusePortCPU(conns[0], maxProcs); err != nil {
+			return
+		}
+		for _, conn := range conns {
+			var file *os.File
+			if file, err = conn.File(); err != nil {
+				return
+			}
+			files = append(files, []*os.File{file})
+		}
+		return
+	}
+
+	conns, lns, err := SystemdSockets()
+	if err != nil {
+		return
+	}
+
+	if len(conns) == 0 && s.InheritListener {
+		var conn *net.UDPConn
+		if conn, err = listen("udp", addr, s.ListenConfig, s.ErrorLog); err != nil {
+			return
+		}
+		conns = append(conns, conn)
+	}
+
+	var shared []*os.File
+	for _, conn := range conns {
+		c, ok := conn.(*net.UDPConn)
+		if !ok {
+			continue
+		}
+		var file *os.File
+		if file, err = c.File(); err != nil {
+			return
+		}
+		shared = append(shared, file)
+	}
+	for _, ln := range lns {
+		l, ok := ln.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		var file *os.File
+		if file, err = l.File(); err != nil {
+			return
+		}
+		shared = append(shared, file)
+	}
+
+	if len(shared) != 0 {
+		for i := 0; i < maxProcs; i++ {
+			files = append(files, shared)
+		}
+	}
+
+	return
 }
 
 // Index indicates the index of Server instances.
@@ -69,16 +249,27 @@ func (s *ForkServer) Index() (index int) {
 	return
 }
 
-func fork(index int) (*exec.Cmd, error) {
+func fork(index int, files []*os.File) (*exec.Cmd, error) {
 	/* #nosec G204 */
 	cmd := exec.Command(os.Args[0], os.Args[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Env = append([]string{"FASTDNS_CHILD_INDEX=" + strconv.Itoa(index)}, os.Environ()...)
+	cmd.ExtraFiles = files
+	cmd.Env = append([]string{
+		"FASTDNS_CHILD_INDEX=" + strconv.Itoa(index),
+		"FASTDNS_LISTEN_FDS=" + strconv.Itoa(len(files)),
+	}, os.Environ()...)
 	return cmd, cmd.Start()
 }
 
-func (s *ForkServer) fork(addr string, maxProcs int) (err error) {
+func childFiles(files [][]*os.File, index int) []*os.File {
+	if index > len(files) {
+		return nil
+	}
+	return files[index-1]
+}
+
+func (s *ForkServer) fork(addr string, maxProcs int, files [][]*os.File) (err error) {
 	type racer struct {
 		index int
 		pid   int
@@ -103,7 +294,7 @@ func (s *ForkServer) fork(addr string, maxProcs int) (err error) {
 
 	for i := 1; i <= maxProcs; i++ {
 		var cmd *exec.Cmd
-		if cmd, err = fork(i); err != nil {
+		if cmd, err = fork(i, childFiles(files, i)); err != nil {
 			s.ErrorLog.Printf("forkserver failed to start a child process, error: %v\n", err)
 			return
 		}
@@ -127,7 +318,7 @@ func (s *ForkServer) fork(addr string, maxProcs int) (err error) {
 		}
 
 		var cmd *exec.Cmd
-		if cmd, err = fork(sig.index); err != nil {
+		if cmd, err = fork(sig.index, childFiles(files, sig.index)); err != nil {
 			break
 		}
 		childs[cmd.Process.Pid] = cmd
@@ -73,6 +73,146 @@ func TestServerHost(t *testing.T) {
 	}
 }
 
+func TestServerServe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// On Windows, the resolver always uses C library functions, such as GetAddrInfo and DnsQuery.
+		return
+	}
+
+	s := &Server{
+		Handler:  &mockServerHandler{},
+		ErrorLog: log.Default(),
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp error: %+v", err)
+	}
+
+	go func() {
+		_ = s.Serve(conn)
+	}()
+	go func() {
+		_ = s.ServeListener(ln)
+	}()
+
+	for network, addr := range map[string]string{"udp": conn.LocalAddr().String(), "tcp": ln.Addr().String()} {
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}
+
+		ips, err := resolver.LookupHost(context.Background(), "example.org")
+		if err != nil {
+			t.Errorf("LookupHost over %s return error: %+v", network, err)
+		}
+		if len(ips) == 0 || ips[0] != "1.1.1.1" {
+			t.Errorf("LookupHost over %s return mismatched reply: %+v", network, ips)
+		}
+	}
+}
+
+func TestServerServePktinfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("IP_PKTINFO only works on linux")
+	}
+
+	s := &Server{
+		Handler:  &mockServerHandler{},
+		ErrorLog: log.Default(),
+	}
+
+	// the wildcard socket replies from the destination address of requests only with IP_PKTINFO
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("listen packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		_ = s.Serve(conn)
+	}()
+
+	client := &Client{
+		AddrPort:    netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), conn.LocalAddr().(*net.UDPAddr).AddrPort().Port()),
+		ReadTimeout: time.Second,
+	}
+
+	req, resp := AcquireMessage(), AcquireMessage()
+	defer ReleaseMessage(req)
+	defer ReleaseMessage(resp)
+
+	req.SetRequestQuestion("example.org", TypeA, ClassINET)
+	if err := client.Exchange(req, resp); err != nil {
+		t.Errorf("Serve shall reply from the destination address 127.0.0.2, got %+v", err)
+	}
+}
+
+func TestServerListenerTimeout(t *testing.T) {
+	s := &Server{
+		Handler:     &mockServerHandler{},
+		ErrorLog:    log.Default(),
+		ReadTimeout: 100 * time.Millisecond,
+		IdleTimeout: 200 * time.Millisecond,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp error: %+v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		_ = s.ServeListener(ln)
+	}()
+
+	for _, c := range []struct {
+		Name    string
+		Data    []byte
+		Timeout time.Duration
+	}{
+		{"idle", nil, s.IdleTimeout},
+		{"partial", []byte{0x00, 0x20, 0x00}, s.ReadTimeout},
+	} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("dial tcp error: %+v", err)
+		}
+		_, _ = conn.Write(c.Data)
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		start := time.Now()
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() || time.Since(start) < c.Timeout/2 {
+			t.Errorf("%s connection shall be closed by server in %s, got %+v in %s", c.Name, c.Timeout, err, time.Since(start))
+		}
+		conn.Close()
+	}
+}
+
+func TestServerServeUnsupportedConn(t *testing.T) {
+	s := &Server{
+		Handler:  &mockServerHandler{},
+		ErrorLog: log.Default(),
+	}
+
+	conn, err := net.ListenPacket("ip4:1", "127.0.0.1")
+	if err != nil {
+		t.Skipf("listen ip packet error: %+v", err)
+	}
+	defer conn.Close()
+
+	if err := s.Serve(conn); err != ErrUnsupportedConn {
+		t.Errorf("Serve(%T) shall return ErrUnsupportedConn but got %+v", conn, err)
+	}
+}
+
 func TestServerListenError(t *testing.T) {
 	s := &Server{
 		Handler:  &mockServerHandler{},
@@ -202,3 +342,30 @@ func TestServerForkParseMessageError(t *testing.T) {
 
 	_, _ = conn.Write([]byte{0x00, 0x02, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 }
+
+func TestSocketDrops(t *testing.T) {
+	var drops uint32
+
+	cases := []struct {
+		Overflow    uint32
+		HasOverflow bool
+		Drops       uint64
+	}{
+		{0, false, 0},
+		{3, true, 3},
+		// the packets without the counter
+		{0, false, 0},
+		{5, true, 2},
+		{5, true, 0},
+		{0, false, 0},
+		// the decreased counter
+		{1, true, 0},
+		{4, true, 3},
+	}
+
+	for i, c := range cases {
+		if n := socketDrops(&drops, c.Overflow, c.HasOverflow); n != c.Drops {
+			t.Errorf("socketDrops #%d (%d, %v) return %d, expect %d", i, c.Overflow, c.HasOverflow, n, c.Drops)
+		}
+	}
+}
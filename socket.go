@@ -0,0 +1,89 @@
+package fastdns
+
+import (
+	"net"
+	"os"
+	"strconv"
+)
+
+// ListenConfig contains options for the UDP sockets of server, zero values leave the system defaults.
+// Most of options only work on linux.
+type ListenConfig struct {
+	// ReadBuffer sets SO_RCVBUF of the socket.
+	ReadBuffer int
+
+	// WriteBuffer sets SO_SNDBUF of the socket.
+	WriteBuffer int
+
+	// ForceBuffer uses SO_RCVBUFFORCE/SO_SNDBUFFORCE to override the rmem_max/wmem_max limits, requires CAP_NET_ADMIN.
+	ForceBuffer bool
+
+	// FreeBind sets IP_FREEBIND to allow binding to a nonlocal or not yet existing address.
+	FreeBind bool
+
+	// V6Only sets IPV6_V6ONLY to restrict an IPv6 socket to IPv6 communication only.
+	V6Only bool
+
+	// Device sets SO_BINDTODEVICE to bind the socket to the network interface.
+	Device string
+
+	// TOS sets IP_TOS/IPV6_TCLASS for outgoing packets, the DSCP value is TOS>>2.
+	TOS int
+}
+
+// listenFdsStart is the first file descriptor passed by systemd or ForkServer parent, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// SystemdSockets returns the UDP and TCP sockets passed by systemd socket activation.
+// It returns empty results if LISTEN_PID does not match the current process. The LISTEN_PID,
+// LISTEN_FDS and LISTEN_FDNAMES variables are unset, so the child processes do not inherit them.
+func SystemdSockets() (conns []net.PacketConn, lns []net.Listener, err error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() {
+		return
+	}
+
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		if conn, e := net.FilePacketConn(file); e == nil {
+			conns = append(conns, conn)
+		} else if ln, e := net.FileListener(file); e == nil {
+			lns = append(lns, ln)
+		} else {
+			err = e
+		}
+		file.Close()
+	}
+
+	return
+}
+
+// inheritedSockets returns the UDP and TCP sockets passed by ForkServer parent via ExtraFiles.
+func inheritedSockets() (conns []*net.UDPConn, lns []net.Listener, err error) {
+	n, _ := strconv.Atoi(os.Getenv("FASTDNS_LISTEN_FDS"))
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		file := os.NewFile(uintptr(fd), "FASTDNS_LISTEN_FD_"+strconv.Itoa(fd))
+		if conn, e := net.FilePacketConn(file); e == nil {
+			if c, ok := conn.(*net.UDPConn); ok {
+				conns = append(conns, c)
+			} else {
+				conn.Close()
+				err = ErrUnsupportedConn
+			}
+		} else if ln, e := net.FileListener(file); e == nil {
+			lns = append(lns, ln)
+		} else {
+			err = e
+		}
+		file.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return
+}
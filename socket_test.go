@@ -0,0 +1,31 @@
+package fastdns
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestSystemdSockets(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	conns, lns, err := SystemdSockets()
+	if len(conns) != 0 || len(lns) != 0 || err != nil {
+		t.Errorf("SystemdSockets() shall ignore mismatched LISTEN_PID, got conns=%+v lns=%+v err=%+v", conns, lns, err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "0")
+
+	conns, lns, err = SystemdSockets()
+	if len(conns) != 0 || len(lns) != 0 || err != nil {
+		t.Errorf("SystemdSockets() shall return empty sockets, got conns=%+v lns=%+v err=%+v", conns, lns, err)
+	}
+
+	if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("SystemdSockets() shall unset LISTEN_PID and LISTEN_FDS")
+	}
+}
@@ -12,7 +12,35 @@ type Stats interface {
 	AppendOpenMetrics(dst []byte) []byte
 }
 
+// SocketStats is an optional interface implemented by Stats to record socket level counters.
+type SocketStats interface {
+	// UpdateSocketStats records the number of packets dropped by the socket receive queue.
+	UpdateSocketStats(drops uint64)
+}
+
+// PanicStats is an optional interface implemented by Stats to record the panics recovered from handlers.
+type PanicStats interface {
+	// UpdatePanicStats records a panic recovered from handler.
+	UpdatePanicStats()
+}
+
+// WorkerStats is an optional interface implemented by Stats to record the worker pool of server.
+type WorkerStats interface {
+	// UpdateWorkerStats records the changes of active workers and queued requests, and the number of dropped requests.
+	UpdateWorkerStats(workers, queued int64, drops uint64)
+}
+
+// RRLStats is an optional interface implemented by Stats to record the responses limited by RRL.
+type RRLStats interface {
+	// UpdateRRLStats records a limited response of class, and whether it is slipped.
+	UpdateRRLStats(class RRLClass, slipped bool)
+}
+
 var _ Stats = (*CoreStats)(nil)
+var _ SocketStats = (*CoreStats)(nil)
+var _ PanicStats = (*CoreStats)(nil)
+var _ WorkerStats = (*CoreStats)(nil)
+var _ RRLStats = (*CoreStats)(nil)
 
 type CoreStats struct {
 	RequestCountTotal uint64
@@ -94,6 +122,21 @@ type CoreStats struct {
 	ResponseSizeBytesSum          uint64
 	ResponseSizeBytesCount        uint64
 
+	SocketReceiveQueueDropsTotal uint64
+
+	PanicsTotal uint64
+
+	WorkersActive       int64
+	RequestQueueDepth   int64
+	RequestDroppedTotal uint64
+
+	RRLLimitedTotal_ANSWER   uint64
+	RRLLimitedTotal_NXDOMAIN uint64
+	RRLLimitedTotal_ERROR    uint64
+	RRLSlippedTotal_ANSWER   uint64
+	RRLSlippedTotal_NXDOMAIN uint64
+	RRLSlippedTotal_ERROR    uint64
+
 	Prefix, Family, Proto, Server, Zone string
 }
 
@@ -260,6 +303,46 @@ func (s *CoreStats) UpdateStats(addr netip.AddrPort, msg *Message, duration time
 	atomic.AddUint64(&s.ResponseSizeBytesCount, 1)
 }
 
+func (s *CoreStats) UpdateSocketStats(drops uint64) {
+	atomic.AddUint64(&s.SocketReceiveQueueDropsTotal, drops)
+}
+
+func (s *CoreStats) UpdatePanicStats() {
+	atomic.AddUint64(&s.PanicsTotal, 1)
+}
+
+func (s *CoreStats) UpdateWorkerStats(workers, queued int64, drops uint64) {
+	if workers != 0 {
+		atomic.AddInt64(&s.WorkersActive, workers)
+	}
+	if queued != 0 {
+		atomic.AddInt64(&s.RequestQueueDepth, queued)
+	}
+	if drops != 0 {
+		atomic.AddUint64(&s.RequestDroppedTotal, drops)
+	}
+}
+
+func (s *CoreStats) UpdateRRLStats(class RRLClass, slipped bool) {
+	switch class {
+	case RRLClassAnswer:
+		atomic.AddUint64(&s.RRLLimitedTotal_ANSWER, 1)
+		if slipped {
+			atomic.AddUint64(&s.RRLSlippedTotal_ANSWER, 1)
+		}
+	case RRLClassNXDomain:
+		atomic.AddUint64(&s.RRLLimitedTotal_NXDOMAIN, 1)
+		if slipped {
+			atomic.AddUint64(&s.RRLSlippedTotal_NXDOMAIN, 1)
+		}
+	default:
+		atomic.AddUint64(&s.RRLLimitedTotal_ERROR, 1)
+		if slipped {
+			atomic.AddUint64(&s.RRLSlippedTotal_ERROR, 1)
+		}
+	}
+}
+
 func (s *CoreStats) AppendOpenMetrics(dst []byte) []byte {
 	return s.template(dst, `
 {prefix}dns_request_count_total{family="{family}",proto="{proto}",server="{server}",zone="{zone}"} {request_count_total}
@@ -335,6 +418,17 @@ func (s *CoreStats) AppendOpenMetrics(dst []byte) []byte {
 {prefix}dns_response_size_bytes_bucket{proto="{proto}",server="{server}",zone="{zone}",le="+Inf"} {response_size_bytes_bucket_inf}
 {prefix}dns_response_size_bytes_sum{proto="{proto}",server="{server}",zone="{zone}"} {response_size_bytes_sum}
 {prefix}dns_response_size_bytes_count{proto="{proto}",server="{server}",zone="{zone}"} {response_size_bytes_count}
+{prefix}dns_socket_receive_queue_drops_total{proto="{proto}",server="{server}",zone="{zone}"} {socket_receive_queue_drops_total}
+{prefix}dns_panics_total{proto="{proto}",server="{server}",zone="{zone}"} {panics_total}
+{prefix}dns_workers_active{proto="{proto}",server="{server}",zone="{zone}"} {workers_active}
+{prefix}dns_request_queue_depth{proto="{proto}",server="{server}",zone="{zone}"} {request_queue_depth}
+{prefix}dns_request_dropped_total{proto="{proto}",server="{server}",zone="{zone}"} {request_dropped_total}
+{prefix}dns_rrl_limited_total{server="{server}",zone="{zone}",class="answer"} {rrl_limited_total_answer}
+{prefix}dns_rrl_limited_total{server="{server}",zone="{zone}",class="nxdomain"} {rrl_limited_total_nxdomain}
+{prefix}dns_rrl_limited_total{server="{server}",zone="{zone}",class="error"} {rrl_limited_total_error}
+{prefix}dns_rrl_slipped_total{server="{server}",zone="{zone}",class="answer"} {rrl_slipped_total_answer}
+{prefix}dns_rrl_slipped_total{server="{server}",zone="{zone}",class="nxdomain"} {rrl_slipped_total_nxdomain}
+{prefix}dns_rrl_slipped_total{server="{server}",zone="{zone}",class="error"} {rrl_slipped_total_error}
 `, '{', '}')
 }
 
@@ -504,6 +598,28 @@ func (s *CoreStats) template(dst []byte, template string, startTag, endTag byte)
 				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.ResponseSizeBytesSum), 10)
 			case "response_size_bytes_count":
 				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.ResponseSizeBytesCount), 10)
+			case "socket_receive_queue_drops_total":
+				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.SocketReceiveQueueDropsTotal), 10)
+			case "panics_total":
+				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.PanicsTotal), 10)
+			case "workers_active":
+				dst = strconv.AppendInt(dst, atomic.LoadInt64(&s.WorkersActive), 10)
+			case "request_queue_depth":
+				dst = strconv.AppendInt(dst, atomic.LoadInt64(&s.RequestQueueDepth), 10)
+			case "request_dropped_total":
+				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.RequestDroppedTotal), 10)
+			case "rrl_limited_total_answer":
+				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.RRLLimitedTotal_ANSWER), 10)
+			case "rrl_limited_total_nxdomain":
+				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.RRLLimitedTotal_NXDOMAIN), 10)
+			case "rrl_limited_total_error":
+				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.RRLLimitedTotal_ERROR), 10)
+			case "rrl_slipped_total_answer":
+				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.RRLSlippedTotal_ANSWER), 10)
+			case "rrl_slipped_total_nxdomain":
+				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.RRLSlippedTotal_NXDOMAIN), 10)
+			case "rrl_slipped_total_error":
+				dst = strconv.AppendUint(dst, atomic.LoadUint64(&s.RRLSlippedTotal_ERROR), 10)
 			default:
 				dst = append(dst, template[j:i]...)
 				offset = 0
@@ -3,10 +3,29 @@ package fastdns
 import (
 	"encoding/hex"
 	"net/netip"
+	"strings"
 	"testing"
 	"time"
 )
 
+func TestCoreStatsSocketStats(t *testing.T) {
+	stats := &CoreStats{
+		Prefix: "coredns_",
+		Family: "1",
+		Proto:  "udp",
+		Server: "dns://:53",
+		Zone:   ".",
+	}
+
+	stats.UpdateSocketStats(3)
+	stats.UpdateSocketStats(4)
+
+	want := `coredns_dns_socket_receive_queue_drops_total{proto="udp",server="dns://:53",zone="."} 7`
+	if got := string(stats.AppendOpenMetrics(nil)); !strings.Contains(got, want) {
+		t.Errorf("AppendOpenMetrics() shall contain %#v", want)
+	}
+}
+
 func BenchmarkUpdateStats(b *testing.B) {
 	payload, _ := hex.DecodeString("8e5281800001000200000000047632657803636f6d0000020001c00c000200010000545f0014036b696d026e730a636c6f7564666c617265c011c00c000200010000545f000704746f6464c02a")
 
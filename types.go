@@ -143,6 +143,16 @@ func (f Flags) Z() byte {
 	return byte((f & 0b0000000001110000) >> 4)
 }
 
+// AD is AD bit of Z bits in Flags, see RFC 4035
+func (f Flags) AD() byte {
+	return byte((f & 0b0000000000100000) >> 5)
+}
+
+// CD is CD bit of Z bits in Flags, see RFC 4035
+func (f Flags) CD() byte {
+	return byte((f & 0b0000000000010000) >> 4)
+}
+
 // Rcode is Rcode in Flags
 func (f Flags) Rcode() Rcode {
 	return Rcode((f & 0b0000000000001111))
@@ -255,6 +265,7 @@ const (
 	TypeLP         Type = 107
 	TypeEUI48      Type = 108
 	TypeEUI64      Type = 109
+	TypeNXNAME     Type = 128 // RFC 9824
 	TypeURI        Type = 256
 	TypeCAA        Type = 257
 	TypeAVC        Type = 258
@@ -414,6 +425,8 @@ func (t Type) String() string {
 		return "EUI48"
 	case TypeEUI64:
 		return "EUI64"
+	case TypeNXNAME:
+		return "NXNAME"
 	case TypeURI:
 		return "URI"
 	case TypeCAA:
@@ -587,6 +600,8 @@ func ParseType(s string) (t Type) {
 		t = TypeEUI48
 	case "EUI64", "eui64":
 		t = TypeEUI64
+	case "NXNAME", "nxname":
+		t = TypeNXNAME
 	case "URI", "uri":
 		t = TypeURI
 	case "CAA", "caa":
@@ -156,6 +156,7 @@ func TestType(t *testing.T) {
 		{TypeLP, "LP"},
 		{TypeEUI48, "EUI48"},
 		{TypeEUI64, "EUI64"},
+		{TypeNXNAME, "NXNAME"},
 		{TypeURI, "URI"},
 		{TypeCAA, "CAA"},
 		{TypeAVC, "AVC"},
@@ -6,6 +6,11 @@ import (
 
 // EncodeDomain encodes domain to dst.
 func EncodeDomain(dst []byte, domain string) []byte {
+	if domain == "" {
+		// root
+		return append(dst, 0)
+	}
+
 	i := len(dst)
 	j := i + len(domain)
 
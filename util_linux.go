@@ -4,17 +4,31 @@ package fastdns
 
 import (
 	"context"
+	"log"
 	"net"
+	"net/netip"
+	"os"
+	"os/user"
+	"strconv"
 	"syscall"
 	"unsafe"
 )
 
-func listen(network, address string) (*net.UDPConn, error) {
+func listen(network, address string, config *ListenConfig, logger *log.Logger) (*net.UDPConn, error) {
 	lc := &net.ListenConfig{
 		Control: func(network, address string, conn syscall.RawConn) error {
 			return conn.Control(func(fd uintptr) {
 				const SO_REUSEPORT = 15
 				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_REUSEPORT, 1)
+				setoobopts(int(fd))
+				if config == nil {
+					return
+				}
+				for _, err := range setsockopts(int(fd), network, config) {
+					if logger != nil {
+						logger.Printf("listen on addr=%s set socket option failed: %+v", address, err)
+					}
+				}
 			})
 		},
 	}
@@ -27,6 +41,179 @@ func listen(network, address string) (*net.UDPConn, error) {
 	return conn.(*net.UDPConn), nil
 }
 
+// enableOOB enables the control messages of conn which is not created by listen, e.g. the sockets passed to
+// Server.Serve or by systemd.
+func enableOOB(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rc.Control(func(fd uintptr) {
+		setoobopts(int(fd))
+	})
+}
+
+func setoobopts(fd int) {
+	// receive the destination address of packets for replying from it.
+	_ = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+	_ = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	// receive the number of packets dropped by the socket receive queue.
+	_ = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+}
+
+func setsockopts(fd int, network string, config *ListenConfig) (errs []error) {
+	setsockopt := func(name string, level, opt, value int) {
+		if err := syscall.SetsockoptInt(fd, level, opt, value); err != nil {
+			errs = append(errs, &os.SyscallError{Syscall: "setsockopt " + name, Err: err})
+		}
+	}
+
+	ipv6 := network == "udp6"
+
+	if config.ReadBuffer > 0 {
+		if config.ForceBuffer {
+			setsockopt("SO_RCVBUFFORCE", syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, config.ReadBuffer)
+		} else {
+			setsockopt("SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, config.ReadBuffer)
+		}
+	}
+	if config.WriteBuffer > 0 {
+		if config.ForceBuffer {
+			setsockopt("SO_SNDBUFFORCE", syscall.SOL_SOCKET, syscall.SO_SNDBUFFORCE, config.WriteBuffer)
+		} else {
+			setsockopt("SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, config.WriteBuffer)
+		}
+	}
+	if config.FreeBind {
+		setsockopt("IP_FREEBIND", syscall.IPPROTO_IP, syscall.IP_FREEBIND, 1)
+	}
+	if config.V6Only && ipv6 {
+		setsockopt("IPV6_V6ONLY", syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+	}
+	if config.Device != "" {
+		if err := syscall.BindToDevice(fd, config.Device); err != nil {
+			errs = append(errs, &os.SyscallError{Syscall: "setsockopt SO_BINDTODEVICE", Err: err})
+		}
+	}
+	if config.TOS > 0 {
+		if ipv6 {
+			setsockopt("IPV6_TCLASS", syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, config.TOS)
+		}
+		// also applies to ipv4 packets of dual stack sockets
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, config.TOS); err != nil && !ipv6 {
+			errs = append(errs, &os.SyscallError{Syscall: "setsockopt IP_TOS", Err: err})
+		}
+	}
+
+	return
+}
+
+// parseOOB returns the destination address of packet from IP_PKTINFO/IPV6_PKTINFO control message,
+// and the number of packets dropped by the socket receive queue from SO_RXQ_OVFL control message, which
+// is attached by kernel only if the number is not zero.
+func parseOOB(oob []byte) (addr netip.Addr, drops uint32, hasOverflow bool) {
+	for len(oob) >= syscall.SizeofCmsghdr {
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		if int(h.Len) < syscall.SizeofCmsghdr || int(h.Len) > len(oob) {
+			break
+		}
+		data := oob[syscall.CmsgLen(0):h.Len]
+		switch {
+		case h.Level == syscall.IPPROTO_IP && h.Type == syscall.IP_PKTINFO && len(data) >= syscall.SizeofInet4Pktinfo:
+			info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			addr = netip.AddrFrom4(info.Addr)
+		case h.Level == syscall.IPPROTO_IPV6 && h.Type == syscall.IPV6_PKTINFO && len(data) >= syscall.SizeofInet6Pktinfo:
+			info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			addr = netip.AddrFrom16(info.Addr)
+		case h.Level == syscall.SOL_SOCKET && h.Type == syscall.SO_RXQ_OVFL && len(data) >= 4:
+			drops, hasOverflow = *(*uint32)(unsafe.Pointer(&data[0])), true
+		}
+		n := syscall.CmsgSpace(len(data))
+		if n > len(oob) {
+			break
+		}
+		oob = oob[n:]
+	}
+	return
+}
+
+// appendPktinfo appends an IP_PKTINFO/IPV6_PKTINFO control message which sets the source address of packet.
+func appendPktinfo(dst []byte, src netip.Addr) []byte {
+	var zero [64]byte
+	switch {
+	case src.Is4():
+		i := len(dst)
+		dst = append(dst, zero[:syscall.CmsgSpace(syscall.SizeofInet4Pktinfo)]...)
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&dst[i]))
+		h.Level = syscall.IPPROTO_IP
+		h.Type = syscall.IP_PKTINFO
+		h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+		info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&dst[i+syscall.CmsgLen(0)]))
+		info.Spec_dst = src.As4()
+	case src.Is6():
+		i := len(dst)
+		dst = append(dst, zero[:syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)]...)
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&dst[i]))
+		h.Level = syscall.IPPROTO_IPV6
+		h.Type = syscall.IPV6_PKTINFO
+		h.SetLen(syscall.CmsgLen(syscall.SizeofInet6Pktinfo))
+		info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&dst[i+syscall.CmsgLen(0)]))
+		info.Addr = src.As16()
+	}
+	return dst
+}
+
+// attachReusePortCPU attaches a classic BPF program to the reuseport group of conn,
+// which selects the socket of index (cpu % n) for the packets received by cpu.
+func attachReusePortCPU(conn *net.UDPConn, n int) error {
+	const (
+		SO_ATTACH_REUSEPORT_CBPF = 51
+
+		BPF_LD  = 0x00
+		BPF_W   = 0x00
+		BPF_ABS = 0x20
+		BPF_ALU = 0x04
+		BPF_MOD = 0x90
+		BPF_K   = 0x00
+		BPF_RET = 0x06
+		BPF_A   = 0x10
+
+		SKF_AD_OFF = 0xfffff000 // -0x1000 in uint32
+		SKF_AD_CPU = 36
+	)
+
+	filter := []syscall.SockFilter{
+		// A = raw_smp_processor_id()
+		{Code: BPF_LD | BPF_W | BPF_ABS, K: SKF_AD_OFF + SKF_AD_CPU},
+		// A = A % n
+		{Code: BPF_ALU | BPF_MOD | BPF_K, K: uint32(n)},
+		// return A
+		{Code: BPF_RET | BPF_A},
+	}
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var e syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, e = syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, syscall.SOL_SOCKET, SO_ATTACH_REUSEPORT_CBPF, uintptr(unsafe.Pointer(&prog)), unsafe.Sizeof(prog), 0)
+	})
+	if err != nil {
+		return err
+	}
+	if e != 0 {
+		return &os.SyscallError{Syscall: "setsockopt SO_ATTACH_REUSEPORT_CBPF", Err: e}
+	}
+
+	return nil
+}
+
 func taskset(cpu int) error {
 	const SYS_SCHED_SETAFFINITY = 203
 
@@ -40,3 +227,49 @@ func taskset(cpu int) error {
 
 	return e
 }
+
+// setuser switches the current process to the given user and group.
+func setuser(username, groupname string) error {
+	uid, gid := os.Getuid(), os.Getgid()
+
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			if u, err = user.LookupId(username); err != nil {
+				return err
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return err
+		}
+	}
+
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupname); err != nil {
+				return err
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+
+	if uid == os.Getuid() && gid == os.Getgid() {
+		return nil
+	}
+
+	// drop supplementary groups first, it requires privileges.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+
+	return syscall.Setuid(uid)
+}
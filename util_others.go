@@ -4,16 +4,57 @@ package fastdns
 
 import (
 	"errors"
+	"log"
 	"net"
+	"net/netip"
 )
 
-func listen(network, address string) (*net.UDPConn, error) {
+func listen(network, address string, config *ListenConfig, logger *log.Logger) (*net.UDPConn, error) {
 	laddr, err := net.ResolveUDPAddr(network, address)
 	if err != nil {
 		return nil, err
 	}
 
-	return net.ListenUDP(network, laddr)
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil || config == nil {
+		return conn, err
+	}
+
+	if config.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(config.ReadBuffer); err != nil && logger != nil {
+			logger.Printf("listen on addr=%s set socket option failed: %+v", address, err)
+		}
+	}
+	if config.WriteBuffer > 0 {
+		if err := conn.SetWriteBuffer(config.WriteBuffer); err != nil && logger != nil {
+			logger.Printf("listen on addr=%s set socket option failed: %+v", address, err)
+		}
+	}
+
+	return conn, nil
+}
+
+func enableOOB(conn *net.UDPConn) error {
+	return nil
+}
+
+func parseOOB(oob []byte) (addr netip.Addr, drops uint32, hasOverflow bool) {
+	return
+}
+
+func appendPktinfo(dst []byte, src netip.Addr) []byte {
+	return dst
+}
+
+func setuser(username, groupname string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+	return errors.New("not implemented")
+}
+
+func attachReusePortCPU(conn *net.UDPConn, n int) error {
+	return errors.New("not implemented")
 }
 
 func taskset(cpu int) error {
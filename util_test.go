@@ -1,7 +1,13 @@
 package fastdns
 
 import (
+	"bytes"
+	"log"
+	"net"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -12,6 +18,7 @@ func TestEncodeDomain(t *testing.T) {
 	}{
 		{"phus.lu", "\x04phus\x02lu\x00"},
 		{"splunk.phus.lu", "\x06splunk\x04phus\x02lu\x00"},
+		{"", "\x00"},
 	}
 
 	for _, c := range cases {
@@ -26,14 +33,14 @@ func TestListen(t *testing.T) {
 		return
 	}
 
-	_, err := listen("udp", ":65537")
+	_, err := listen("udp", ":65537", nil, nil)
 	if err == nil {
 		t.Errorf("listen(:65537) at shall return error but empty")
 	}
 
 	var addr = ":19841"
 	for i := 1; i <= 64; i++ {
-		_, err := listen("udp", addr)
+		_, err := listen("udp", addr, nil, nil)
 		if err != nil {
 			t.Errorf("listen(%+v) at %d times got error: %+v", addr, i, err)
 		}
@@ -56,9 +63,122 @@ func TestTastset(t *testing.T) {
 	}
 }
 
+func TestListenConfig(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	var logs bytes.Buffer
+	config := &ListenConfig{
+		ReadBuffer:  256 * 1024,
+		WriteBuffer: 256 * 1024,
+		FreeBind:    true,
+		TOS:         0xb8,
+		Device:      "fastdns-nonexistent",
+	}
+
+	conn, err := listen("udp", "127.0.0.1:0", config, log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatalf("listen(127.0.0.1:0) error: %+v", err)
+	}
+	defer conn.Close()
+
+	if !strings.Contains(logs.String(), "SO_BINDTODEVICE") {
+		t.Errorf("listen shall log SO_BINDTODEVICE error but got %#v", logs.String())
+	}
+	if strings.Contains(logs.String(), "IP_TOS") {
+		t.Errorf("listen shall not log IP_TOS error but got %#v", logs.String())
+	}
+}
+
+func TestAttachReusePortCPU(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	conn1, err := listen("udp", "127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatalf("listen(127.0.0.1:0) error: %+v", err)
+	}
+	defer conn1.Close()
+
+	conn2, err := listen("udp", conn1.LocalAddr().String(), nil, nil)
+	if err != nil {
+		t.Fatalf("listen(%s) error: %+v", conn1.LocalAddr(), err)
+	}
+	defer conn2.Close()
+
+	if err := attachReusePortCPU(conn1, 2); err != nil {
+		t.Errorf("attachReusePortCPU(%s, 2) error: %+v", conn1.LocalAddr(), err)
+	}
+}
+
+func TestSetuser(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	if err := setuser("", ""); err != nil {
+		t.Errorf("setuser(\"\", \"\") error: %+v", err)
+	}
+
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	if err := setuser(uid, gid); err != nil {
+		t.Errorf("setuser(%s, %s) error: %+v", uid, gid, err)
+	}
+
+	if err := setuser("fastdns-nonexistent-user", ""); err == nil {
+		t.Errorf("setuser(fastdns-nonexistent-user) shall return error but empty")
+	}
+}
+
 func BenchmarkEncodeDomain(b *testing.B) {
 	dst := make([]byte, 0, 256)
 	for i := 0; i < b.N; i++ {
 		dst = EncodeDomain(dst[:0], "hk.phus.lu")
 	}
 }
+
+func TestPktinfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	conn, err := listen("udp", "127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatalf("listen(127.0.0.1:0) error: %+v", err)
+	}
+	defer conn.Close()
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial %+v error: %+v", conn.LocalAddr(), err)
+	}
+	defer client.Close()
+
+	_, _ = client.Write([]byte("test"))
+
+	buf, oob := make([]byte, 512), make([]byte, 64)
+	_, oobn, _, raddr, err := conn.ReadMsgUDPAddrPort(buf, oob)
+	if err != nil {
+		t.Fatalf("read msg error: %+v", err)
+	}
+
+	ip, drops, _ := parseOOB(oob[:oobn])
+	if got, want := ip.String(), "127.0.0.1"; got != want {
+		t.Errorf("parseOOB(%x) error got=%#v want=%#v", oob[:oobn], got, want)
+	}
+	if drops != 0 {
+		t.Errorf("parseOOB(%x) error got drops=%d", oob[:oobn], drops)
+	}
+
+	_, _, err = conn.WriteMsgUDPAddrPort([]byte("test"), appendPktinfo(nil, ip), raddr)
+	if err != nil {
+		t.Errorf("write msg with pktinfo error: %+v", err)
+	}
+
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "test" {
+		t.Errorf("read reply error: %+v data: %q", err, buf[:n])
+	}
+}
@@ -24,12 +24,20 @@ type workerPool struct {
 
 	Logger *log.Logger
 
+	// Stats optionally records the active workers and queued requests.
+	Stats WorkerStats
+
+	// Backlog is the maximum number of requests queued when all workers are busy, zero disables queueing.
+	Backlog int
+
 	lock         sync.Mutex
 	workersCount int
 	mustStop     bool
 
 	ready []*workerChan
 
+	backlog chan *udpCtx
+
 	stopCh chan struct{}
 
 	workerChanPool sync.Pool
@@ -50,6 +58,9 @@ func (wp *workerPool) Start() {
 	}
 	wp.stopCh = make(chan struct{})
 	stopCh := wp.stopCh
+	if wp.Backlog > 0 {
+		wp.backlog = make(chan *udpCtx, wp.Backlog)
+	}
 	wp.workerChanPool.New = func() interface{} {
 		return &workerChan{
 			ch: make(chan workerItem, workerChanCap),
@@ -146,12 +157,39 @@ func (wp *workerPool) clean(scratch *[]*workerChan) {
 func (wp *workerPool) Serve(ctx *udpCtx) bool {
 	ch := wp.getCh()
 	if ch == nil {
-		return false
+		return wp.enqueue(ctx)
 	}
 	ch.ch <- workerItem{ctx}
 	return true
 }
 
+// enqueue queues ctx into backlog, it must be serialized with release by wp.lock,
+// otherwise a queued ctx may be left when all workers become idle.
+func (wp *workerPool) enqueue(ctx *udpCtx) bool {
+	wp.lock.Lock()
+	ready := wp.ready
+	if n := len(ready) - 1; n >= 0 {
+		// a worker was released after getCh
+		ch := ready[n]
+		ready[n] = nil
+		wp.ready = ready[:n]
+		wp.lock.Unlock()
+		ch.ch <- workerItem{ctx}
+		return true
+	}
+	select {
+	case wp.backlog <- ctx:
+		wp.lock.Unlock()
+		if wp.Stats != nil {
+			wp.Stats.UpdateWorkerStats(0, 1, 0)
+		}
+		return true
+	default:
+		wp.lock.Unlock()
+		return false
+	}
+}
+
 var workerChanCap = func() int {
 	// Use blocking workerChan if GOMAXPROCS=1.
 	// This immediately switches Serve to WorkerFunc, which results
@@ -200,31 +238,53 @@ func (wp *workerPool) getCh() *workerChan {
 }
 
 func (wp *workerPool) release(ch *workerChan) bool {
-	ch.lastUseTime = time.Now()
-	wp.lock.Lock()
-	if wp.mustStop {
+	for {
+		ch.lastUseTime = time.Now()
+		wp.lock.Lock()
+		if wp.mustStop {
+			wp.lock.Unlock()
+			return false
+		}
+		select {
+		case ctx := <-wp.backlog:
+			wp.lock.Unlock()
+			if wp.Stats != nil {
+				wp.Stats.UpdateWorkerStats(0, -1, 0)
+			}
+			wp.serve(ctx)
+			continue
+		default:
+		}
+		wp.ready = append(wp.ready, ch)
 		wp.lock.Unlock()
-		return false
+		return true
+	}
+}
+
+func (wp *workerPool) serve(ctx *udpCtx) {
+	if wp.Stats != nil {
+		wp.Stats.UpdateWorkerStats(1, 0, 0)
+		defer wp.Stats.UpdateWorkerStats(-1, 0, 0)
+	}
+
+	// keep the addresses for logging, ctx is released by WorkerFunc.
+	laddr, raddr := ctx.rw.Conn.LocalAddr(), ctx.rw.AddrPort
+	if err := wp.WorkerFunc(ctx); err != nil {
+		if wp.LogAllErrors || !(err == ErrInvalidHeader || err == ErrInvalidQuestion) {
+			wp.Logger.Printf("error when serving connection %q<->%q: %s", laddr, raddr, err)
+		}
 	}
-	wp.ready = append(wp.ready, ch)
-	wp.lock.Unlock()
-	return true
 }
 
 func (wp *workerPool) workerFunc(ch *workerChan) {
 	var item workerItem
 
-	var err error
 	for item = range ch.ch {
 		if item.ctx == nil {
 			break
 		}
 
-		if err = wp.WorkerFunc(item.ctx); err != nil {
-			if wp.LogAllErrors || !(err == ErrInvalidHeader || err == ErrInvalidQuestion) {
-				wp.Logger.Printf("error when serving connection %q<->%q: %s", item.ctx.rw.Conn.LocalAddr(), item.ctx.rw.AddrPort, err)
-			}
-		}
+		wp.serve(item.ctx)
 		item.ctx = nil
 
 		if !wp.release(ch) {
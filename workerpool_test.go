@@ -0,0 +1,65 @@
+package fastdns
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolBacklog(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp error: %+v", err)
+	}
+	defer conn.Close()
+
+	var served int32
+	block := make(chan struct{})
+	stats := &CoreStats{}
+
+	pool := &workerPool{
+		WorkerFunc: func(ctx *udpCtx) error {
+			<-block
+			atomic.AddInt32(&served, 1)
+			return nil
+		},
+		MaxWorkersCount: 1,
+		Logger:          log.Default(),
+		Stats:           stats,
+		Backlog:         1,
+	}
+	pool.Start()
+	defer pool.Stop()
+
+	newCtx := func() *udpCtx {
+		return &udpCtx{rw: &udpResponseWriter{Conn: conn}, req: new(Message)}
+	}
+
+	if !pool.Serve(newCtx()) {
+		t.Errorf("workerPool.Serve shall dispatch the first ctx to worker")
+	}
+	if !pool.Serve(newCtx()) {
+		t.Errorf("workerPool.Serve shall queue the second ctx to backlog")
+	}
+	if pool.Serve(newCtx()) {
+		t.Errorf("workerPool.Serve shall reject the third ctx when backlog is full")
+	}
+	if got := atomic.LoadInt64(&stats.RequestQueueDepth); got != 1 {
+		t.Errorf("workerPool shall record queue depth 1 but got %d", got)
+	}
+
+	close(block)
+	time.Sleep(100 * time.Millisecond)
+
+	if got := atomic.LoadInt32(&served); got != 2 {
+		t.Errorf("workerPool shall serve the queued ctx, served=%d", got)
+	}
+	if got := atomic.LoadInt64(&stats.RequestQueueDepth); got != 0 {
+		t.Errorf("workerPool shall drain the queue but got depth %d", got)
+	}
+	if got := atomic.LoadInt64(&stats.WorkersActive); got != 0 {
+		t.Errorf("workerPool shall have no active workers but got %d", got)
+	}
+}
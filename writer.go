@@ -44,6 +44,8 @@ func (rw *MemResponseWriter) Write(p []byte) (n int, err error) {
 type udpResponseWriter struct {
 	Conn     *net.UDPConn
 	AddrPort netip.AddrPort
+	LocalIP  netip.Addr
+	OOB      []byte
 }
 
 func (rw *udpResponseWriter) RemoteAddr() netip.AddrPort {
@@ -51,10 +53,42 @@ func (rw *udpResponseWriter) RemoteAddr() netip.AddrPort {
 }
 
 func (rw *udpResponseWriter) LocalAddr() netip.AddrPort {
-	return rw.Conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	addrPort := rw.Conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	if rw.LocalIP.IsValid() {
+		addrPort = netip.AddrPortFrom(rw.LocalIP, addrPort.Port())
+	}
+	return addrPort
 }
 
 func (rw *udpResponseWriter) Write(p []byte) (n int, err error) {
-	n, _, err = rw.Conn.WriteMsgUDPAddrPort(p, nil, rw.AddrPort)
+	n, _, err = rw.Conn.WriteMsgUDPAddrPort(p, rw.OOB, rw.AddrPort)
+	return
+}
+
+type tcpResponseWriter struct {
+	Conn     net.Conn
+	AddrPort netip.AddrPort
+	buf      []byte
+}
+
+func (rw *tcpResponseWriter) RemoteAddr() netip.AddrPort {
+	return rw.AddrPort
+}
+
+func (rw *tcpResponseWriter) LocalAddr() netip.AddrPort {
+	if addr, ok := rw.Conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
+func (rw *tcpResponseWriter) Write(p []byte) (n int, err error) {
+	// length-prefixed framing, see RFC 1035 section 4.2.2.
+	rw.buf = append(rw.buf[:0], byte(len(p)>>8), byte(len(p)))
+	rw.buf = append(rw.buf, p...)
+	n, err = rw.Conn.Write(rw.buf)
+	if n >= 2 {
+		n -= 2
+	}
 	return
 }